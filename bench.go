@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/peferb/thumbnailer/thumbnailer"
+	"github.com/spf13/cobra"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Size of the synthetic image bench uses without samples, that of a
+// 6 megapixel photo.
+const (
+	benchImageWidth  = 3000
+	benchImageHeight = 2000
+)
+
+var (
+	benchSweep  []int
+	benchImages int
+	benchWidth  int
+	benchHeight int
+)
+
+// newBenchCommand returns the bench subcommand, which measures how many images
+// per second the pipeline thumbnails at a sweep of parallelism values.
+func newBenchCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "bench [file or directory...]",
+		Short: "Measure the throughput of sample images, or a synthetic one, at several parallelism values",
+		Args:  cobra.ArbitraryArgs,
+		Run:   runBench,
+	}
+
+	cmd.Flags().IntSliceVar(&benchSweep, "sweep", defaultSweep(), "Parallelism values to measure, e.g. 1,2,4,8")
+	cmd.Flags().IntVar(&benchImages, "images", 50, "Number of images processed at every parallelism value, cycling through the samples")
+	cmd.Flags().IntVarP(&benchWidth, "width", "w", 200, "Maximum width of the thumbnails")
+	cmd.Flags().IntVarP(&benchHeight, "height", "H", 0, "Maximum height of the thumbnails")
+	cmd.Flags().IntVarP(&compression, "compression", "c", 75, "Compression level (1-100) of JPEG, WebP and AVIF output")
+	cmd.Flags().StringVarP(&outputFormat, "format", "f", "jpeg", "Output image format (jpeg, png, apng, gif, bmp, tiff, webp, avif)")
+	cmd.Flags().StringVar(&filter, "filter", "lanczos", "Resample filter (lanczos, catmullrom, mitchell, linear, box, nearest)")
+	return cmd
+}
+
+// defaultSweep returns the powers of two up to the number of CPUs, and that
+// number itself.
+func defaultSweep() []int {
+	var sweep []int
+	for p := 1; p < runtime.NumCPU(); p *= 2 {
+		sweep = append(sweep, p)
+	}
+	return append(sweep, runtime.NumCPU())
+}
+
+func runBench(cmd *cobra.Command, args []string) {
+	if compression < 1 || compression > 100 {
+		fatalf("Compression must be between 1 (smallest files) and 100 (best quality), got %d", compression)
+	}
+	if !thumbnailer.SupportedFormat(outputFormat) {
+		fatalf("Unsupported output format: %s", outputFormat)
+	}
+	if !thumbnailer.SupportedFilter(filter) {
+		fatalf("Unsupported resample filter: %s", filter)
+	}
+	if benchWidth < 0 || benchHeight < 0 || benchWidth == 0 && benchHeight == 0 {
+		fatal("Either max width or max height must be specified")
+	}
+	if benchImages < 1 {
+		fatalf("Images must be at least 1, got %d", benchImages)
+	}
+	for _, p := range benchSweep {
+		if p < 1 {
+			fatalf("Parallelism must be at least 1, got %d", p)
+		}
+	}
+
+	thumb := thumbnailer.Thumbnailer{
+		Width:      benchWidth,
+		Height:     benchHeight,
+		Format:     outputFormat,
+		Quality:    compression,
+		Mode:       thumbnailer.ModeFit,
+		Filter:     filter,
+		AutoOrient: true,
+		Metadata:   thumbnailer.MetadataStrip,
+	}
+
+	samples := readBenchSamples(args)
+	if len(args) == 0 {
+		data, err := syntheticImage()
+		if err != nil {
+			fatalf("Error generating the synthetic image: %v", err)
+		}
+		samples = [][]byte{data}
+		log.Printf("Benchmarking a synthetic %dx%d JPEG", benchImageWidth, benchImageHeight)
+	}
+
+	// a first pass warms up caches and drops the samples that can't be
+	// processed, so they don't distort the measurements
+	var usable [][]byte
+	for _, data := range samples {
+		if err := thumb.Process(bytes.NewReader(data), io.Discard); err != nil {
+			log.Printf("Warning: skipping a sample: %v", err)
+			continue
+		}
+		usable = append(usable, data)
+	}
+	if len(usable) == 0 {
+		fatal("No sample image could be processed")
+	}
+	if len(args) > 0 {
+		log.Printf("Benchmarking %d sample images", len(usable))
+	}
+
+	fmt.Printf("%-12s %8s %10s %10s %10s %10s\n", "parallelism", "images", "time", "images/s", "p50", "p95")
+	for _, p := range benchSweep {
+		wall, stats := benchRun(&thumb, usable, p)
+		fmt.Printf("%-12d %8d %10v %10.1f %10v %10v\n", p, benchImages, wall.Round(time.Millisecond),
+			float64(benchImages)/wall.Seconds(), roundLatency(stats.percentile(50)), roundLatency(stats.percentile(95)))
+	}
+}
+
+// benchRun processes benchImages of samples with parallelism workers, and
+// returns the total time it took and the time of every image.
+func benchRun(thumb *thumbnailer.Thumbnailer, samples [][]byte, parallelism int) (time.Duration, *latencyStats) {
+	var (
+		stats latencyStats
+		mu    sync.Mutex
+		wg    sync.WaitGroup
+	)
+	jobs := make(chan []byte)
+	startTime := time.Now()
+	for i := 0; i < parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for data := range jobs {
+				imageStart := time.Now()
+				if err := thumb.Process(bytes.NewReader(data), io.Discard); err != nil {
+					fatalf("Error processing a sample: %v", err)
+				}
+				d := time.Since(imageStart)
+				mu.Lock()
+				stats.add(d)
+				mu.Unlock()
+			}
+		}()
+	}
+	for i := 0; i < benchImages; i++ {
+		jobs <- samples[i%len(samples)]
+	}
+	close(jobs)
+	wg.Wait()
+	return time.Since(startTime), &stats
+}
+
+// readBenchSamples reads the images given as args, and those in directories
+// among them, into memory, so reading them isn't part of the measurements.
+// RAW, HEIC and PDF files are skipped, as they're converted from disk.
+func readBenchSamples(args []string) [][]byte {
+	includeExts := extensionSet(thumbnailer.InputExtensions())
+	var samples [][]byte
+	for _, arg := range args {
+		err := filepath.Walk(arg, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() || !includeExts[strings.ToLower(filepath.Ext(path))] || needsExtracting(path) {
+				return nil
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			samples = append(samples, data)
+			return nil
+		})
+		if err != nil {
+			fatalf("Error reading samples: %v", err)
+		}
+	}
+	if len(args) > 0 && len(samples) == 0 {
+		fatal("No sample images found")
+	}
+	return samples
+}
+
+// syntheticImage returns a photo-sized JPEG of gradients and noise, which
+// compresses about as well as a real photo.
+func syntheticImage() ([]byte, error) {
+	img := image.NewNRGBA(image.Rect(0, 0, benchImageWidth, benchImageHeight))
+	rng := rand.New(rand.NewSource(1))
+	for y := 0; y < benchImageHeight; y++ {
+		for x := 0; x < benchImageWidth; x++ {
+			noise := rng.Intn(32)
+			img.SetNRGBA(x, y, color.NRGBA{
+				R: uint8(x*200/benchImageWidth) + uint8(noise),
+				G: uint8(y*200/benchImageHeight) + uint8(noise),
+				B: uint8((x+y)*200/(benchImageWidth+benchImageHeight)) + uint8(noise),
+				A: 0xff,
+			})
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/peferb/thumbnailer/thumbnailer"
+	"image"
+	"io"
+	"os"
+	"strings"
+)
+
+// blurHashSidecarExt is appended to the name of the first thumbnail of an
+// image to get the name of its --blurhash-sidecar file.
+const blurHashSidecarExt = ".blurhash"
+
+// BlurHash components across and down, enough detail for a placeholder.
+const (
+	blurHashX = 4
+	blurHashY = 3
+)
+
+// blurHashOf returns the BlurHash of the thumbnail img of file with
+// --blurhash, or "" without.
+func blurHashOf(img image.Image, file string) (string, error) {
+	if !blurHash || img == nil {
+		return "", nil
+	}
+	hash, err := thumbnailer.BlurHash(img, blurHashX, blurHashY)
+	if err != nil {
+		return "", fmt.Errorf("error computing BlurHash of %s: %v", file, err)
+	}
+	return hash, nil
+}
+
+// writeBlurHashSidecar saves hash next to outputFile with --blurhash-sidecar,
+// unless ctx is done.
+func writeBlurHashSidecar(ctx context.Context, outputFile, hash string) error {
+	if !hashSidecar || hash == "" {
+		return nil
+	}
+	sidecar := outputFile + blurHashSidecarExt
+	if err := saveFileContext(ctx, sidecar, func(w io.Writer) error {
+		_, err := io.WriteString(w, hash)
+		return err
+	}); err != nil {
+		return fmt.Errorf("error saving BlurHash %s: %v", sidecar, err)
+	}
+	return nil
+}
+
+// existingBlurHash returns the BlurHash of the existing thumbnail outputFile,
+// read from its sidecar or computed from the thumbnail itself.
+func existingBlurHash(outputFile string) string {
+	if data, err := os.ReadFile(outputFile + blurHashSidecarExt); err == nil {
+		return strings.TrimSpace(string(data))
+	}
+	f, err := os.Open(outputFile)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return ""
+	}
+	hash, _ := blurHashOf(img, outputFile)
+	return hash
+}
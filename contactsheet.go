@@ -0,0 +1,87 @@
+package main
+
+import (
+	"github.com/peferb/thumbnailer/thumbnailer"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"log"
+	"path/filepath"
+	"sort"
+)
+
+// sheetPadding is the space in pixels around every contact sheet cell.
+const sheetPadding = 8
+
+// writeContactSheet tiles the thumbnails of results into one image with the
+// file names as captions, and saves it as contact_sheet.<format> in outputPath.
+// It returns the file written, "" when there were no thumbnails.
+func writeContactSheet(thumb *thumbnailer.Thumbnailer, results []imageResult) (string, error) {
+	var cells []imageResult
+	for _, r := range results {
+		if r.Thumbnail != nil {
+			cells = append(cells, r)
+		}
+	}
+	if len(cells) == 0 {
+		log.Print("No thumbnails for the contact sheet")
+		return "", nil
+	}
+	sort.Slice(cells, func(i, j int) bool {
+		return cells[i].File < cells[j].File
+	})
+
+	var thumbW, thumbH int
+	for _, r := range cells {
+		b := r.Thumbnail.Bounds()
+		thumbW, thumbH = max(thumbW, b.Dx()), max(thumbH, b.Dy())
+	}
+
+	face := basicfont.Face7x13
+	captionH := face.Metrics().Height.Ceil()
+	cellW, cellH := thumbW+sheetPadding, thumbH+captionH+2*sheetPadding
+	cols := min(columns, len(cells))
+	rows := (len(cells) + cols - 1) / cols
+
+	var bg color.Color = color.White
+	if thumb.Background != nil {
+		bg = thumb.Background
+	}
+	sheet := image.NewRGBA(image.Rect(0, 0, cols*cellW+sheetPadding, rows*cellH+sheetPadding))
+	draw.Draw(sheet, sheet.Bounds(), &image.Uniform{C: bg}, image.Point{}, draw.Src)
+
+	for i, r := range cells {
+		x := sheetPadding + (i%cols)*cellW
+		y := sheetPadding + (i/cols)*cellH
+
+		b := r.Thumbnail.Bounds()
+		at := image.Pt(x+(thumbW-b.Dx())/2, y+(thumbH-b.Dy())/2)
+		draw.Draw(sheet, b.Sub(b.Min).Add(at), r.Thumbnail, b.Min, draw.Over)
+
+		caption := filepath.Base(r.File)
+		for len(caption) > 1 && font.MeasureString(face, caption).Ceil() > thumbW {
+			caption = caption[:len(caption)-1]
+		}
+		d := &font.Drawer{
+			Dst:  sheet,
+			Src:  image.Black,
+			Face: face,
+			Dot:  fixed.P(x+(thumbW-font.MeasureString(face, caption).Ceil())/2, y+thumbH+sheetPadding/2+face.Metrics().Ascent.Ceil()),
+		}
+		d.DrawString(caption)
+	}
+
+	file := filepath.Join(outputPath, "contact_sheet."+outputExt)
+	if err := saveFile(file, func(w io.Writer) error {
+		return thumb.Encode(w, sheet)
+	}); err != nil {
+		return "", err
+	}
+
+	log.Printf("Contact sheet with %d images saved to %s", len(cells), file)
+	return file, nil
+}
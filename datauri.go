@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/peferb/thumbnailer/thumbnailer"
+	"io"
+	"log"
+	"path/filepath"
+)
+
+// dataURIsName is the file the thumbnails of --data-uri are written to in the
+// output directory.
+const dataURIsName = "data_uris.json"
+
+// saveThumbnail writes the output of encode to output.Path and records its
+// size and SHA-256 in output. With --data-uri no file is written, the
+// thumbnail is kept as output.DataURI instead.
+func saveThumbnail(ctx context.Context, output *outputResult, encode func(w io.Writer) error) error {
+	if !dataURI {
+		var err error
+		output.Bytes, output.SHA256, err = saveCounted(ctx, output.Path, encode)
+		return err
+	}
+
+	var buf bytes.Buffer
+	if err := encode(&buf); err != nil {
+		return err
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	output.Bytes, output.SHA256 = int64(buf.Len()), hex.EncodeToString(sum[:])
+	output.DataURI = dataURIOf(output.Format, buf.Bytes())
+	return nil
+}
+
+// dataURIOf returns data, an image in format, as a base64 data URI.
+func dataURIOf(format string, data []byte) string {
+	return "data:" + thumbnailer.ContentType(format) + ";base64," + base64.StdEncoding.EncodeToString(data)
+}
+
+// writeDataURIs writes uris, the data URI of every source's thumbnail keyed by
+// the source path, to the output directory.
+func writeDataURIs(uris map[string]string) error {
+	// encoding/json sorts the keys, so the file only changes when the
+	// thumbnails do
+	data, err := json.MarshalIndent(uris, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	file := filepath.Join(outputPath, dataURIsName)
+	if err := saveFile(file, func(w io.Writer) error {
+		_, err := w.Write(append(data, '\n'))
+		return err
+	}); err != nil {
+		return err
+	}
+	log.Printf("Data URIs saved to %s", file)
+	return nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/peferb/thumbnailer/thumbnailer"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// dedupeIndex remembers the sources seen so far by content hash, so that with
+// --dedupe identical sources are only thumbnailed once.
+type dedupeIndex struct {
+	mu      sync.Mutex
+	sources map[string]*dedupeSource
+}
+
+// dedupeSource is the first source seen with some content. done is closed
+// once its result is set.
+type dedupeSource struct {
+	done   chan struct{}
+	result imageResult
+}
+
+func newDedupeIndex() *dedupeIndex {
+	return &dedupeIndex{sources: make(map[string]*dedupeSource)}
+}
+
+// process thumbnails file unless a source with the same content was seen
+// before, in which case it waits for that source and copies its thumbnails.
+func (d *dedupeIndex) process(thumb *thumbnailer.Thumbnailer, file string) imageResult {
+	startTime := time.Now()
+	hash, err := hashFile(file)
+	if err != nil {
+		return imageResult{File: file, Err: fmt.Errorf("error hashing image file %s: %v", file, err)}
+	}
+
+	d.mu.Lock()
+	src, seen := d.sources[hash]
+	if !seen {
+		src = &dedupeSource{done: make(chan struct{})}
+		d.sources[hash] = src
+	}
+	d.mu.Unlock()
+
+	if !seen {
+		src.result = processWithRetries(thumb, file)
+		close(src.done)
+		return src.result
+	}
+
+	<-src.done
+	if src.result.Err != nil || src.result.Existing || !sameFileSettings(thumb, src.result.File, file) {
+		// nothing to copy, give the duplicate its own chance
+		return processWithRetries(thumb, file)
+	}
+	if existing, err := existingOutput(file); err != nil {
+		return imageResult{File: file, Err: err}
+	} else if existing != "" {
+		return skipExisting(imageResult{File: file}, existing, startTime)
+	}
+
+	result, err := copyThumbnails(src.result, file)
+	if err != nil {
+		return imageResult{File: file, Err: err}
+	}
+	result.Duration = time.Since(startTime)
+	logVerbose("Copied thumbnails of %s for duplicate %s", src.result.File, file)
+	return result
+}
+
+// sameFileSettings reports whether the thumbnails of a fit b. Besides the
+// directory configs, their crop sidecars and rendered captions must match.
+func sameFileSettings(thumb *thumbnailer.Thumbnailer, a, b string) bool {
+	if !sameDirSettings(a, b) {
+		return false
+	}
+	if cropSidecar {
+		cropA, okA, errA := readCropSidecar(a)
+		cropB, okB, errB := readCropSidecar(b)
+		if errA != nil || errB != nil || okA != okB || cropA != cropB {
+			return false
+		}
+	}
+	if captionTemplate == nil || thumb.Caption == nil {
+		return true
+	}
+
+	thumb, err := fileThumbnailer(thumb, a)
+	if err != nil {
+		return false
+	}
+	sizes, err := sizesFor(a)
+	if err != nil {
+		return false
+	}
+	for _, size := range sizes {
+		sized := *thumb
+		if size.Format != "" {
+			sized.Format = size.Format
+		}
+		sizedA, sizedB := sized, sized
+		if setCaption(&sizedA, a, size) != nil || setCaption(&sizedB, b, size) != nil {
+			return false
+		}
+		if sizedA.Caption.Text != sizedB.Caption.Text {
+			return false
+		}
+	}
+	return true
+}
+
+// copyThumbnails copies the thumbnails written for src to the output paths of
+// the duplicate file.
+func copyThumbnails(src imageResult, file string) (imageResult, error) {
+	result := src
+	result.File = file
+	result.DuplicateOf = src.File
+	result.Outputs = nil
+
+	sizes, err := sizesFor(file)
+	if err != nil {
+		return result, err
+	}
+	for i, size := range sizes {
+		if i >= len(src.Outputs) {
+			break
+		}
+		outputFile, err := outputFileFor(file, size)
+		if err != nil {
+			return result, err
+		}
+		if err := makeOutputDir(filepath.Dir(outputFile)); err != nil {
+			return result, fmt.Errorf("error creating output directory for %s: %v", outputFile, err)
+		}
+
+		output := src.Outputs[i]
+		if err := copyFile(output.Path, outputFile); err != nil {
+			return result, fmt.Errorf("error copying thumbnail %s to %s: %v", output.Path, outputFile, err)
+		}
+		if err := preserveModTime(file, outputFile); err != nil {
+			return result, err
+		}
+		if i == 0 {
+			if err := writeBlurHashSidecar(context.Background(), outputFile, result.BlurHash); err != nil {
+				return result, err
+			}
+		}
+		output.Path = outputFile
+		result.Outputs = append(result.Outputs, output)
+	}
+	return result, nil
+}
+
+// copyFile copies src to dst through saveFile.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	return saveFile(dst, func(w io.Writer) error {
+		_, err := io.Copy(w, in)
+		return err
+	})
+}
+
+// hashFile returns the hex encoded SHA-256 of the contents of file.
+func hashFile(file string) (string, error) {
+	f, err := openSource(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
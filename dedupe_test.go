@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"github.com/peferb/thumbnailer/thumbnailer"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+	"text/template"
+)
+
+// writePNG writes a w x h PNG filled with c to file.
+func writePNG(t *testing.T, file string, w, h int, c color.Color) {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for i := 0; i < w*h; i++ {
+		img.Set(i%w, i/w, c)
+	}
+	f, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := png.Encode(f, img); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDedupeIndex(t *testing.T) {
+	in, out := t.TempDir(), t.TempDir()
+	red, blue := color.NRGBA{255, 0, 0, 255}, color.NRGBA{0, 0, 255, 255}
+	writePNG(t, filepath.Join(in, "a.png"), 40, 30, red)
+	writePNG(t, filepath.Join(in, "b.png"), 40, 30, red)
+	writePNG(t, filepath.Join(in, "c.png"), 40, 30, blue)
+
+	defer func(saved []thumbnailSize) { sizes = saved }(sizes)
+	defer func(in, out, format, ext string, r int, flat bool) {
+		inputPath, outputPath, outputFormat, outputExt, retries, flatten = in, out, format, ext, r, flat
+	}(inputPath, outputPath, outputFormat, outputExt, retries, flatten)
+	inputPath, outputPath, outputFormat, outputExt, retries, flatten = in, out, "png", "png", 0, true
+	sizes = []thumbnailSize{{Width: 20, Height: 20}}
+	thumb := &thumbnailer.Thumbnailer{Width: 20, Height: 20, Format: "png", Quality: 80}
+
+	d := newDedupeIndex()
+	tests := []struct {
+		file        string
+		duplicateOf string
+	}{
+		{"a.png", ""},
+		{"b.png", "a.png"},
+		{"c.png", ""},
+	}
+	for _, tt := range tests {
+		file := filepath.Join(in, tt.file)
+		result := d.process(thumb, file)
+		if result.Err != nil {
+			t.Errorf("%s: %v", tt.file, result.Err)
+			continue
+		}
+		want := ""
+		if tt.duplicateOf != "" {
+			want = filepath.Join(in, tt.duplicateOf)
+		}
+		if result.DuplicateOf != want {
+			t.Errorf("%s: duplicate of %q, want %q", tt.file, result.DuplicateOf, want)
+		}
+		if len(result.Outputs) != 1 || result.Outputs[0].Path != filepath.Join(out, tt.file) {
+			t.Errorf("%s: outputs %v", tt.file, result.Outputs)
+		}
+	}
+
+	a, err := os.ReadFile(filepath.Join(out, "a.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(filepath.Join(out, "b.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(a, b) {
+		t.Errorf("the thumbnail of the duplicate differs")
+	}
+}
+
+func TestSameFileSettings(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.png", "b.png", "c.png"} {
+		writePNG(t, filepath.Join(dir, name), 40, 30, color.NRGBA{255, 0, 0, 255})
+	}
+	a, b, c := filepath.Join(dir, "a.png"), filepath.Join(dir, "b.png"), filepath.Join(dir, "c.png")
+	os.WriteFile(a+cropSidecarExt, []byte(`{"x": 0, "y": 0, "w": 20, "h": 20}`), 0644)
+	os.WriteFile(b+cropSidecarExt, []byte(`{"x": 0, "y": 0, "w": 20, "h": 20}`), 0644)
+	os.WriteFile(c+cropSidecarExt, []byte(`{"x": 5, "y": 0, "w": 20, "h": 20}`), 0644)
+
+	defer func(saved []thumbnailSize) { sizes = saved }(sizes)
+	defer func(saved *template.Template) { captionTemplate = saved }(captionTemplate)
+	defer func(saved bool) { cropSidecar = saved }(cropSidecar)
+	sizes = []thumbnailSize{{Width: 20, Height: 20}}
+	caption, err := thumbnailer.NewCaption("", "bottom", color.White, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	thumb := &thumbnailer.Thumbnailer{Width: 20, Height: 20, Format: "png", Caption: caption}
+
+	tests := []struct {
+		name    string
+		caption string
+		crop    bool
+		a, b    string
+		want    bool
+	}{
+		{"no caption or crop", "", false, a, c, true},
+		{"same crop", "", true, a, b, true},
+		{"different crop", "", true, a, c, false},
+		{"same caption", "{{.Width}}", false, a, b, true},
+		{"different caption", "{{.Name}}", false, a, b, false},
+	}
+	for _, tt := range tests {
+		captionTemplate, cropSidecar = nil, tt.crop
+		if tt.caption != "" {
+			captionTemplate = template.Must(template.New("caption").Parse(tt.caption))
+		}
+		if got := sameFileSettings(thumb, tt.a, tt.b); got != tt.want {
+			t.Errorf("%s: sameFileSettings = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
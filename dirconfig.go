@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/peferb/thumbnailer/thumbnailer"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// dirConfigName is the name of the per-directory config files that override
+// the settings for the images in their directory and below.
+const dirConfigName = ".thumbnailer.json"
+
+// dirConfigs caches the directory configs read so far by directory; a nil
+// entry means the directory has none.
+var (
+	dirConfigs   = make(map[string]*dirConfig)
+	dirConfigsMu sync.Mutex
+)
+
+// dirConfig is a parsed directory config, or the error reading it.
+type dirConfig struct {
+	settings configSettings
+	err      error
+}
+
+// dirSettings merges the directory configs from the input path file was found
+// under down to the directory of file, the deepest taking precedence.
+func dirSettings(file string) (configSettings, bool, error) {
+	var merged configSettings
+	found := false
+	for _, dir := range configDirs(file) {
+		config := loadDirConfig(dir)
+		if config == nil {
+			continue
+		}
+		if config.err != nil {
+			return configSettings{}, false, config.err
+		}
+		merged.merge(config.settings)
+		found = true
+	}
+	return merged, found, nil
+}
+
+// configDirs lists the directories from the input path of file down to the
+// directory holding it.
+func configDirs(file string) []string {
+	dir := filepath.Dir(file)
+	root, ok := fileRoot(file)
+	if !ok {
+		return []string{dir}
+	}
+	if isTarInput(root) {
+		// directory configs aren't read from inside archives
+		return nil
+	}
+	if info, err := os.Stat(root); err != nil || !info.IsDir() {
+		return []string{dir}
+	}
+	rel, err := filepath.Rel(root, dir)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return []string{dir}
+	}
+
+	dirs := []string{root}
+	if rel != "." {
+		for _, part := range strings.Split(rel, string(filepath.Separator)) {
+			dirs = append(dirs, filepath.Join(dirs[len(dirs)-1], part))
+		}
+	}
+	return dirs
+}
+
+// loadDirConfig returns the directory config of dir, reading it the first
+// time, or nil when dir has none.
+func loadDirConfig(dir string) *dirConfig {
+	dirConfigsMu.Lock()
+	defer dirConfigsMu.Unlock()
+	if config, ok := dirConfigs[dir]; ok {
+		return config
+	}
+
+	config := readDirConfig(filepath.Join(dir, dirConfigName))
+	dirConfigs[dir] = config
+	return config
+}
+
+// readDirConfig parses the directory config file, or returns nil when it
+// doesn't exist.
+func readDirConfig(file string) *dirConfig {
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return &dirConfig{err: fmt.Errorf("error reading directory config %s: %v", file, err)}
+	}
+
+	var values map[string]interface{}
+	if err := json.Unmarshal(data, &values); err != nil {
+		return &dirConfig{err: fmt.Errorf("error parsing directory config %s: %v", file, err)}
+	}
+	for _, key := range []string{"input", "output", "presets"} {
+		if _, ok := values[key]; ok {
+			log.Printf("Warning: %q can't be set in directory config %s, ignoring it", key, file)
+			delete(values, key)
+		}
+	}
+
+	s := parseConfigSettings(values, "directory config "+file)
+	err = checkQualities(s.Qualities)
+	switch {
+	case err != nil:
+	case s.Compression != nil && (*s.Compression < 1 || *s.Compression > 100):
+		err = fmt.Errorf("compression must be between 1 and 100, got %d", *s.Compression)
+	case s.Width != nil && *s.Width < 0, s.Height != nil && *s.Height < 0:
+		err = fmt.Errorf("width and height must not be negative")
+	case s.Format != nil && !thumbnailer.SupportedFormat(*s.Format):
+		err = fmt.Errorf("unsupported output format: %s", *s.Format)
+	}
+	if err != nil {
+		return &dirConfig{err: fmt.Errorf("invalid directory config %s: %v", file, err)}
+	}
+	if (s.Width != nil || s.Height != nil) && !hasPrimarySize() {
+		log.Printf("Warning: the width and height of directory config %s only replace --width and --height, which aren't given", file)
+	}
+	if s.Format != nil && len(formats) > 1 {
+		log.Printf("Warning: ignoring the format of directory config %s, every image is written in each --format", file)
+		s.Format = nil
+	}
+	return &dirConfig{settings: s}
+}
+
+// fileThumbnailer returns thumb with the compression, qualities and format of
+// the directory configs above file applied.
+func fileThumbnailer(thumb *thumbnailer.Thumbnailer, file string) (*thumbnailer.Thumbnailer, error) {
+	s, found, err := dirSettings(file)
+	if err != nil || !found || (s.Compression == nil && s.Qualities == nil && s.Format == nil) {
+		return thumb, err
+	}
+
+	// the directory's compression is more specific than the per-format
+	// qualities of the config file, its own per-format ones more still
+	t := *thumb
+	if s.Compression != nil {
+		t.Quality = *s.Compression
+		t.FormatQuality = nil
+	}
+	if s.Qualities != nil {
+		merged := make(map[string]int)
+		for format, q := range t.FormatQuality {
+			merged[format] = q
+		}
+		for format, q := range s.Qualities {
+			merged[format] = q
+		}
+		t.FormatQuality = merged
+	}
+	if s.Format != nil {
+		t.Format = *s.Format
+		if !thumbnailer.SupportsTargetSize(t.Format) {
+			t.TargetBytes = 0
+		}
+	}
+	return &t, nil
+}
+
+// sizesFor returns the thumbnail sizes of file, sizes with the width and
+// height of the directory configs above it replacing those of --width and
+// --height.
+func sizesFor(file string) ([]thumbnailSize, error) {
+	s, found, err := dirSettings(file)
+	if err != nil || !found || !hasPrimarySize() || (s.Width == nil && s.Height == nil) {
+		return sizes, err
+	}
+
+	// with several formats the primary size is there once per format
+	fileSizes := append([]thumbnailSize(nil), sizes...)
+	for i := range fileSizes {
+		size := &fileSizes[i]
+		if !size.Primary {
+			continue
+		}
+		if s.Width != nil {
+			size.Width = *s.Width
+		}
+		if s.Height != nil {
+			size.Height = *s.Height
+		}
+		if size.Width == 0 && size.Height == 0 {
+			return nil, fmt.Errorf("the directory configs of %s leave neither width nor height", file)
+		}
+		if square {
+			// the directory's dimension wins, the --width or --height one follows
+			if s.Width != nil && s.Height == nil {
+				size.Height = 0
+			} else if s.Height != nil && s.Width == nil {
+				size.Width = 0
+			}
+			*size = squareSize(*size)
+			if size.Width != size.Height {
+				return nil, fmt.Errorf("the directory configs of %s give --square a %dx%d box", file, size.Width, size.Height)
+			}
+		}
+		if resizeMode != thumbnailer.ModeFit && (size.Width == 0 || size.Height == 0) {
+			return nil, fmt.Errorf("the directory configs of %s leave %s mode without both width and height", file, resizeMode)
+		}
+	}
+	return fileSizes, nil
+}
+
+// hasPrimarySize reports whether sizes has the size given with --width and
+// --height.
+func hasPrimarySize() bool {
+	for _, size := range sizes {
+		if size.Primary {
+			return true
+		}
+	}
+	return false
+}
+
+// sameDirSettings reports whether the directory configs give a and b the same
+// settings, so with --dedupe the thumbnails of one fit the other.
+func sameDirSettings(a, b string) bool {
+	sa, _, errA := dirSettings(a)
+	sb, _, errB := dirSettings(b)
+	return errA == nil && errB == nil && reflect.DeepEqual(sa, sb)
+}
+
+// fileFormat returns the output format and file name extension of the
+// thumbnails of file, from the directory configs above it or the flags. An
+// --output-ext given on the command line is kept.
+func fileFormat(file string) (format, ext string) {
+	s, found, _ := dirSettings(file)
+	if !found || s.Format == nil {
+		return outputFormat, outputExt
+	}
+	if outputExt != thumbnailer.Extension(outputFormat) {
+		return *s.Format, outputExt
+	}
+	return *s.Format, thumbnailer.Extension(*s.Format)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"github.com/peferb/thumbnailer/thumbnailer"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDirConfig(t *testing.T) {
+	root := t.TempDir()
+	configs := map[string]string{
+		".":       `{"compression": 50, "width": 300}`,
+		"sub":     `{"compression": 70, "format": "png", "output": "elsewhere"}`,
+		"broken":  `{"compression": 70`,
+		"invalid": `{"compression": 700}`,
+	}
+	for dir, config := range configs {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(root, dir, dirConfigName), []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	defer func(saved []thumbnailSize) { sizes = saved }(sizes)
+	defer func(in, format, ext, mode string) {
+		inputPath, outputFormat, outputExt, resizeMode = in, format, ext, mode
+	}(inputPath, outputFormat, outputExt, resizeMode)
+	inputPath, outputFormat, outputExt, resizeMode = root, "jpeg", "jpeg", thumbnailer.ModeFit
+	sizes = []thumbnailSize{{Width: 200, Height: 200, Primary: true}, {Width: 50, Height: 50, Suffix: "_small"}}
+	thumb := &thumbnailer.Thumbnailer{Width: 200, Height: 200, Format: "jpeg", Quality: 80}
+
+	tests := []struct {
+		file    string
+		quality int
+		format  string
+		ext     string
+		width   int
+		wantErr bool
+	}{
+		{file: "a.jpg", quality: 50, format: "jpeg", ext: "jpeg", width: 300},
+		{file: "sub/b.jpg", quality: 70, format: "png", ext: "png", width: 300},
+		{file: "sub/deeper/c.jpg", quality: 70, format: "png", ext: "png", width: 300},
+		{file: "broken/d.jpg", wantErr: true},
+		{file: "invalid/e.jpg", wantErr: true},
+	}
+	for _, tt := range tests {
+		file := filepath.Join(root, filepath.FromSlash(tt.file))
+		if !addFileRoot(file, root) {
+			t.Fatalf("%s: already added", tt.file)
+		}
+		defer forgetFileRoot(file)
+
+		th, err := fileThumbnailer(thumb, file)
+		fileSizes, sizesErr := sizesFor(file)
+		if tt.wantErr {
+			if err == nil || sizesErr == nil {
+				t.Errorf("%s: fileThumbnailer %v, sizesFor %v, want errors", tt.file, err, sizesErr)
+			}
+			continue
+		}
+		if err != nil || sizesErr != nil {
+			t.Errorf("%s: fileThumbnailer %v, sizesFor %v", tt.file, err, sizesErr)
+			continue
+		}
+		if th.Quality != tt.quality || th.Format != tt.format {
+			t.Errorf("%s: quality %d and format %s, want %d and %s", tt.file, th.Quality, th.Format, tt.quality, tt.format)
+		}
+		if format, ext := fileFormat(file); format != tt.format || ext != tt.ext {
+			t.Errorf("%s: fileFormat = %s, %s, want %s, %s", tt.file, format, ext, tt.format, tt.ext)
+		}
+		// only the size of --width and --height is replaced
+		if fileSizes[0].Width != tt.width || fileSizes[0].Height != 200 || fileSizes[1] != sizes[1] {
+			t.Errorf("%s: sizes %v", tt.file, fileSizes)
+		}
+	}
+	if thumb.Quality != 80 || sizes[0].Width != 200 {
+		t.Errorf("the directory configs changed the flag settings")
+	}
+
+	// outside the input path only the file's own directory counts
+	outside := filepath.Join(t.TempDir(), "f.jpg")
+	if th, err := fileThumbnailer(thumb, outside); err != nil || th != thumb {
+		t.Errorf("fileThumbnailer of a file without directory config = %v, %v", th, err)
+	}
+}
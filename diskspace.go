@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+)
+
+// freeSpaceInterval is how often the free space of the output filesystem is
+// checked during a run with --min-free.
+const freeSpaceInterval = 2 * time.Second
+
+// errFreeSpaceUnsupported is returned by freeSpace on platforms where the free
+// space can't be queried.
+var errFreeSpaceUnsupported = errors.New("checking free space isn't supported on this platform")
+
+// checkFreeSpace returns an error when the filesystem holding dir has less
+// than minFreeBytes available, with low set, or its free space can't be
+// queried.
+func checkFreeSpace(dir string) (low bool, err error) {
+	free, err := freeSpace(dir)
+	if err != nil {
+		return false, fmt.Errorf("error checking free space of %s: %v", dir, err)
+	}
+	if free < uint64(minFreeBytes) {
+		return true, fmt.Errorf("the filesystem of %s has only %d MB free, below --min-free %s", dir, free>>20, minFree)
+	}
+	return false, nil
+}
+
+// monitorFreeSpace checks the free space of dir every freeSpaceInterval until
+// ctx is done, and calls onLow with the error of the first check that finds
+// it low. Errors querying the space are logged and don't stop the run.
+func monitorFreeSpace(ctx context.Context, dir string, onLow func(err error)) {
+	ticker := time.NewTicker(freeSpaceInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		low, err := checkFreeSpace(dir)
+		if low {
+			onLow(err)
+			return
+		}
+		if err != nil {
+			logVerbose("%v", err)
+		}
+	}
+}
+
+// freeSpaceDir returns the directory whose filesystem the thumbnails, or the
+// output archive, are written to.
+func freeSpaceDir() string {
+	if isZipOutput(outputPath) {
+		return filepath.Dir(outputPath)
+	}
+	return outputPath
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !freebsd
+
+package main
+
+// freeSpace isn't available on this platform, --min-free is ignored with a
+// warning.
+func freeSpace(dir string) (uint64, error) {
+	return 0, errFreeSpaceUnsupported
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"github.com/peferb/thumbnailer/thumbnailer"
+	"github.com/spf13/cobra"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// newFormatsCommand returns the formats subcommand, which prints the formats
+// that can be read and written on this system.
+func newFormatsCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "formats",
+		Short: "List the supported output formats, and the input formats and external tools found on this system",
+		Args:  cobra.NoArgs,
+		Run:   runFormats,
+	}
+	cmd.Flags().StringSliceVar(&rawExts, "raw-extensions", nil, "File extensions treated as camera RAW files, as for thumbnailing")
+	return cmd
+}
+
+func runFormats(cmd *cobra.Command, args []string) {
+	if len(rawExts) > 0 {
+		thumbnailer.SetRawExtensions(rawExts)
+	}
+
+	fmt.Println("Output formats:")
+	for _, format := range thumbnailer.OutputFormats() {
+		fmt.Printf("  %-6s %-11s %s\n", format, thumbnailer.ContentType(format), thumbnailer.Codec(format))
+	}
+
+	tools := thumbnailer.Tools()
+	paths := make(map[string]string)
+	for _, tool := range tools {
+		paths[tool.Name] = tool.Path
+	}
+	fmt.Println()
+	fmt.Println("Input formats:")
+	for _, input := range thumbnailer.InputFormats() {
+		status := "available"
+		if len(input.Tools) > 0 {
+			status = "missing, install " + strings.Join(input.Tools, " or ")
+			for _, tool := range input.Tools {
+				if paths[tool] != "" {
+					status = "available with " + tool
+					break
+				}
+			}
+		}
+		fmt.Printf("  %-10s %s\n", input.Name, status)
+		fmt.Printf("             %s\n", strings.Join(input.Extensions, " "))
+	}
+
+	fmt.Println()
+	fmt.Println("External tools:")
+	// paths differ in length, tabwriter lines up the column after them
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
+	for _, tool := range tools {
+		path := tool.Path
+		if path == "" {
+			path = "not found"
+		}
+		fmt.Fprintf(tw, "  %s\t%s\t%s\n", tool.Name, path, tool.Use)
+	}
+	tw.Flush()
+}
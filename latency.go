@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// latencyBuckets is the number of histogram buckets of latencyStats. Bucket i
+// holds durations from 1µs * 2^(i/8) up to the next bucket, about 9% wider, so
+// percentiles are accurate to within 9% and the last bucket starts at days.
+const latencyBuckets = 8 * 38
+
+// latencyStats aggregates processing times into running totals and a fixed
+// histogram, so its size stays the same however many images are processed.
+type latencyStats struct {
+	count   int64
+	sum     time.Duration
+	min     time.Duration
+	max     time.Duration
+	buckets [latencyBuckets]int64
+}
+
+// latencySummary holds the aggregates of latencyStats in milliseconds, for
+// the JSON report.
+type latencySummary struct {
+	Min  float64 `json:"min"`
+	Mean float64 `json:"avg"`
+	P50  float64 `json:"p50"`
+	P95  float64 `json:"p95"`
+	P99  float64 `json:"p99"`
+	Max  float64 `json:"max"`
+}
+
+func (l *latencyStats) add(d time.Duration) {
+	if l.count == 0 || d < l.min {
+		l.min = d
+	}
+	if d > l.max {
+		l.max = d
+	}
+	l.count++
+	l.sum += d
+	l.buckets[latencyBucket(d)]++
+}
+
+// latencyBucket returns the index of the histogram bucket holding d.
+func latencyBucket(d time.Duration) int {
+	if d <= time.Microsecond {
+		return 0
+	}
+	i := int(8 * math.Log2(float64(d)/float64(time.Microsecond)))
+	return min(i, latencyBuckets-1)
+}
+
+func (l *latencyStats) mean() time.Duration {
+	if l.count == 0 {
+		return 0
+	}
+	return l.sum / time.Duration(l.count)
+}
+
+// percentile returns the duration p percent of the added durations are at or
+// below, as the upper end of its bucket, but never beyond the extremes.
+func (l *latencyStats) percentile(p float64) time.Duration {
+	if l.count == 0 {
+		return 0
+	}
+
+	rank := int64(math.Ceil(p / 100 * float64(l.count)))
+	var seen int64
+	for i, n := range l.buckets {
+		if seen += n; seen >= rank {
+			upper := time.Duration(float64(time.Microsecond) * math.Exp2(float64(i+1)/8))
+			return min(max(upper, l.min), l.max)
+		}
+	}
+	return l.max
+}
+
+// String returns the aggregates for the summary, e.g. "min 12ms, avg 40ms,
+// p50 35ms, p95 96ms, p99 140ms, max 210ms".
+func (l *latencyStats) String() string {
+	return fmt.Sprintf("min %v, avg %v, p50 %v, p95 %v, p99 %v, max %v",
+		roundLatency(l.min), roundLatency(l.mean()), roundLatency(l.percentile(50)),
+		roundLatency(l.percentile(95)), roundLatency(l.percentile(99)), roundLatency(l.max))
+}
+
+func (l *latencyStats) summary() latencySummary {
+	return latencySummary{
+		Min:  milliseconds(l.min),
+		Mean: milliseconds(l.mean()),
+		P50:  milliseconds(l.percentile(50)),
+		P95:  milliseconds(l.percentile(95)),
+		P99:  milliseconds(l.percentile(99)),
+		Max:  milliseconds(l.max),
+	}
+}
+
+// milliseconds returns d in milliseconds, rounded to a tenth, for reports.
+func milliseconds(d time.Duration) float64 {
+	return math.Round(float64(d)/float64(time.Millisecond)*10) / 10
+}
+
+// roundLatency rounds d to milliseconds, or microseconds below a millisecond.
+func roundLatency(d time.Duration) time.Duration {
+	if d < time.Millisecond {
+		return d.Round(time.Microsecond)
+	}
+	return d.Round(time.Millisecond)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// Values of --log-format.
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// warningPrefix starts the messages logged as warnings.
+const warningPrefix = "Warning: "
+
+// useJSONLogging switches all logging to one JSON object per line on w,
+// including what's logged through the log package.
+func useJSONLogging(w io.Writer) {
+	handler := slog.NewJSONHandler(w, &slog.HandlerOptions{
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 && a.Key == slog.MessageKey {
+				a.Key = "message"
+			}
+			return a
+		},
+	})
+	slog.SetDefault(slog.New(warningHandler{handler}))
+}
+
+// warningHandler logs messages starting with warningPrefix at the warning
+// level, without the prefix, as log.Printf can't give a level.
+type warningHandler struct {
+	slog.Handler
+}
+
+func (h warningHandler) Handle(ctx context.Context, r slog.Record) error {
+	if msg, ok := strings.CutPrefix(r.Message, warningPrefix); ok {
+		if r.Level < slog.LevelWarn {
+			r.Level = slog.LevelWarn
+		}
+		r.Message = msg
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h warningHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return warningHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h warningHandler) WithGroup(name string) slog.Handler {
+	return warningHandler{h.Handler.WithGroup(name)}
+}
+
+// logEvent logs the start, finish, error or summary event of an image or of
+// the run. In text mode it logs like log.Printf; with --log-format json the
+// event, file and duration_ms are separate fields, left out when empty.
+func logEvent(level slog.Level, event, file string, duration time.Duration, format string, v ...interface{}) {
+	msg := fmt.Sprintf(format, v...)
+	if logFormat != logFormatJSON {
+		log.Output(2, msg)
+		return
+	}
+
+	attrs := []slog.Attr{slog.String("event", event)}
+	if file != "" {
+		attrs = append(attrs, slog.String("file", file))
+	}
+	if duration > 0 {
+		attrs = append(attrs, slog.Int64("duration_ms", duration.Milliseconds()))
+	}
+	slog.LogAttrs(context.Background(), level, msg, attrs...)
+}
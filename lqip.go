@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/peferb/thumbnailer/thumbnailer"
+	"image"
+	"os"
+)
+
+// previewOf returns the --preview-size preview of img, the thumbnail of file
+// that thumb wrote, as a base64 data URI, or "" without --preview-size. It's
+// encoded like the thumbnail, except that BMP and TIFF, which browsers don't
+// show inline, become PNG.
+func previewOf(thumb *thumbnailer.Thumbnailer, img image.Image, file string) (string, error) {
+	if previewSize == 0 || img == nil {
+		return "", nil
+	}
+
+	format := thumb.Format
+	switch format {
+	case "bmp", "tiff":
+		format = "png"
+	case "apng":
+		// the preview is a still image, a plain PNG
+		format = "png"
+	}
+	preview := thumbnailer.Thumbnailer{
+		Width:          previewSize,
+		Height:         previewSize,
+		Format:         format,
+		Quality:        thumb.Quality,
+		FormatQuality:  thumb.FormatQuality,
+		Mode:           thumbnailer.ModeFit,
+		NoUpscale:      true,
+		Filter:         thumb.Filter,
+		Background:     thumb.Background,
+		PNGCompression: thumb.PNGCompression,
+		Metadata:       thumbnailer.MetadataStrip,
+	}
+	var buf bytes.Buffer
+	if err := preview.Encode(&buf, preview.Resize(img)); err != nil {
+		return "", fmt.Errorf("error encoding preview of %s: %v", file, err)
+	}
+	return dataURIOf(format, buf.Bytes()), nil
+}
+
+// existingPreview returns the preview of the existing thumbnail outputFile,
+// computed from the thumbnail itself.
+func existingPreview(outputFile, format string) string {
+	if previewSize == 0 {
+		return ""
+	}
+	f, err := os.Open(outputFile)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return ""
+	}
+	uri, _ := previewOf(&thumbnailer.Thumbnailer{
+		Format:        format,
+		Quality:       compression,
+		FormatQuality: qualities,
+		Filter:        filter,
+	}, img, outputFile)
+	return uri
+}
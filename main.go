@@ -1,23 +1,35 @@
 package main
 
 import (
-	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"github.com/disintegration/imaging"
-	"github.com/nfnt/resize"
+	"github.com/BurntSushi/toml"
+	"github.com/peferb/thumbnailer/thumbnailer"
 	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
 	"image"
-	_ "image/png"
+	"image/color"
+	"image/gif"
 	"io"
 	"io/ioutil"
 	"log"
+	"log/slog"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/template"
 	"time"
 )
 
@@ -28,247 +40,2293 @@ var (
 	maxWidth     int
 	maxHeight    int
 	outputFormat string
+	formats      []string
 	configFile   string
 	parallelism  int
+	flatten      bool
+	recursive    bool
+	followLinks  bool
+	dedupe       bool
+	manifest     bool
+	maxFileSize  string
+	minFree      string
+	maxPixels    int64
+	since        string
+	grayscale    bool
+	sepia        bool
+	contrast     float64
+	sharpen      float64
+	logFilePath  string
+	noLogFile    bool
+	s3Bucket     string
+	s3Prefix     string
+	rawExts      []string
+	failFast     bool
+	ignoreErrors bool
+	skipTools    bool
+	scale        float64
+	preserveTime bool
+	noUpscale    bool
+	noResize     bool
+	square       bool
+	cropSidecar  bool
+	preserveICC  bool
+	overwrite    bool
+	inputList    string
+	progressive  bool
+	noSubsample  bool
+	targetSize   string
+	logFormat    string
+	outputExt    string
+	stream       bool
+	aspect       string
+	zoom         float64
+	minWidth     int
+	minHeight    int
+	preset       string
+	byDate       bool
+	noAutoOrient bool
+	resizeMode   string
+	metadata     string
+	stripGPS     bool
+	retries      int
+	sizeFlags    []string
+	reportFormat string
+	incremental  bool
+	force        bool
+	include      []string
+	exclude      []string
+	dryRun       bool
+	templateText string
+	pngLevel     string
+	quiet        bool
+	verbose      bool
+	page         int
+	timeout      time.Duration
+	watch        bool
+	background   string
+	filter       string
+	contactSheet bool
+	columns      int
+	watermark    string
+	markPosition string
+	markOpacity  float64
+	caption      string
+	capPosition  string
+	capColor     string
+	capOutline   bool
+	blurHash     bool
+	hashSidecar  bool
+	timeFormat   string
+	maxAspect    float64
+	dataURI      bool
+	palette      int
+	maxPixelsOut int64
+	previewSize  int
 )
 
-const maxRetries = 1
+// sizes holds the thumbnail sizes generated for every image, built from
+// --width/--height and --size in run.
+var sizes []thumbnailSize
+
+// fileRoots maps every collected source file to the input path it was found
+// under, for mirroring the directory structure in the output. With --stream
+// files are added while others are processed, hence fileRootsMu.
+var (
+	fileRoots   = make(map[string]string)
+	fileRootsMu sync.Mutex
+)
+
+// listedRoots maps the files of --input-list that name the input path they
+// were found under, as in failures.txt, to that path. They are registered
+// under it instead of themselves, so their thumbnails keep their place.
+var listedRoots = make(map[string]string)
+
+// addFileRoot records that file was found under root. It returns false when
+// file was already found, under root or another input path.
+func addFileRoot(file, root string) bool {
+	fileRootsMu.Lock()
+	defer fileRootsMu.Unlock()
+	if _, seen := fileRoots[file]; seen {
+		return false
+	}
+	fileRoots[file] = root
+	return true
+}
+
+// fileRoot returns the input path file was found under.
+func fileRoot(file string) (string, bool) {
+	fileRootsMu.Lock()
+	defer fileRootsMu.Unlock()
+	root, ok := fileRoots[file]
+	return root, ok
+}
+
+// forgetFileRoot drops file from fileRoots once it's processed.
+func forgetFileRoot(file string) {
+	fileRootsMu.Lock()
+	defer fileRootsMu.Unlock()
+	delete(fileRoots, file)
+}
+
+// maxFileBytes is --max-file-size in bytes, 0 for no limit.
+var maxFileBytes int64
+
+// minFreeBytes is --min-free in bytes, 0 for no check.
+var minFreeBytes int64
+
+// sinceTime is the --since cutoff, files modified before it are left out of
+// the walk. It's zero without --since.
+var sinceTime time.Time
+
+// qualities is the per-format quality of the config file, formats it doesn't
+// list use --compression.
+var qualities map[string]int
+
+// thumbnailSize is one requested output size. Suffix is appended to the output
+// file name to tell the sizes of one image apart.
+type thumbnailSize struct {
+	Width  int
+	Height int
+	Suffix string
+	// Format is the output format of the size when several are written, empty
+	// for the single --format (or the directory config's).
+	Format string
+	// Primary marks the size given with --width and --height, which directory
+	// configs replace.
+	Primary bool
+}
+
+// retryBackoff is the wait before the first retry, later retries wait longer.
+const retryBackoff = 500 * time.Millisecond
+
+// maxParallelismFactor is how many workers per CPU are allowed before warning
+// that the parallelism is unlikely to help.
+const maxParallelismFactor = 4
+
+// Exit codes of the thumbnailer command.
+const (
+	// exitFailed means some images couldn't be processed.
+	exitFailed = 1
+	// exitFatal means the run couldn't start or complete, e.g. because of
+	// invalid flags or an unwritable output directory.
+	exitFatal = 2
+)
+
+// stdioPath is the input and output path that selects stdin and stdout.
+const stdioPath = "-"
 
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 
-	logFile, err := os.OpenFile("processing.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
-	if err != nil {
-		log.Fatalf("Failed to open log file: %v", err)
-	}
-	defer logFile.Close()
-	log.SetOutput(io.MultiWriter(os.Stdout, logFile))
+	// Log to stderr so stdout can carry image data when writing to "-"
+	log.SetOutput(stderr)
 
 	var rootCmd = &cobra.Command{
-		Use:   "thumbnailer",
+		Use:   "thumbnailer [file or directory...]",
 		Short: "Thumbnailer creates thumbnails of images",
-		Run:   run,
+		// file and directory arguments, next to the serve subcommand
+		Args: cobra.ArbitraryArgs,
+		Run:  run,
 	}
+	rootCmd.AddCommand(newServeCommand())
+	rootCmd.AddCommand(newBenchCommand())
+	rootCmd.AddCommand(newFormatsCommand())
 
-	rootCmd.Flags().StringVarP(&inputPath, "input", "i", "", "Path to the input images")
-	rootCmd.Flags().StringVarP(&outputPath, "output", "o", "", "Path to save the output thumbnails")
-	rootCmd.Flags().IntVarP(&compression, "compression", "c", 75, "Compression level (1-100)")
+	rootCmd.Flags().StringVarP(&inputPath, "input", "i", "", "Path to the input images, a directory, file or tar archive, or - to read a single image from stdin")
+	rootCmd.Flags().StringVar(&inputList, "input-list", "", "File with newline-separated input paths, or - to read them from stdin")
+	rootCmd.Flags().StringVarP(&outputPath, "output", "o", "", "Path to save the output thumbnails, or - to write to stdout")
+	rootCmd.Flags().IntVarP(&compression, "compression", "c", 75, "Compression level (1-100) of JPEG, WebP and AVIF output")
+	rootCmd.Flags().BoolVar(&progressive, "progressive", false, "Write progressive JPEGs (needs jpegtran)")
+	rootCmd.Flags().BoolVar(&noSubsample, "no-subsampling", false, "Write JPEGs with full-resolution chroma (4:4:4) instead of 4:2:0, for text and saturated colors")
+	rootCmd.Flags().StringVar(&pngLevel, "png-compression", "default", "Compression of PNG output (default, best-speed, best-compression, no-compression)")
+	rootCmd.Flags().IntVar(&palette, "palette", 0, "Quantize PNG output to an indexed palette of at most this many colors (2-256), for icons and logos")
 	rootCmd.Flags().IntVarP(&maxWidth, "width", "w", 0, "Maximum width of the output thumbnails")
 	rootCmd.Flags().IntVarP(&maxHeight, "height", "H", 0, "Maximum height of the output thumbnails")
-	rootCmd.Flags().StringVarP(&outputFormat, "format", "f", "jpeg", "Output image format (jpeg, png)")
+	rootCmd.Flags().Float64Var(&scale, "scale", 0, "Resize every image by a factor of its own size, e.g. 0.5 for half size, instead of to a width and height")
+	rootCmd.Flags().Int64Var(&maxPixelsOut, "max-pixels-out", 0, "Resize every image to at most this many pixels (width x height), keeping its aspect ratio, instead of to a width and height")
+	rootCmd.Flags().StringVar(&templateText, "output-template", "", "Go template for output file names, e.g. {{.Name}}_thumb_{{.Width}}.{{.Format}}")
+	rootCmd.Flags().StringVar(&timeFormat, "time-format", "2006-01-02_150405", "Go time layout of {{.CaptureTime}} in --output-template and --caption")
+	rootCmd.Flags().StringArrayVar(&sizeFlags, "size", nil, "Additional thumbnail size as WIDTHxHEIGHT, can be repeated (e.g. --size 150x150 --size 300x)")
+	rootCmd.Flags().StringSliceVarP(&formats, "format", "f", []string{"jpeg"}, "Output image format (jpeg, png, apng, gif, bmp, tiff, webp, avif), repeat to write every image in several formats")
+	rootCmd.Flags().StringVar(&outputExt, "output-ext", "", "File name extension of the thumbnails, e.g. jpg (default: the format)")
+	rootCmd.Flags().IntVar(&page, "page", 1, "Page to thumbnail from multi-page TIFFs and PDFs")
+	rootCmd.Flags().StringVar(&background, "background", "", "Hex color like #ffffff to fill transparent areas with (default: white for jpeg and bmp)")
+	rootCmd.Flags().StringVar(&filter, "filter", "lanczos", "Resample filter (lanczos, catmullrom, mitchell, linear, box, nearest)")
+	rootCmd.Flags().Float64Var(&sharpen, "sharpen", 0, "Sharpen the thumbnails after resizing with this sigma, 0.5 when given without a value")
+	rootCmd.Flags().Lookup("sharpen").NoOptDefVal = "0.5"
+	rootCmd.Flags().BoolVar(&grayscale, "grayscale", false, "Convert the thumbnails to grayscale")
+	rootCmd.Flags().BoolVar(&sepia, "sepia", false, "Give the thumbnails a sepia tone")
+	rootCmd.Flags().Float64Var(&contrast, "contrast", 0, "Change the contrast of the thumbnails by a percentage (-100 to 100)")
+	rootCmd.Flags().StringVar(&aspect, "aspect", "", "Center-crop images to this aspect ratio before resizing, e.g. 16:9 or 1:1")
+	rootCmd.Flags().Float64Var(&zoom, "zoom", 1, "Center-crop images to this fraction of their width and height before resizing, e.g. 0.8 to punch in (0-1)")
+	rootCmd.Flags().BoolVar(&cropSidecar, "crop-sidecar", false, "Crop images to the x, y, w and h box of their .crop.json sidecar, e.g. photo.jpg.crop.json, before resizing")
+	rootCmd.Flags().StringVar(&resizeMode, "mode", thumbnailer.ModeFit, "Resize mode: fit inside the box, fill it by cropping or pad the fitted image to it (fit, fill, pad)")
+	rootCmd.Flags().Float64Var(&maxAspect, "max-aspect", 3, "Fit instead of fill images whose long side is more than this many times their short side, such as panoramas, 0 to always fill")
+	rootCmd.Flags().StringVar(&watermark, "watermark", "", "PNG image to overlay on every thumbnail, scaled to a quarter of its size")
+	rootCmd.Flags().StringVar(&markPosition, "watermark-position", "bottom-right", "Where to place the watermark (top-left, top, top-right, left, center, right, bottom-left, bottom, bottom-right)")
+	rootCmd.Flags().Float64Var(&markOpacity, "watermark-opacity", 0.5, "Opacity of the watermark, from 0 to 1")
+	rootCmd.Flags().StringVar(&caption, "caption", "", "Text to draw onto every thumbnail, a Go template like --output-template, e.g. \"© Example {{.Name}}\"")
+	rootCmd.Flags().StringVar(&capPosition, "caption-position", "bottom-left", "Where to place the caption, one of the --watermark-position values")
+	rootCmd.Flags().StringVar(&capColor, "caption-color", "#ffffff", "Hex color of the caption text")
+	rootCmd.Flags().BoolVar(&capOutline, "caption-outline", false, "Outline the caption in a contrasting color to keep it readable over busy images")
+	rootCmd.Flags().BoolVar(&square, "square", false, "Write square thumbnails, padding the fitted image with the --background color instead of cropping")
+	rootCmd.Flags().StringVar(&metadata, "metadata", thumbnailer.MetadataStrip, "What to do with EXIF metadata of JPEG sources (strip, keep)")
+	rootCmd.Flags().BoolVar(&stripGPS, "strip-gps", false, "Remove GPS tags from kept metadata")
+	rootCmd.Flags().BoolVar(&preserveICC, "preserve-icc", false, "Embed the ICC color profile of JPEG and PNG sources into JPEG and PNG thumbnails")
+	rootCmd.Flags().StringSliceVar(&include, "include", nil, "Comma-separated file extensions to process (default: all supported input formats)")
+	rootCmd.Flags().StringSliceVar(&exclude, "exclude", nil, "Comma-separated file extensions to skip")
+	rootCmd.Flags().StringSliceVar(&rawExts, "raw-extensions", nil, "Comma-separated file extensions decoded as camera RAW (default: cr2,cr3,nef,arw,dng,raf,orf,rw2)")
+	rootCmd.Flags().StringVar(&targetSize, "target-size", "", "Pick the JPEG or WebP quality that keeps thumbnails just under this size, e.g. 50KB")
+	rootCmd.Flags().IntVar(&minWidth, "min-width", 0, "Skip sources narrower than this many pixels")
+	rootCmd.Flags().IntVar(&minHeight, "min-height", 0, "Skip sources shorter than this many pixels")
+	rootCmd.Flags().StringVar(&maxFileSize, "max-file-size", "", "Skip source files larger than this, e.g. 50MB (default: no limit)")
+	rootCmd.Flags().BoolVar(&blurHash, "blurhash", false, "Compute a BlurHash placeholder of every image and add it to the JSON report and the manifest")
+	rootCmd.Flags().BoolVar(&hashSidecar, "blurhash-sidecar", false, "With --blurhash, also save it next to the first thumbnail of every image, e.g. photo.jpeg.blurhash")
+	rootCmd.Flags().IntVar(&previewSize, "preview-size", 0, "Also make a preview of the first thumbnail of every image, at most this many pixels wide and high, and add it to the manifest as a data URI")
+	rootCmd.Flags().Int64Var(&maxPixels, "max-pixels", 100_000_000, "Fail images with more pixels (width x height) than this before decoding them, 0 for no limit")
+	rootCmd.Flags().StringVar(&minFree, "min-free", "", "Abort when the output filesystem has less free space than this, e.g. 1GB (default: no check)")
 	rootCmd.Flags().StringVarP(&configFile, "config", "C", "", "Path to the configuration file")
+	rootCmd.Flags().StringVar(&preset, "preset", "", "Name of a preset from the presets of the configuration file")
 	rootCmd.Flags().IntVarP(&parallelism, "parallelism", "p", runtime.NumCPU(), "Number of parallel image processing tasks")
+	rootCmd.Flags().StringVar(&reportFormat, "report-format", "text", "Format of the summary report (text, json, csv)")
+	rootCmd.Flags().DurationVar(&timeout, "timeout", 0, "Maximum time to spend on one image, e.g. 30s (default: no limit)")
+	rootCmd.Flags().BoolVar(&failFast, "fail-fast", false, "Stop the run at the first image that fails")
+	rootCmd.Flags().BoolVar(&ignoreErrors, "ignore-errors", false, "Exit with status 0 even when images failed")
+	rootCmd.Flags().BoolVar(&skipTools, "skip-tool-check", false, "Start the run even when the external tools of its RAW, HEIC or PDF files are missing")
+	rootCmd.Flags().IntVar(&retries, "retries", 2, "Number of times to retry an image that failed with a transient error, such as an I/O error or a failed external tool")
+	rootCmd.Flags().BoolVar(&incremental, "incremental", false, "Skip images whose thumbnails exist and are newer than the source")
+	rootCmd.Flags().StringVar(&since, "since", "", "Only process files modified within this duration, e.g. 24h or 7d, or since this time, e.g. 2024-05-01")
+	rootCmd.Flags().BoolVar(&overwrite, "overwrite", false, "Replace existing files at the output paths instead of skipping their images")
+	rootCmd.Flags().BoolVar(&force, "force", false, "Reprocess all images, even with --incremental")
+	rootCmd.Flags().BoolVar(&contactSheet, "contact-sheet", false, "Write a single contact sheet of all thumbnails instead of separate files")
+	rootCmd.Flags().IntVar(&columns, "columns", 6, "Number of columns of the contact sheet")
+	rootCmd.Flags().BoolVar(&watch, "watch", false, "Keep running and process images added to the input directory")
+	rootCmd.Flags().BoolVar(&dedupe, "dedupe", false, "Thumbnail identical source files once and copy the thumbnails for the duplicates")
+	rootCmd.Flags().BoolVar(&dataURI, "data-uri", false, "Write the thumbnails as base64 data URIs into data_uris.json, keyed by source path, instead of as image files")
+	rootCmd.Flags().BoolVar(&manifest, "manifest", false, "Write manifest.json mapping every source to its thumbnails and their SHA-256")
+	rootCmd.Flags().BoolVar(&stream, "stream", false, "Process files as the input is walked instead of listing them first, to bound memory use on huge trees")
+	rootCmd.Flags().BoolVar(&dryRun, "dry-run", false, "Only log what would be processed, without writing anything")
+	rootCmd.Flags().BoolVar(&recursive, "recursive", true, "Also process images in subdirectories of the input path")
+	rootCmd.Flags().BoolVar(&followLinks, "follow-symlinks", false, "Descend into symlinked directories of the input path, walking every directory only once")
+	rootCmd.Flags().BoolVar(&byDate, "organize-by-date", false, "Write thumbnails into YYYY/MM/DD folders by the EXIF capture date, or else the modification time")
+	rootCmd.Flags().BoolVar(&flatten, "flatten", false, "Write all thumbnails directly into the output directory instead of mirroring the input tree")
+	rootCmd.Flags().BoolVar(&noResize, "no-resize", false, "Re-encode images at their full size, e.g. to convert the format or strip metadata")
+	rootCmd.Flags().BoolVar(&noUpscale, "no-upscale", false, "Keep images smaller than the requested size at their own size")
+	rootCmd.Flags().BoolVar(&preserveTime, "preserve-mtime", false, "Give thumbnails the modification time of their source")
+	rootCmd.Flags().BoolVar(&noAutoOrient, "no-auto-orient", false, "Don't rotate images according to their EXIF orientation")
+
+	rootCmd.Flags().StringVar(&s3Bucket, "s3-bucket", "", "S3 bucket to upload the thumbnails to, in addition to writing them to the output")
+	rootCmd.Flags().StringVar(&s3Prefix, "s3-prefix", "", "Key prefix of the thumbnails uploaded to --s3-bucket")
+	rootCmd.Flags().StringVar(&logFilePath, "log-file", "processing.log", "File to append the log to, in addition to stderr")
+	rootCmd.Flags().StringVar(&logFormat, "log-format", logFormatText, "Format of log lines (text, json)")
+	rootCmd.Flags().BoolVar(&noLogFile, "no-log-file", false, "Only log to stderr")
+	rootCmd.Flags().BoolVarP(&quiet, "quiet", "q", false, "Don't show the progress line")
+	rootCmd.Flags().BoolVarP(&verbose, "verbose", "v", false, "Log the start and end of every image")
 
-	rootCmd.MarkFlagRequired("input")
 	rootCmd.MarkFlagRequired("output")
 
 	if err := rootCmd.Execute(); err != nil {
-		log.Fatalf("Error executing command: %v", err)
+		fatalf("Error executing command: %v", err)
 	}
 }
 
 func run(cmd *cobra.Command, args []string) {
+	if !noLogFile {
+		if logFile := openLogFile(logFilePath); logFile != nil {
+			defer logFile.Close()
+		}
+	}
+
 	if configFile != "" {
-		if err := readConfig(configFile); err != nil {
-			log.Fatalf("Error reading config file: %v", err)
+		if err := readConfig(configFile, preset, cmd.Flags().Changed); err != nil {
+			fatalf("Error reading config file: %v", err)
 		}
+	} else if preset != "" {
+		fatal("--preset needs a config file with presets, given with --config")
 	}
 
-	if maxWidth == 0 && maxHeight == 0 {
-		log.Fatal("Either max width or max height must be specified")
+	switch logFormat {
+	case logFormatText:
+	case logFormatJSON:
+		useJSONLogging(log.Writer())
+	default:
+		fatalf("Unsupported log format: %s", logFormat)
 	}
 
-	// Ensure the output directory exists
-	if err := os.MkdirAll(outputPath, os.ModePerm); err != nil {
-		log.Fatalf("Error creating output directory: %v", err)
+	if scale < 0 {
+		fatal("Scale must be positive")
+	}
+	if scale > 0 {
+		if maxWidth > 0 || maxHeight > 0 || len(sizeFlags) > 0 {
+			fatal("Scale can't be combined with a width, height or size")
+		}
+		// a single size without dimensions, thumb.Scale does the resizing
+		sizes = append(sizes, thumbnailSize{})
+	}
+	if maxPixelsOut < 0 {
+		fatal("Max output pixels must be positive")
+	}
+	if maxPixelsOut > 0 {
+		if scale > 0 || maxWidth > 0 || maxHeight > 0 || len(sizeFlags) > 0 {
+			fatal("--max-pixels-out can't be combined with a width, height, size or scale")
+		}
+		// a single size without dimensions, thumb.MaxOutPixels does the
+		// resizing
+		sizes = append(sizes, thumbnailSize{})
+	}
+	if noResize {
+		if scale > 0 || maxPixelsOut > 0 || maxWidth > 0 || maxHeight > 0 || len(sizeFlags) > 0 {
+			fatal("--no-resize can't be combined with a width, height, size, scale or --max-pixels-out")
+		}
+		// a single size without dimensions, which thumb leaves at full size
+		sizes = append(sizes, thumbnailSize{})
 	}
 
-	var files []string
-	err := filepath.Walk(inputPath, func(path string, info os.FileInfo, err error) error {
+	if maxWidth > 0 || maxHeight > 0 {
+		sizes = append(sizes, thumbnailSize{Width: maxWidth, Height: maxHeight, Primary: true})
+	}
+	for _, flag := range sizeFlags {
+		size, err := parseSize(flag)
 		if err != nil {
-			return err
+			fatalf("Invalid size %q: %v", flag, err)
 		}
-		if !info.IsDir() {
-			files = append(files, path)
+		sizes = append(sizes, size)
+	}
+	if len(sizes) == 0 {
+		fatal("Either max width, max height, scale, --max-pixels-out or --no-resize must be specified")
+	}
+
+	if templateText != "" {
+		var err error
+		if outputTemplate, err = template.New("output").Option("missingkey=error").Parse(templateText); err != nil {
+			fatalf("Invalid output template: %v", err)
 		}
-		return nil
-	})
-	if err != nil {
-		log.Fatalf("Error reading input path: %v", err)
 	}
 
-	log.Printf("Starting processing of %d images", len(files))
-	startTime := time.Now()
+	if reportFormat != "text" && reportFormat != "json" && reportFormat != "csv" {
+		fatalf("Unsupported report format: %s", reportFormat)
+	}
 
-	var wg sync.WaitGroup
-	sem := make(chan struct{}, parallelism)
-	var successCount, errorCount int
-	var mu sync.Mutex
-	var durations []time.Duration
+	// checked after readConfig, as the config file can set it too
+	if compression < 1 || compression > 100 {
+		fatalf("Compression must be between 1 (smallest files) and 100 (best quality), got %d", compression)
+	}
+	if err := checkQualities(qualities); err != nil {
+		fatalf("Invalid quality in config file: %v", err)
+	}
 
-	for _, file := range files {
-		wg.Add(1)
-		sem <- struct{}{}
+	if retries < 0 {
+		fatal("Retries must not be negative")
+	}
 
-		go func(file string) {
-			defer wg.Done()
-			defer func() { <-sem }()
+	if parallelism < 1 {
+		fatalf("Parallelism must be at least 1, got %d", parallelism)
+	}
+	if parallelism > maxParallelismFactor*runtime.NumCPU() {
+		log.Printf("Warning: parallelism %d is far above the %d available CPUs, resizing is CPU-bound so this rarely helps", parallelism, runtime.NumCPU())
+	}
 
-			retries := 0
-			for retries < maxRetries {
-				duration, err := processImage(file)
-				if err != nil {
-					log.Printf("Error processing image %s: %v", file, err)
-					retries++
-					if retries == maxRetries {
-						mu.Lock()
-						errorCount++
-						mu.Unlock()
-					}
-				} else {
-					mu.Lock()
-					successCount++
-					durations = append(durations, duration)
-					mu.Unlock()
-					break
-				}
+	if page < 1 {
+		fatal("Page must be 1 or higher")
+	}
+
+	if minWidth < 0 || minHeight < 0 {
+		fatal("Minimum width and height must not be negative")
+	}
+
+	if since != "" {
+		var err error
+		if sinceTime, err = parseSince(since, time.Now()); err != nil {
+			fatalf("Invalid --since %q: %v", since, err)
+		}
+		logVerbose("Only processing files modified since %s", sinceTime.Format(time.RFC3339))
+	}
+
+	if maxFileSize != "" {
+		var err error
+		if maxFileBytes, err = parseByteSize(maxFileSize); err != nil {
+			fatalf("Invalid max file size %q: %v", maxFileSize, err)
+		}
+	}
+
+	if maxPixels < 0 {
+		fatal("Max pixels must not be negative")
+	}
+
+	if minFree != "" {
+		var err error
+		if minFreeBytes, err = parseByteSize(minFree); err != nil {
+			fatalf("Invalid minimum free space %q: %v", minFree, err)
+		}
+	}
+
+	if square {
+		if cmd.Flags().Changed("mode") && resizeMode != thumbnailer.ModePad {
+			fatalf("--square can't be combined with --mode %s", resizeMode)
+		}
+		resizeMode = thumbnailer.ModePad
+		for i, size := range sizes {
+			if size.Width == 0 && size.Height == 0 {
+				fatal("--square needs a width, height or size")
 			}
-		}(file)
+			if sizes[i] = squareSize(size); sizes[i].Width != sizes[i].Height {
+				fatalf("--square needs equal widths and heights, got %dx%d", size.Width, size.Height)
+			}
+		}
 	}
 
-	wg.Wait()
-	endTime := time.Now()
-	log.Printf("Finished processing images in %v", endTime.Sub(startTime))
-	log.Printf("Successfully processed %d images, encountered %d errors", successCount, errorCount)
+	switch resizeMode {
+	case thumbnailer.ModeFit:
+	case thumbnailer.ModeFill, thumbnailer.ModePad:
+		name := "Fill"
+		if resizeMode == thumbnailer.ModePad {
+			name = "Pad"
+		}
+		if noResize {
+			fatalf("%s mode can't be combined with --no-resize", name)
+		}
+		for _, size := range sizes {
+			if size.Width == 0 || size.Height == 0 {
+				fatalf("%s mode requires both max width and max height", name)
+			}
+		}
+	default:
+		fatalf("Unsupported resize mode: %s", resizeMode)
+	}
+	if maxAspect != 0 && maxAspect < 1 {
+		fatalf("Max aspect must be at least 1, or 0 to always fill, got %v", maxAspect)
+	}
 
-	generateSummaryReport(len(files), successCount, errorCount, endTime.Sub(startTime), durations)
-}
+	if sharpen < 0 {
+		fatal("Sharpen sigma must not be negative")
+	}
 
-func generateSummaryReport(total, success, errors int, duration time.Duration, durations []time.Duration) {
-	report := fmt.Sprintf("Summary Report:\n"+
-		"Total images processed: %d\n"+
-		"Successfully processed: %d\n"+
-		"Errors encountered: %d\n"+
-		"Total time taken: %v\n",
-		total, success, errors, duration)
+	if contrast < -100 || contrast > 100 {
+		fatalf("Contrast must be between -100 and 100, got %v", contrast)
+	}
 
-	for i, d := range durations {
-		report += fmt.Sprintf("Image %d processing time: %v\n", i+1, d)
+	if !thumbnailer.SupportedFilter(filter) {
+		fatalf("Unsupported resample filter: %s", filter)
 	}
 
-	reportFile := filepath.Join(outputPath, "summary_report.txt")
-	if err := ioutil.WriteFile(reportFile, []byte(report), 0644); err != nil {
-		log.Fatalf("Error writing summary report: %v", err)
+	if metadata != thumbnailer.MetadataStrip && metadata != thumbnailer.MetadataKeep {
+		fatalf("Unsupported metadata mode: %s", metadata)
 	}
 
-	log.Printf("Summary report saved to %s", reportFile)
-}
+	// a single input file with an image file name as output is written to
+	// exactly that file, in the format of its extension unless one is given
+	if inputPath != "" && inputPath != stdioPath && len(args) == 0 && inputList == "" && !watch {
+		format, ok := singleOutputFormat(inputPath, outputPath)
+		if singleOutput = ok; ok && !cmd.Flags().Changed("format") {
+			if format == "" {
+				fatalf("Can't write %s files, name the output file after one of the output formats or give --format", filepath.Ext(outputPath))
+			}
+			formats = []string{format}
+		}
+	}
 
-func readConfig(file string) error {
-	data, err := ioutil.ReadFile(file)
-	if err != nil {
-		return err
+	formats = uniqueFormats(formats)
+	if len(formats) == 0 {
+		fatal("At least one output format must be given")
+	}
+	for _, format := range formats {
+		if !thumbnailer.SupportedFormat(format) {
+			fatalf("Unsupported output format: %s", format)
+		}
+	}
+	exts := make(map[string]string)
+	for _, format := range formats {
+		ext := thumbnailer.Extension(format)
+		if other, ok := exts[ext]; ok {
+			fatalf("Formats %s and %s can't be combined, their thumbnails would get the same name", other, format)
+		}
+		exts[ext] = format
 	}
+	// the first format is the one used where only one can be, e.g. for stdout
+	// and contact sheets, which refuse several below
+	outputFormat = formats[0]
 
-	var config map[string]interface{}
-	if err := json.Unmarshal(data, &config); err != nil {
-		return err
+	outputExt = strings.TrimPrefix(outputExt, ".")
+	if strings.ContainsAny(outputExt, `/\`) {
+		fatalf("Invalid output extension: %s", outputExt)
+	}
+	if outputExt != "" && len(formats) > 1 {
+		fatal("--output-ext can't be combined with several formats, their thumbnails would get the same name")
+	}
+	if outputExt == "" {
+		outputExt = thumbnailer.Extension(outputFormat)
+	}
+
+	// with several formats every size is written in each of them, the
+	// extension tells them apart
+	if len(formats) > 1 {
+		if outputTemplate != nil && !strings.Contains(templateText, ".Format") {
+			fatal("--output-template must use {{.Format}} with several formats, or their thumbnails get the same name")
+		}
+		var expanded []thumbnailSize
+		for _, size := range sizes {
+			for _, format := range formats {
+				size.Format = format
+				expanded = append(expanded, size)
+			}
+		}
+		sizes = expanded
 	}
 
-	if v, ok := config["input"].(string); ok {
-		inputPath = v
+	if progressive && hasFormat("jpeg") {
+		if _, err := exec.LookPath("jpegtran"); err != nil {
+			fatal("Progressive JPEG output needs jpegtran, install libjpeg-turbo (libjpeg-turbo-progs on Debian and Ubuntu, jpeg-turbo on Homebrew)")
+		}
+	}
+
+	var aspectRatio float64
+	if aspect != "" {
+		var err error
+		if aspectRatio, err = thumbnailer.ParseAspect(aspect); err != nil {
+			fatalf("Invalid aspect: %v", err)
+		}
 	}
-	if v, ok := config["output"].(string); ok {
-		outputPath = v
+
+	if zoom <= 0 || zoom > 1 {
+		fatalf("Invalid zoom %v: must be above 0 and at most 1", zoom)
+	}
+
+	var targetBytes int64
+	if targetSize != "" {
+		var err error
+		if targetBytes, err = parseByteSize(targetSize); err != nil || targetBytes <= 0 {
+			fatalf("Invalid target size %q: must be a positive size, e.g. 50KB", targetSize)
+		}
+		for _, format := range formats {
+			if !thumbnailer.SupportsTargetSize(format) {
+				fatalf("Target size needs jpeg or webp output, got %s", format)
+			}
+		}
 	}
-	if v, ok := config["compression"].(float64); ok {
-		compression = int(v)
+
+	pngCompression, err := thumbnailer.ParsePNGCompression(pngLevel)
+	if err != nil {
+		fatalf("Invalid PNG compression: %v", err)
 	}
-	if v, ok := config["width"].(float64); ok {
-		maxWidth = int(v)
+	if previewSize < 0 {
+		fatalf("Preview size must be positive, got %d", previewSize)
 	}
-	if v, ok := config["height"].(float64); ok {
-		maxHeight = int(v)
+	if previewSize > 0 && !manifest {
+		fatal("--preview-size needs --manifest, where the previews are recorded")
 	}
-	if v, ok := config["format"].(string); ok {
-		outputFormat = v
+	if palette != 0 && (palette < 2 || palette > 256) {
+		fatalf("Palette must be between 2 and 256 colors, got %d", palette)
 	}
 
-	return nil
-}
+	var backgroundColor color.Color
+	if background != "" {
+		if backgroundColor, err = thumbnailer.ParseColor(background); err != nil {
+			fatalf("Invalid background: %v", err)
+		}
+	}
 
-func processImage(file string) (time.Duration, error) {
-	log.Printf("Starting processing of image %s", file)
-	startTime := time.Now()
+	// the watermark is decoded once and shared by all workers
+	var mark *thumbnailer.Watermark
+	if watermark != "" {
+		if mark, err = thumbnailer.LoadWatermark(watermark, markPosition, markOpacity); err != nil {
+			fatalf("Invalid watermark: %v", err)
+		}
+	}
 
-	var img image.Image
-	var err error
-	var fileIsTempFile bool
-
-	if strings.HasSuffix(file, ".cr3") {
-		// Convert CR3 to JPEG using exiftool
-		jpegFile := strings.TrimSuffix(file, ".cr3") + ".jpg"
-		cmd := exec.Command("exiftool", "-b", "-JpgFromRaw", "-w", "jpg", file)
-		var stderr bytes.Buffer
-		cmd.Stderr = &stderr
-		err := cmd.Run()
+	// the text is filled in for every image, see captionFor
+	var captionText *thumbnailer.Caption
+	if caption != "" {
+		if captionTemplate, err = template.New("caption").Option("missingkey=error").Parse(caption); err != nil {
+			fatalf("Invalid caption: %v", err)
+		}
+		textColor, err := thumbnailer.ParseColor(capColor)
 		if err != nil {
-			return 0, fmt.Errorf("error converting CR3 to JPEG: %v, %s", err, stderr.String())
+			fatalf("Invalid caption color: %v", err)
+		}
+		if captionText, err = thumbnailer.NewCaption("", capPosition, textColor, capOutline); err != nil {
+			fatalf("Invalid caption: %v", err)
 		}
-		file = jpegFile
-		fileIsTempFile = true
 	}
 
-	imgFile, err := os.Open(file)
-	if err != nil {
-		return 0, fmt.Errorf("error opening image file %s: %v", file, err)
+	thumb := &thumbnailer.Thumbnailer{
+		Width:          maxWidth,
+		Height:         maxHeight,
+		Scale:          scale,
+		MaxOutPixels:   maxPixelsOut,
+		NoUpscale:      noUpscale,
+		Format:         outputFormat,
+		Quality:        compression,
+		FormatQuality:  qualities,
+		TargetBytes:    targetBytes,
+		Progressive:    progressive,
+		NoSubsampling:  noSubsample,
+		Mode:           resizeMode,
+		Aspect:         aspectRatio,
+		Zoom:           zoom,
+		Filter:         filter,
+		PNGCompression: pngCompression,
+		Palette:        palette,
+		AutoOrient:     !noAutoOrient,
+		Metadata:       metadata,
+		StripGPS:       stripGPS,
+		PreserveICC:    preserveICC,
+		Page:           page,
+		Background:     backgroundColor,
+		Sharpen:        sharpen,
+		Contrast:       contrast,
+		Grayscale:      grayscale,
+		Sepia:          sepia,
+		MaxPixels:      maxPixels,
+		Watermark:      mark,
+		Caption:        captionText,
 	}
-	defer imgFile.Close()
 
-	img, _, err = image.Decode(imgFile)
-	if err != nil {
-		return 0, fmt.Errorf("error decoding image file %s: %v", file, err)
+	if watch && dryRun {
+		fatal("Watch mode can't be combined with a dry run")
+	}
+
+	if contactSheet {
+		if columns < 1 {
+			fatal("Columns must be at least 1")
+		}
+		if watch {
+			fatal("Watch mode can't be combined with a contact sheet")
+		}
+		if len(formats) > 1 {
+			fatal("A contact sheet is written in a single format")
+		}
+		if manifest {
+			fatal("--manifest can't be combined with a contact sheet, which writes no thumbnails per image")
+		}
+		if blurHash {
+			fatal("--blurhash can't be combined with a contact sheet, which writes no thumbnails per image")
+		}
+	}
+
+	inputs := args
+	if inputPath != "" {
+		inputs = append([]string{inputPath}, inputs...)
+	}
+	if inputList != "" {
+		listed, err := readInputList(inputList)
+		if err != nil {
+			fatalf("Error reading input list: %v", err)
+		}
+		inputs = append(inputs, listed...)
+	}
+	if len(inputs) == 0 {
+		fatal("An input path, an input list or input files as arguments must be given")
+	}
+	if watch && (len(inputs) > 1 || inputPath == "") {
+		fatal("Watch mode needs a single input directory given with --input")
+	}
+
+	if dataURI {
+		if inputPath == stdioPath || outputPath == stdioPath || singleOutput || isZipOutput(outputPath) {
+			fatal("--data-uri needs an output directory to write data_uris.json to")
+		}
+		if len(sizes) > 1 {
+			fatal("--data-uri writes one thumbnail per image, it can't be combined with several sizes or formats")
+		}
+		if contactSheet || manifest || s3Bucket != "" || dedupe || incremental || watch || preserveTime || hashSidecar {
+			fatal("--data-uri writes no thumbnail files, so it can't be combined with --contact-sheet, --manifest, --s3-bucket, --dedupe, --incremental, --watch, --preserve-mtime or --blurhash-sidecar")
+		}
+	}
+
+	if inputPath == stdioPath || outputPath == stdioPath {
+		if watch {
+			fatal("Watch mode can't be used with stdin")
+		}
+		if inputPath != outputPath || len(inputs) > 1 {
+			fatal("Input and output must both be - to read from stdin and write to stdout")
+		}
+		if len(formats) > 1 {
+			fatal("Only one format can be written to stdout")
+		}
+		if len(sizes) > 1 {
+			fatal("Only one size can be written to stdout")
+		}
+		thumb.Width, thumb.Height = sizes[0].Width, sizes[0].Height
+		if err := setCaption(thumb, stdioPath, sizes[0]); err != nil {
+			fatalf("Error processing image from stdin: %v", err)
+		}
+		if err := processStdio(thumb); err != nil {
+			fatalf("Error processing image from stdin: %v", err)
+		}
+		return
+	}
+
+	if singleOutput {
+		if len(formats) > 1 {
+			fatal("Only one format can be written to an output file, give an output directory for several")
+		}
+		if len(sizes) > 1 {
+			fatal("Only one size can be written to an output file, give an output directory for several")
+		}
+		if contactSheet || manifest || s3Bucket != "" {
+			fatal("--contact-sheet, --manifest and --s3-bucket need an output directory, not an output file")
+		}
+		processSingle(thumb)
+		return
+	}
+
+	if stream && (contactSheet || dedupe) {
+		fatal("--stream can't be combined with --contact-sheet or --dedupe, which keep every image in memory")
+	}
+
+	// tar entries are held in memory until processed, so they are streamed
+	for _, root := range inputs {
+		if !isTarInput(root) {
+			continue
+		}
+		if watch {
+			fatal("Watch mode can't read from a tar archive")
+		}
+		if contactSheet || dedupe {
+			fatal("Tar archives can't be read with --contact-sheet or --dedupe, which keep every image in memory")
+		}
+		stream = true
+	}
+
+	if isZipOutput(outputPath) {
+		if watch {
+			fatal("Watch mode can't write to a zip archive")
+		}
+		if incremental || dedupe || s3Bucket != "" {
+			fatal("Incremental runs, --dedupe and --s3-bucket need an output directory, not a zip archive")
+		}
+	}
+
+	// Ensure the output directory exists
+	if !dryRun {
+		if isZipOutput(outputPath) {
+			if err := os.MkdirAll(filepath.Dir(outputPath), os.ModePerm); err != nil {
+				fatalf("Error creating output directory: %v", err)
+			}
+			if archive, err = createZipArchive(outputPath); err != nil {
+				fatalf("Error creating output archive: %v", err)
+			}
+		} else if err := os.MkdirAll(outputPath, os.ModePerm); err != nil {
+			fatalf("Error creating output directory: %v", err)
+		}
+	}
+
+	// checked before starting, and while running below
+	if minFreeBytes > 0 && !dryRun {
+		if low, err := checkFreeSpace(freeSpaceDir()); low {
+			fatalf("Not enough free space to start: %v", err)
+		} else if err != nil {
+			log.Printf("Warning: ignoring --min-free: %v", err)
+			minFreeBytes = 0
+		}
+	}
+
+	if len(rawExts) > 0 {
+		thumbnailer.SetRawExtensions(rawExts)
+	}
+	defaultInclude := len(include) == 0
+	if defaultInclude {
+		include = thumbnailer.InputExtensions()
+	}
+	includeExts, excludeExts := extensionSet(include), extensionSet(exclude)
+	// decoding goes by the content, so without --include files without an
+	// extension are taken too, once their content shows they're images
+	acceptName := func(path string) bool {
+		ext := strings.ToLower(filepath.Ext(path))
+		if ext == "" {
+			return defaultInclude
+		}
+		return includeExts[ext] && !excludeExts[ext]
+	}
+	accept := func(path string) bool {
+		return acceptName(path) && (filepath.Ext(path) != "" || thumbnailer.IsImageFile(path))
 	}
 
-	if maxWidth > 0 && maxHeight > 0 {
-		img = imaging.Fit(img, maxWidth, maxHeight, imaging.Lanczos)
-	} else if maxWidth > 0 {
-		img = resize.Resize(uint(maxWidth), 0, img, resize.Lanczos3)
+	// with --stream the walk feeds the workers directly, so the file list is
+	// never held in memory; otherwise it's collected first to know the total
+	var files []string
+	tooLargeCount := 0
+	var found atomic.Int64
+	walk := func(visit func(file string) bool) {
+		halted := false
+		for _, root := range inputs {
+			if halted {
+				break
+			}
+			if isTarInput(root) {
+				err := walkTar(root, func(path string, info os.FileInfo, r io.Reader) error {
+					if !recursive && filepath.Dir(path) != root {
+						return nil
+					}
+					if !acceptName(path) || info.ModTime().Before(sinceTime) {
+						return nil
+					}
+					if tooLarge(path, info.Size()) {
+						tooLargeCount++
+						return nil
+					}
+					// the content is sniffed like that of files on disk
+					data, err := io.ReadAll(r)
+					if err != nil {
+						return fmt.Errorf("error reading %s: %v", path, err)
+					}
+					if filepath.Ext(path) == "" && !thumbnailer.IsImageData(data) {
+						return nil
+					}
+					if thumbnailer.NeedsTools(data, path) {
+						log.Printf("Warning: skipping %s, RAW, HEIC and PDF files can't be read from a tar archive, extract it first", path)
+						return nil
+					}
+					if !addFileRoot(path, root) {
+						return nil
+					}
+					addTarEntry(path, data, info.ModTime())
+					found.Add(1)
+					if !visit(path) {
+						halted = true
+						return filepath.SkipAll
+					}
+					return nil
+				})
+				if err != nil {
+					fatalf("Error reading input archive: %v", err)
+				}
+				continue
+			}
+			err := walkInput(root, func(path string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				if info.IsDir() && !recursive && path != root {
+					return filepath.SkipDir
+				}
+				if info.IsDir() || !accept(path) {
+					return nil
+				}
+				if info.ModTime().Before(sinceTime) {
+					return nil
+				}
+				if tooLarge(path, info.Size()) {
+					tooLargeCount++
+					return nil
+				}
+				under := root
+				if listed, ok := listedRoots[path]; ok && path == root {
+					under = listed
+				}
+				if !addFileRoot(path, under) {
+					return nil
+				}
+				found.Add(1)
+				if !visit(path) {
+					halted = true
+					return filepath.SkipAll
+				}
+				return nil
+			})
+			if err != nil {
+				fatalf("Error reading input path: %v", err)
+			}
+		}
+	}
+	if stream {
+		logEvent(slog.LevelInfo, "start", "", 0, "Starting processing of images as they are found")
 	} else {
-		img = resize.Resize(0, uint(maxHeight), img, resize.Lanczos3)
-	}
-
-	outputFile := filepath.Join(outputPath, strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))+"."+outputFormat)
-	switch outputFormat {
-	case "jpeg":
-		err = imaging.Save(img, outputFile, imaging.JPEGQuality(compression))
-	case "png":
-		err = imaging.Save(img, outputFile)
-	case "gif":
-		err = imaging.Save(img, outputFile)
-	case "bmp":
-		err = imaging.Save(img, outputFile)
-	default:
-		return 0, fmt.Errorf("unsupported output format: %s", outputFormat)
+		walk(func(file string) bool {
+			files = append(files, file)
+			return true
+		})
+		// fail before starting rather than with every RAW, HEIC or PDF file
+		// when their tools are missing; streamed files aren't known up front
+		if err := thumbnailer.CheckTools(files); err != nil && skipTools {
+			log.Printf("Warning: missing external tool: %v", err)
+		} else if err != nil {
+			fatalf("Missing external tool: %v", err)
+		}
+		// there's no use in more workers than files, unless more arrive when watching
+		if !watch && len(files) > 0 && parallelism > len(files) {
+			parallelism = len(files)
+		}
+		logEvent(slog.LevelInfo, "start", "", 0, "Starting processing of %d images", len(files))
 	}
+	startTime := time.Now()
 
+	var successCount, errorCount, skippedCount, duplicateCount, existingCount int
+	var mu sync.Mutex
+	var results []imageResult
+	report, err := newSummaryReport(stream)
 	if err != nil {
-		return 0, fmt.Errorf("error saving image %s: %v", outputFile, err)
+		fatalf("Error creating summary report: %v", err)
 	}
+	defer report.close()
 
-	if fileIsTempFile {
-		removeTempFile(file)
+	var done atomic.Int64
+	stopProgress := func() {}
+	if !quiet && !dryRun && isTerminal(os.Stderr) {
+		stopProgress = startProgress(&done, &found)
 	}
 
-	endTime := time.Now()
-	duration := endTime.Sub(startTime)
-	log.Printf("Finished processing image %s in %v", file, duration)
+	// on SIGINT or SIGTERM, or the first error with --fail-fast, stop
+	// dispatching, but let images in progress finish; their uploads are
+	// cancelled by the signal though
+	sigCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ctx, abort := context.WithCancel(sigCtx)
+	defer abort()
 
-	return duration, nil
-}
+	process := processWithRetries
+	if dedupe {
+		process = newDedupeIndex().process
+	}
+	var uploader *s3Uploader
+	if s3Bucket != "" && !dryRun {
+		var err error
+		uploader, err = newS3Uploader(sigCtx, s3Bucket, s3Prefix)
+		if err != nil {
+			fatalf("Error setting up S3 upload: %v", err)
+		}
+		process = uploader.wrap(sigCtx, process)
+	}
+
+	// record keeps result for the report, streamed results are added right
+	// away instead of being kept until the end; manifest entries are small
+	// enough to be kept either way
+	var manifestEntries []manifestEntry
+	dataURIs := make(map[string]string)
+	record := func(result imageResult) {
+		mu.Lock()
+		defer mu.Unlock()
+		if manifest {
+			if entry, ok := manifestFor(result); ok {
+				manifestEntries = append(manifestEntries, entry)
+			}
+		}
+		if dataURI && len(result.Outputs) > 0 {
+			// directory configs may add sizes, the first one is kept
+			dataURIs[result.File] = result.Outputs[0].DataURI
+		}
+		if stream {
+			report.add(result)
+		} else {
+			results = append(results, result)
+		}
+	}
+
+	// when the output filesystem runs low, stop dispatching like --fail-fast
+	var lowSpace error
+	lowFree := func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		return lowSpace
+	}
+	monitorCtx, stopMonitor := context.WithCancel(ctx)
+	defer stopMonitor()
+	if minFreeBytes > 0 && !dryRun {
+		go monitorFreeSpace(monitorCtx, freeSpaceDir(), func(err error) {
+			mu.Lock()
+			lowSpace = err
+			mu.Unlock()
+			abort()
+		})
+	}
 
-func removeTempFile(file string) {
-	if err := os.Remove(file); err != nil {
-		log.Printf("Error removing file %s: %v", file, err)
+	var wg sync.WaitGroup
+	jobs := make(chan string)
+	for i := 0; i < parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for file := range jobs {
+				result := process(thumb, file)
+				forgetTarEntry(file)
+				if stream && len(inputs) == 1 && result.Err == nil {
+					// a single walk can't find a file twice, failed files
+					// keep theirs for failures.txt
+					forgetFileRoot(file)
+				}
+				mu.Lock()
+				if result.Skipped {
+					skippedCount++
+				} else if result.Err == nil {
+					successCount++
+				} else {
+					errorCount++
+					if failFast {
+						abort()
+					}
+				}
+				if result.DuplicateOf != "" {
+					duplicateCount++
+				}
+				if result.Existing {
+					existingCount++
+				}
+				mu.Unlock()
+				record(result)
+				done.Add(1)
+			}
+		}()
+	}
+
+	stopped := false
+	dispatched := 0
+	stopDispatching := func() {
+		stopped = true
+		if sigCtx.Err() != nil {
+			// restore the default handling, so a second signal kills the process
+			stop()
+			log.Print("Interrupted, waiting for images in progress to finish")
+		} else if lowFree() != nil {
+			log.Printf("Error: %v, waiting for images in progress to finish", lowFree())
+		} else {
+			log.Print("Stopping at the first error, waiting for images in progress to finish")
+		}
 	}
+	dispatch := func(file string) bool {
+		if ctx.Err() != nil {
+			stopDispatching()
+			return false
+		}
+		if minFreeBytes > 0 && !dryRun {
+			// the monitor can't see the space taken since its last check
+			if low, err := checkFreeSpace(freeSpaceDir()); low {
+				mu.Lock()
+				lowSpace = err
+				mu.Unlock()
+				abort()
+				stopDispatching()
+				return false
+			}
+		}
+		dispatched++
+
+		if incremental && !force && upToDate(file) {
+			logVerbose("Skipping up-to-date image %s", file)
+			forgetTarEntry(file)
+			done.Add(1)
+			mu.Lock()
+			skippedCount++
+			mu.Unlock()
+			record(imageResult{File: file, Skipped: true})
+			return true
+		}
+		if dryRun {
+			if previewImage(thumb, file) {
+				successCount++
+			} else {
+				skippedCount++
+			}
+			forgetTarEntry(file)
+			return true
+		}
+
+		select {
+		case jobs <- file:
+			return true
+		case <-ctx.Done():
+			dispatched--
+			stopDispatching()
+			return false
+		}
+	}
+
+	if stream {
+		walk(dispatch)
+	} else {
+		for _, file := range files {
+			if !dispatch(file) {
+				break
+			}
+		}
+	}
+	close(jobs)
+
+	wg.Wait()
+	stopMonitor()
+	stopProgress()
+	if dryRun {
+		log.Printf("Dry run: would process %d images, skip %d", successCount, skippedCount)
+		return
+	}
+
+	notStarted := int(found.Load()) - dispatched
+	endTime := time.Now()
+	logEvent(slog.LevelInfo, "summary", "", endTime.Sub(startTime), "Finished processing images in %v", endTime.Sub(startTime))
+	logEvent(slog.LevelInfo, "summary", "", 0, "Successfully processed %d images, skipped %d, encountered %d errors", successCount, skippedCount, errorCount)
+	if tooLargeCount > 0 {
+		log.Printf("Skipped %d files larger than %s", tooLargeCount, maxFileSize)
+	}
+	if dedupe {
+		log.Printf("Found %d duplicate images", duplicateCount)
+	}
+	if existingCount > 0 {
+		log.Printf("Skipped %d images whose thumbnails already exist, use --overwrite to replace them", existingCount)
+	}
+	if stream && stopped {
+		log.Print("Stopped before processing the rest of the input")
+	} else if notStarted > 0 {
+		log.Printf("Stopped before processing %d images", notStarted)
+	}
+
+	if !stream {
+		// results arrive in completion order, sort them so reports can be diffed
+		sort.Slice(results, func(i, j int) bool {
+			return results[i].File < results[j].File
+		})
+		for _, r := range results {
+			report.add(r)
+		}
+	}
+	if report.thumbnails > successCount {
+		// sizes holds every size once per format
+		logEvent(slog.LevelInfo, "summary", "", 0, "Wrote %d thumbnails, %d sizes x %d formats per image", report.thumbnails, len(sizes)/len(formats), len(formats))
+	}
+	if report.latency.count > 0 {
+		logEvent(slog.LevelInfo, "summary", "", 0, "Processing time per image: %v", &report.latency)
+	}
+	report.write(int(found.Load())+tooLargeCount, successCount, errorCount, skippedCount, duplicateCount, tooLargeCount, endTime.Sub(startTime))
+	if manifest {
+		if err := writeManifest(manifestEntries); err != nil {
+			fatalf("Error writing manifest: %v", err)
+		}
+	}
+	if dataURI && !dryRun {
+		if err := writeDataURIs(dataURIs); err != nil {
+			fatalf("Error writing data URIs: %v", err)
+		}
+	}
+
+	if contactSheet {
+		file, err := writeContactSheet(thumb, results)
+		if err != nil {
+			fatalf("Error writing contact sheet: %v", err)
+		}
+		// the contact sheet takes the place of the thumbnails, so it's
+		// uploaded like them
+		if uploader != nil && file != "" {
+			if err := uploader.upload(sigCtx, file, thumbnailer.ContentType(outputFormat)); err != nil {
+				fatalf("Error uploading contact sheet: %v", err)
+			}
+			logVerbose("Uploaded %s to s3://%s", file, uploader.bucket)
+		}
+	}
+
+	if archive != nil {
+		if err := archive.close(); err != nil {
+			fatalf("Error writing output archive: %v", err)
+		}
+		log.Printf("Thumbnails saved to %s", outputPath)
+	}
+
+	if err := lowFree(); err != nil {
+		fatalf("Stopped before processing every image: %v", err)
+	}
+
+	if watch && !stopped {
+		stop()
+		if err := watchInput(thumb, accept, process); err != nil {
+			fatalf("Error watching input path: %v", err)
+		}
+	}
+
+	if errorCount > 0 && !ignoreErrors {
+		os.Exit(exitFailed)
+	}
+}
+
+// openLogFile adds file as a second log destination. When it can't be opened
+// logging continues on stderr only.
+func openLogFile(file string) *os.File {
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		log.Printf("Warning: can't open log file, logging to stderr only: %v", err)
+		return nil
+	}
+	log.SetOutput(io.MultiWriter(stderr, f))
+	return f
+}
+
+// readInputList reads the newline-separated input paths listed in file, or
+// stdin for -. Blank lines are ignored. A path may be followed by a tab and
+// the input path it was found under, which is recorded in listedRoots.
+func readInputList(file string) ([]string, error) {
+	var data []byte
+	var err error
+	if file == stdioPath {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(file)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		path, root, ok := strings.Cut(line, "\t")
+		if ok && strings.TrimSpace(root) != "" {
+			listedRoots[path] = strings.TrimSpace(root)
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+// readConfig applies the settings of a config file and, unless preset is
+// empty, of the named preset in it. changed reports the flags given on the
+// command line, which win over both.
+func readConfig(file, preset string, changed func(flag string) bool) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	var config map[string]interface{}
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &config)
+	case ".toml":
+		err = toml.Unmarshal(data, &config)
+	default:
+		err = json.Unmarshal(data, &config)
+	}
+	if err != nil {
+		return err
+	}
+
+	settings := parseConfigSettings(config, "config file "+file)
+	presets, _ := config["presets"].(map[string]interface{})
+	if preset != "" {
+		values, ok := presets[preset].(map[string]interface{})
+		if !ok {
+			var names []string
+			for name := range presets {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return fmt.Errorf("no preset %q in %s, available presets: %s", preset, file, strings.Join(names, ", "))
+		}
+		settings.merge(parseConfigSettings(values, fmt.Sprintf("preset %s of config file %s", preset, file)))
+	}
+	settings.apply(changed)
+	return nil
+}
+
+// configSettings are the options a config file or one of its presets sets,
+// nil when it leaves them alone.
+type configSettings struct {
+	Input       *string
+	Output      *string
+	Compression *int
+	Qualities   map[string]int
+	Width       *int
+	Height      *int
+	Format      *string
+}
+
+// parseConfigSettings reads the settings from the decoded values of a config
+// file or preset, warning about unknown keys. source names it in warnings.
+func parseConfigSettings(values map[string]interface{}, source string) configSettings {
+	var keys []string
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !configKeys[key] {
+			log.Printf("Warning: unknown key %q in %s", key, source)
+		}
+	}
+
+	var s configSettings
+	if v, ok := values["input"].(string); ok {
+		s.Input = &v
+	}
+	if v, ok := values["output"].(string); ok {
+		s.Output = &v
+	}
+	// quality is the name used in presets, compression the one of the flag
+	for _, key := range []string{"quality", "compression"} {
+		if v, ok := configInt(values[key]); ok {
+			s.Compression = &v
+		}
+	}
+	// quality can also map formats to their own quality
+	if m, ok := values["quality"].(map[string]interface{}); ok {
+		s.Qualities = make(map[string]int)
+		for format, v := range m {
+			q, ok := configInt(v)
+			if !ok {
+				log.Printf("Warning: the quality of %s in %s isn't a number, ignoring it", format, source)
+				continue
+			}
+			s.Qualities[format] = q
+		}
+	}
+	if v, ok := configInt(values["width"]); ok {
+		s.Width = &v
+	}
+	if v, ok := configInt(values["height"]); ok {
+		s.Height = &v
+	}
+	if v, ok := values["format"].(string); ok {
+		s.Format = &v
+	}
+	return s
+}
+
+// merge replaces the settings of s that o sets.
+func (s *configSettings) merge(o configSettings) {
+	if o.Input != nil {
+		s.Input = o.Input
+	}
+	if o.Output != nil {
+		s.Output = o.Output
+	}
+	if o.Compression != nil {
+		s.Compression = o.Compression
+	}
+	if o.Qualities != nil {
+		// a new map, s may be a cached directory config
+		merged := make(map[string]int)
+		for format, q := range s.Qualities {
+			merged[format] = q
+		}
+		for format, q := range o.Qualities {
+			merged[format] = q
+		}
+		s.Qualities = merged
+	}
+	if o.Width != nil {
+		s.Width = o.Width
+	}
+	if o.Height != nil {
+		s.Height = o.Height
+	}
+	if o.Format != nil {
+		s.Format = o.Format
+	}
+}
+
+// apply sets the flags s has a value for, unless they were given on the
+// command line, which takes precedence.
+func (s configSettings) apply(changed func(flag string) bool) {
+	if s.Input != nil && !changed("input") {
+		inputPath = *s.Input
+	}
+	if s.Output != nil && !changed("output") {
+		outputPath = *s.Output
+	}
+	if s.Compression != nil && !changed("compression") {
+		compression = *s.Compression
+	}
+	// --compression is the default of the formats left out, so it doesn't
+	// replace them
+	if s.Qualities != nil {
+		qualities = s.Qualities
+	}
+	if s.Width != nil && !changed("width") {
+		maxWidth = *s.Width
+	}
+	if s.Height != nil && !changed("height") {
+		maxHeight = *s.Height
+	}
+	if s.Format != nil && !changed("format") {
+		formats = []string{*s.Format}
+	}
+}
+
+// configKeys lists the keys understood in a config file.
+var configKeys = map[string]bool{
+	"input":       true,
+	"output":      true,
+	"compression": true,
+	"quality":     true,
+	"width":       true,
+	"height":      true,
+	"format":      true,
+	"presets":     true,
+}
+
+// checkQualities returns an error when a per-format quality is out of range
+// or for a format without a quality setting.
+func checkQualities(qualities map[string]int) error {
+	for format, q := range qualities {
+		if !thumbnailer.SupportsQuality(format) {
+			return fmt.Errorf("%s has no quality setting, only jpeg, webp and avif do", format)
+		}
+		if q < 1 || q > 100 {
+			return fmt.Errorf("the quality of %s must be between 1 and 100, got %d", format, q)
+		}
+	}
+	return nil
+}
+
+// configInt converts a numeric config value to an int. JSON decodes numbers as
+// float64 while YAML and TOML produce integer types.
+func configInt(v interface{}) (int, bool) {
+	switch n := v.(type) {
+	case float64:
+		return int(n), true
+	case int:
+		return n, true
+	case int64:
+		return int(n), true
+	}
+	return 0, false
+}
+
+// processStdio thumbnails a single image read from stdin and writes it to stdout.
+func processStdio(thumb *thumbnailer.Thumbnailer) error {
+	startTime := time.Now()
+	if err := thumb.Process(os.Stdin, os.Stdout); err != nil {
+		return err
+	}
+	duration := time.Since(startTime)
+	logEvent(slog.LevelInfo, "finish", stdioPath, duration, "Finished processing image from stdin in %v", duration)
+	return nil
+}
+
+// fatal logs like log.Print and exits with exitFatal.
+func fatal(v ...interface{}) {
+	if logFormat == logFormatJSON {
+		slog.Error(fmt.Sprint(v...))
+	} else {
+		log.Output(2, fmt.Sprint(v...))
+	}
+	os.Exit(exitFatal)
+}
+
+// fatalf logs like log.Printf and exits with exitFatal.
+func fatalf(format string, v ...interface{}) {
+	if logFormat == logFormatJSON {
+		slog.Error(fmt.Sprintf(format, v...))
+	} else {
+		log.Output(2, fmt.Sprintf(format, v...))
+	}
+	os.Exit(exitFatal)
+}
+
+// logVerbose logs only with --verbose.
+func logVerbose(format string, v ...interface{}) {
+	if verbose {
+		log.Output(2, fmt.Sprintf(format, v...))
+	}
+}
+
+// previewImage logs the thumbnails processImage would write for file, reading
+// only the image header to compute their dimensions. It returns false for
+// images that would be skipped as too small or for existing thumbnails.
+func previewImage(thumb *thumbnailer.Thumbnailer, file string) bool {
+	if existing, _ := existingOutput(file); existing != "" {
+		log.Printf("Would skip %s, %s already exists", file, existing)
+		return false
+	}
+
+	var config image.Config
+	if !needsExtracting(file) {
+		var err error
+		if config, err = decodeConfig(file); err != nil {
+			log.Printf("Could not read dimensions of %s: %v", file, err)
+		}
+	}
+
+	if config.Width > 0 && tooSmall(config.Width, config.Height) && tooSmall(config.Height, config.Width) {
+		log.Printf("Would skip %s (%dx%d), it's below the minimum size", file, config.Width, config.Height)
+		return false
+	}
+	if cropSidecar {
+		if crop, ok, err := readCropSidecar(file); err != nil {
+			log.Printf("Warning: %v", err)
+		} else if ok {
+			log.Printf("Would crop %s to %dx%d at %d,%d", file, crop.Dx(), crop.Dy(), crop.Min.X, crop.Min.Y)
+			config.Width, config.Height = crop.Dx(), crop.Dy()
+		}
+	}
+
+	sizes, err := sizesFor(file)
+	if err != nil {
+		log.Printf("Warning: %v", err)
+		return true
+	}
+	thumb = fitExtremeAspect(thumb, file, config.Width, config.Height)
+	for _, size := range sizes {
+		outputFile, err := outputFileFor(file, size)
+		if err != nil {
+			log.Printf("Error computing output path for %s: %v", file, err)
+			return true
+		}
+
+		sized := *thumb
+		sized.Width, sized.Height = size.Width, size.Height
+		if w, h := sized.TargetSize(config.Width, config.Height); w > 0 {
+			log.Printf("Would write %s -> %s (%dx%d)", file, outputFile, w, h)
+		} else {
+			log.Printf("Would write %s -> %s", file, outputFile)
+		}
+	}
+	return true
+}
+
+// decodeConfig reads the dimensions of file from its header.
+func decodeConfig(file string) (image.Config, error) {
+	f, err := openSource(file)
+	if err != nil {
+		return image.Config{}, err
+	}
+	defer f.Close()
+
+	config, _, err := image.DecodeConfig(f)
+	return config, err
+}
+
+// processWithRetries processes file, retrying failures with a growing backoff.
+// The returned result has Err set when the last attempt failed.
+func processWithRetries(thumb *thumbnailer.Thumbnailer, file string) imageResult {
+	for attempt := 1; ; attempt++ {
+		result, err := processWithTimeout(thumb, file)
+		if err == nil {
+			return result
+		}
+
+		if attempt > retries || !isTransient(err) {
+			logEvent(slog.LevelError, "error", file, 0, "Warning: failed to process image %s: %v", file, err)
+			// the report still gives the size of failed sources
+			failed := imageResult{File: file, Err: err}
+			if size, _, err := statSource(file); err == nil {
+				failed.SourceBytes = size
+			}
+			return failed
+		}
+
+		logVerbose("Error processing image %s (attempt %d of %d), retrying: %v", file, attempt, retries+1, err)
+		time.Sleep(time.Duration(attempt) * retryBackoff)
+	}
+}
+
+// transientErrnos are the system errors that may go away when an image is
+// processed again, on top of those whose Temporary method says so: a file
+// locked or busy in another program, and I/O errors of network filesystems.
+var transientErrnos = map[syscall.Errno]bool{
+	syscall.EBUSY:   true,
+	syscall.ETXTBSY: true,
+	syscall.EIO:     true,
+}
+
+// isTransient reports whether err may go away when the image is processed
+// again: system errors reading the source or writing its thumbnails such as a
+// file locked by another program, see transientErrnos. Decode and format
+// errors fail for good, as do timeouts, missing or unreadable files, missing
+// tools, external tools that failed even after their own retries, and
+// decompression bombs.
+func isTransient(err error) bool {
+	var errno syscall.Errno
+	switch {
+	case errors.Is(err, errTimeout), errors.Is(err, thumbnailer.ErrTooManyPixels),
+		errors.Is(err, thumbnailer.ErrToolFailed), errors.Is(err, exec.ErrNotFound):
+		return false
+	case errors.As(err, &errno):
+		return transientErrnos[errno] || errno.Temporary()
+	}
+	return false
+}
+
+// errTimeout is returned for images that took longer than --timeout.
+var errTimeout = errors.New("timed out")
+
+// processWithTimeout runs processImage, giving up on the image after --timeout.
+// An abandoned decode keeps running in the background until it returns, but
+// once the context is done it writes no thumbnails or sidecars into place, see
+// saveFileContext, so neither do images already reported as failed, nor ones
+// racing a retry of themselves.
+func processWithTimeout(thumb *thumbnailer.Thumbnailer, file string) (imageResult, error) {
+	if timeout <= 0 {
+		return processImage(context.Background(), thumb, file)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	type outcome struct {
+		result imageResult
+		err    error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		result, err := processImage(ctx, thumb, file)
+		done <- outcome{result, err}
+	}()
+
+	select {
+	case o := <-done:
+		return o.result, o.err
+	case <-ctx.Done():
+		return imageResult{File: file}, fmt.Errorf("%w after %v", errTimeout, timeout)
+	}
+}
+
+// imageResult records the outcome of processing one source image.
+type imageResult struct {
+	File     string
+	Duration time.Duration
+	// Width and Height are the dimensions of the decoded source.
+	Width  int
+	Height int
+	// SourceBytes is the size of the source file.
+	SourceBytes int64
+	// DecodeTime is the time spent decoding the source, and ConvertTime the
+	// time external tools spent converting it, e.g. exiftool for RAW files.
+	DecodeTime  time.Duration
+	ConvertTime time.Duration
+	Outputs     []outputResult
+	Err         error
+	// Skipped is set for images left alone because they were up-to-date,
+	// smaller than --min-width or --min-height or had existing thumbnails.
+	Skipped bool
+	// Existing is set along with Skipped when a thumbnail of the image exists
+	// and may not be overwritten.
+	Existing bool
+	// DuplicateOf is the source whose thumbnails were copied with --dedupe.
+	DuplicateOf string
+	// BlurHash is the BlurHash of the first thumbnail with --blurhash.
+	BlurHash string
+	// Thumbnail is kept in memory for the contact sheet instead of being
+	// written to a file.
+	Thumbnail image.Image
+}
+
+// Status returns "success", "error" or "skipped".
+func (r imageResult) Status() string {
+	switch {
+	case r.Skipped:
+		return "skipped"
+	case r.Err != nil:
+		return "error"
+	}
+	return "success"
+}
+
+// outputResult describes one thumbnail written for a source image.
+type outputResult struct {
+	Path   string
+	Width  int
+	Height int
+	Bytes  int64
+	Format string
+	// SHA256 is the hex SHA-256 of the written thumbnail.
+	SHA256 string
+	// DataURI is the thumbnail as a base64 data URI with --data-uri, which
+	// writes no file to Path.
+	DataURI string
+	// Preview is the --preview-size preview of the first thumbnail of an
+	// image, as a base64 data URI.
+	Preview string
+	// ResizeTime is the time spent resizing, or rendering SVGs, and
+	// EncodeTime the time spent encoding and writing the thumbnail.
+	ResizeTime time.Duration
+	EncodeTime time.Duration
+}
+
+// processImage writes all thumbnails of file. It stops before writing when ctx
+// is done.
+func processImage(ctx context.Context, thumb *thumbnailer.Thumbnailer, file string) (imageResult, error) {
+	if verbose {
+		logEvent(slog.LevelInfo, "start", file, 0, "Starting processing of image %s", file)
+	}
+	startTime := time.Now()
+	result := imageResult{File: file}
+	if size, _, err := statSource(file); err == nil {
+		result.SourceBytes = size
+	}
+
+	if existing, err := existingOutput(file); err != nil {
+		return result, err
+	} else if existing != "" {
+		return skipExisting(result, existing, startTime), nil
+	}
+
+	thumb, err := fileThumbnailer(thumb, file)
+	if err != nil {
+		return result, err
+	}
+	sizes, err := sizesFor(file)
+	if err != nil {
+		return result, err
+	}
+
+	// SVGs are rendered at every thumbnail size below instead of resized
+	svg := isSVGSource(file)
+
+	// the header is enough to reject decompression bombs and to skip small
+	// images without decoding them, unless the EXIF orientation might still
+	// swap the dimensions
+	if (minWidth > 0 || minHeight > 0 || thumb.MaxPixels > 0) && !needsExtracting(file) {
+		if config, err := decodeConfig(file); err == nil {
+			if err := thumb.CheckPixels(config.Width, config.Height); err != nil && !svg {
+				return result, fmt.Errorf("error decoding image file %s: %w", file, err)
+			}
+			if tooSmall(config.Width, config.Height) && tooSmall(config.Height, config.Width) {
+				return skipSmall(result, config.Width, config.Height, startTime), nil
+			}
+		}
+	}
+
+	// external tools run during decoding, their time is split off below
+	ctx = thumbnailer.WithToolTime(ctx, &result.ConvertTime)
+	decodeStart := time.Now()
+
+	// animated GIFs keep all their frames when writing GIF, WebP or APNG
+	var animated, still bool
+	for format := range sizeFormats(thumb, sizes) {
+		if thumbnailer.AnimatedFormat(format) {
+			animated = true
+		} else {
+			still = true
+		}
+	}
+	var anim *gif.GIF
+	if animated && !contactSheet {
+		if anim, err = decodeSourceAnimation(file); err != nil {
+			return result, fmt.Errorf("error decoding animation %s: %w", file, err)
+		}
+	}
+
+	// the other formats of a run with several take the still image
+	var img image.Image
+	if anim != nil && !still {
+		result.Width, result.Height = anim.Config.Width, anim.Config.Height
+	} else if svg {
+		config, err := decodeConfig(file)
+		if err != nil {
+			return result, fmt.Errorf("error decoding image file %s: %v", file, err)
+		}
+		result.Width, result.Height = config.Width, config.Height
+	} else {
+		if img, err = decodeSource(ctx, thumb, file); err != nil {
+			return result, err
+		}
+		result.Width, result.Height = img.Bounds().Dx(), img.Bounds().Dy()
+	}
+	result.DecodeTime = time.Since(decodeStart) - result.ConvertTime
+	if tooSmall(result.Width, result.Height) {
+		return skipSmall(result, result.Width, result.Height, startTime), nil
+	}
+
+	if cropSidecar {
+		crop, ok, err := readCropSidecar(file)
+		if err != nil {
+			return result, err
+		}
+		if ok && img == nil {
+			log.Printf("Warning: ignoring the crop sidecar of %s, only still raster images can be cropped", file)
+		} else if ok {
+			if img, err = thumbnailer.Crop(img, crop); err != nil {
+				return result, fmt.Errorf("error cropping image %s: %v", file, err)
+			}
+		}
+	}
+
+	if img != nil {
+		thumb = fitExtremeAspect(thumb, file, img.Bounds().Dx(), img.Bounds().Dy())
+	} else {
+		thumb = fitExtremeAspect(thumb, file, result.Width, result.Height)
+	}
+
+	if contactSheet {
+		sized := *thumb
+		sized.Width, sized.Height = sizes[0].Width, sizes[0].Height
+		if err := setCaption(&sized, file, sizes[0]); err != nil {
+			return result, err
+		}
+		if svg {
+			if img, err = decodeSource(ctx, &sized, file); err != nil {
+				return result, err
+			}
+		}
+		result.Thumbnail = sized.Resize(img)
+		result.Duration = time.Since(startTime)
+		return result, nil
+	}
+
+	var exif []byte
+	if thumb.Metadata == thumbnailer.MetadataKeep && img != nil && !isRawSource(file) {
+		if exif, err = readSourceExif(file); err != nil {
+			return result, err
+		}
+	}
+
+	var icc []byte
+	if preserveICC && img != nil {
+		if icc, err = readSourceICC(file); err != nil {
+			return result, err
+		}
+	}
+
+	for _, size := range sizes {
+		sized := *thumb
+		sized.Width, sized.Height = size.Width, size.Height
+		sized.ICC = icc
+		if size.Format != "" {
+			sized.Format = size.Format
+		}
+		if err := setCaption(&sized, file, size); err != nil {
+			return result, err
+		}
+
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+
+		outputFile, err := outputFileFor(file, size)
+		if err != nil {
+			return result, err
+		}
+		if err := makeOutputDir(filepath.Dir(outputFile)); err != nil {
+			return result, fmt.Errorf("error creating output directory for %s: %w", outputFile, err)
+		}
+
+		output := outputResult{Path: outputFile, Format: sized.Format}
+		// the placeholder is made from the first thumbnail, before encoding
+		var placeholder image.Image
+		resizeStart := time.Now()
+		if anim != nil && thumbnailer.AnimatedFormat(sized.Format) {
+			resized := sized.ResizeAnimation(anim)
+			output.ResizeTime = time.Since(resizeStart)
+			placeholder = resized.Frames[0]
+			err = saveThumbnail(ctx, &output, func(w io.Writer) error {
+				return sized.EncodeAnimation(w, resized)
+			})
+			output.Width, output.Height = resized.Size()
+		} else {
+			// rendering an SVG at the size takes the place of resizing it
+			src := img
+			if svg {
+				if src, err = decodeSource(ctx, &sized, file); err != nil {
+					return result, err
+				}
+			}
+			resized := sized.Resize(src)
+			output.ResizeTime = time.Since(resizeStart)
+			placeholder = resized
+			err = saveThumbnail(ctx, &output, func(w io.Writer) error {
+				if sized.TargetBytes == 0 {
+					return sized.EncodeWithMetadata(w, resized, exif)
+				}
+				quality, err := sized.EncodeTargetSize(w, resized, exif)
+				if err == nil {
+					logVerbose("Chose quality %d for %s to stay under %s", quality, outputFile, targetSize)
+				}
+				return err
+			})
+			output.Width, output.Height = resized.Bounds().Dx(), resized.Bounds().Dy()
+		}
+		output.EncodeTime = time.Since(resizeStart) - output.ResizeTime
+		if err != nil {
+			return result, fmt.Errorf("error saving image %s: %w", outputFile, err)
+		}
+		if sized.TargetBytes > 0 && output.Bytes > sized.TargetBytes {
+			log.Printf("Warning: %s is %d bytes even at the lowest quality, over the target size of %s", outputFile, output.Bytes, targetSize)
+		}
+		if err := preserveModTime(file, outputFile); err != nil {
+			return result, err
+		}
+		if len(result.Outputs) == 0 {
+			if result.BlurHash, err = blurHashOf(placeholder, file); err != nil {
+				return result, err
+			}
+			if err := writeBlurHashSidecar(ctx, outputFile, result.BlurHash); err != nil {
+				return result, err
+			}
+			if output.Preview, err = previewOf(&sized, placeholder, file); err != nil {
+				return result, err
+			}
+		}
+		result.Outputs = append(result.Outputs, output)
+	}
+
+	endTime := time.Now()
+	result.Duration = endTime.Sub(startTime)
+	if verbose {
+		var resize, encode time.Duration
+		for _, o := range result.Outputs {
+			resize += o.ResizeTime
+			encode += o.EncodeTime
+		}
+		logEvent(slog.LevelInfo, "finish", file, result.Duration, "Finished processing image %s in %v (decode %v, convert %v, resize %v, encode %v)",
+			file, result.Duration, result.DecodeTime, result.ConvertTime, resize, encode)
+	}
+
+	return result, nil
+}
+
+// mayOverwrite reports whether thumbnails may replace existing files: with
+// --overwrite, and when updating thumbnails with --incremental, --force or
+// --watch. Archives are written from scratch, and --data-uri writes no
+// thumbnail files.
+func mayOverwrite() bool {
+	return overwrite || incremental || force || watch || archive != nil || dataURI
+}
+
+// existingOutput returns the first output path of file that already exists
+// and may not be overwritten, or "" when there is none. A contact sheet writes
+// no files per image.
+func existingOutput(file string) (string, error) {
+	if mayOverwrite() || contactSheet {
+		return "", nil
+	}
+	sizes, err := sizesFor(file)
+	if err != nil {
+		return "", err
+	}
+	for _, size := range sizes {
+		outputFile, err := outputFileFor(file, size)
+		if err != nil {
+			return "", err
+		}
+		if _, err := os.Lstat(outputFile); err == nil {
+			return outputFile, nil
+		}
+	}
+	return "", nil
+}
+
+// skipExisting returns result marked as skipped because the thumbnail at
+// existing may not be overwritten.
+func skipExisting(result imageResult, existing string, startTime time.Time) imageResult {
+	logVerbose("Skipping %s, %s already exists", result.File, existing)
+	result.Skipped = true
+	result.Existing = true
+	result.Duration = time.Since(startTime)
+	return result
+}
+
+// tooSmall reports whether a w x h source is below --min-width or --min-height.
+func tooSmall(w, h int) bool {
+	return w < minWidth || h < minHeight
+}
+
+// fitExtremeAspect returns thumb in ModeFit, with a warning, when it would
+// fill the thumbnail box with a w x h source that is more than --max-aspect
+// times as long as it is wide, or the other way around. Filling would crop
+// away most of it, such as all but a slice of a panorama.
+func fitExtremeAspect(thumb *thumbnailer.Thumbnailer, file string, w, h int) *thumbnailer.Thumbnailer {
+	if thumb.Mode != thumbnailer.ModeFill || maxAspect == 0 || w <= 0 || h <= 0 {
+		return thumb
+	}
+	aspect := float64(max(w, h)) / float64(min(w, h))
+	if aspect <= maxAspect {
+		return thumb
+	}
+	log.Printf("Warning: fitting %s (%dx%d) instead of filling the box, its aspect ratio of %.1f:1 is beyond --max-aspect %v", file, w, h, aspect, maxAspect)
+	fitted := *thumb
+	fitted.Mode = thumbnailer.ModeFit
+	return &fitted
+}
+
+// skipSmall returns result marked as skipped for an image of w x h that is
+// too small to thumbnail.
+func skipSmall(result imageResult, w, h int, startTime time.Time) imageResult {
+	logVerbose("Skipping %s, its size of %dx%d is below the minimum of %dx%d", result.File, w, h, minWidth, minHeight)
+	result.Width, result.Height = w, h
+	result.Skipped = true
+	result.Duration = time.Since(startTime)
+	return result
+}
+
+// extensionSet normalizes a list of extensions, given with or without the
+// leading dot, into a lowercase lookup set.
+func extensionSet(exts []string) map[string]bool {
+	set := make(map[string]bool, len(exts))
+	for _, ext := range exts {
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if ext == "" {
+			continue
+		}
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		set[ext] = true
+	}
+	return set
+}
+
+// preserveModTime gives outputFile the modification time of the source file
+// with --preserve-mtime.
+func preserveModTime(file, outputFile string) error {
+	if !preserveTime || archive != nil {
+		return nil
+	}
+
+	_, modTime, err := statSource(file)
+	if err != nil {
+		return err
+	}
+	if err := os.Chtimes(outputFile, modTime, modTime); err != nil {
+		return fmt.Errorf("error setting modification time of %s: %v", outputFile, err)
+	}
+	return nil
+}
+
+// upToDate reports whether all thumbnails of file exist and are newer than it
+// and its crop sidecar, or as new with --preserve-mtime.
+func upToDate(file string) bool {
+	_, modTime, err := statSource(file)
+	if err != nil {
+		return false
+	}
+	// an edited crop box changes the thumbnails as well
+	if cropSidecar {
+		if sidecar, err := os.Stat(file + cropSidecarExt); err == nil && sidecar.ModTime().After(modTime) {
+			modTime = sidecar.ModTime()
+		}
+	}
+
+	sizes, err := sizesFor(file)
+	if err != nil {
+		return false
+	}
+	for _, size := range sizes {
+		outputFile, err := outputFileFor(file, size)
+		if err != nil {
+			return false
+		}
+		out, err := os.Stat(outputFile)
+		if err != nil || out.ModTime().Before(modTime) {
+			return false
+		}
+		if !preserveTime && out.ModTime().Equal(modTime) {
+			return false
+		}
+	}
+	return true
+}
+
+// sizeFormats returns the set of formats the sizes of an image are written
+// in, thumb's for those without their own.
+func sizeFormats(thumb *thumbnailer.Thumbnailer, sizes []thumbnailSize) map[string]bool {
+	set := make(map[string]bool)
+	for _, size := range sizes {
+		if size.Format != "" {
+			set[size.Format] = true
+		} else {
+			set[thumb.Format] = true
+		}
+	}
+	return set
+}
+
+// uniqueFormats returns formats without repeats, in the order given.
+func uniqueFormats(formats []string) []string {
+	var unique []string
+	seen := make(map[string]bool)
+	for _, format := range formats {
+		if !seen[format] {
+			seen[format] = true
+			unique = append(unique, format)
+		}
+	}
+	return unique
+}
+
+// hasFormat reports whether format is one of the --format values.
+func hasFormat(format string) bool {
+	for _, f := range formats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// squareSize returns size with a missing dimension set to the other one, for
+// --square.
+func squareSize(size thumbnailSize) thumbnailSize {
+	if size.Width == 0 {
+		size.Width = size.Height
+	}
+	if size.Height == 0 {
+		size.Height = size.Width
+	}
+	return size
+}
+
+// parseSize parses a WIDTHxHEIGHT size where either dimension may be left out
+// to leave it unconstrained, e.g. 300x200, 300x or x200.
+func parseSize(s string) (thumbnailSize, error) {
+	w, h, ok := strings.Cut(strings.ToLower(s), "x")
+	if !ok {
+		return thumbnailSize{}, fmt.Errorf("expected WIDTHxHEIGHT")
+	}
+
+	var size thumbnailSize
+	var err error
+	if w != "" {
+		if size.Width, err = strconv.Atoi(w); err != nil || size.Width < 0 {
+			return thumbnailSize{}, fmt.Errorf("invalid width %q", w)
+		}
+	}
+	if h != "" {
+		if size.Height, err = strconv.Atoi(h); err != nil || size.Height < 0 {
+			return thumbnailSize{}, fmt.Errorf("invalid height %q", h)
+		}
+	}
+	if size.Width == 0 && size.Height == 0 {
+		return thumbnailSize{}, fmt.Errorf("width or height must be set")
+	}
+
+	size.Suffix = "_" + w + "x" + h
+	return size, nil
+}
+
+// sinceLayouts are the timestamps accepted by parseSince, in local time
+// unless they give a zone.
+var sinceLayouts = []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02T15:04", "2006-01-02 15:04", "2006-01-02"}
+
+// parseSince parses --since, a duration before now with a d suffix for days
+// allowed, e.g. 24h or 7d, or a timestamp, e.g. 2024-05-01 or
+// 2024-05-01T08:00:00Z.
+func parseSince(s string, now time.Time) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		if n, err := strconv.ParseFloat(days, 64); err == nil && n >= 0 {
+			return now.Add(-time.Duration(n * 24 * float64(time.Hour))), nil
+		}
+	}
+	if d, err := time.ParseDuration(s); err == nil && d >= 0 {
+		return now.Add(-d), nil
+	}
+	for _, layout := range sinceLayouts {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("expected a duration such as 24h or 7d, or a time such as 2024-05-01 or 2024-05-01T08:00:00Z")
+}
+
+// byteUnits are the suffixes accepted by parseByteSize, longest first.
+var byteUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"gb", 1 << 30},
+	{"mb", 1 << 20},
+	{"kb", 1 << 10},
+	{"g", 1 << 30},
+	{"m", 1 << 20},
+	{"k", 1 << 10},
+	{"b", 1},
+}
+
+// parseByteSize parses a size in bytes with an optional KB, MB or GB suffix,
+// which are powers of 1024, e.g. 500000, 512KB or 50MB.
+func parseByteSize(s string) (int64, error) {
+	num, unit := strings.ToLower(strings.TrimSpace(s)), int64(1)
+	for _, u := range byteUnits {
+		if strings.HasSuffix(num, u.suffix) {
+			num, unit = strings.TrimSpace(strings.TrimSuffix(num, u.suffix)), u.size
+			break
+		}
+	}
+
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("expected a positive number of bytes with an optional KB, MB or GB suffix")
+	}
+	return int64(n * float64(unit)), nil
+}
+
+// tooLarge reports whether a source of size bytes exceeds --max-file-size,
+// logging a warning if so.
+func tooLarge(file string, size int64) bool {
+	if maxFileBytes <= 0 || size <= maxFileBytes {
+		return false
+	}
+	log.Printf("Warning: skipping %s, its size of %d bytes exceeds the maximum of %s", file, size, maxFileSize)
+	return true
+}
+
+// saveCounted is saveFileContext, also returning the number of bytes written
+// and their hex SHA-256.
+func saveCounted(ctx context.Context, file string, encode func(w io.Writer) error) (int64, string, error) {
+	var n int64
+	h := sha256.New()
+	err := saveFileContext(ctx, file, func(w io.Writer) error {
+		cw := &countingWriter{w: io.MultiWriter(w, h)}
+		err := encode(cw)
+		n = cw.n
+		return err
+	})
+	return n, hex.EncodeToString(h.Sum(nil)), err
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// saveFile writes the output of encode to file, or adds it to the output
+// archive. It writes to a temporary file in the same directory that is renamed
+// into place on success and removed on any error, so a file in the output
+// directory is always complete.
+func saveFile(file string, encode func(w io.Writer) error) error {
+	return saveFileContext(context.Background(), file, encode)
+}
+
+// saveFileContext is saveFile, writing nothing into place once ctx is done, so
+// an image given up on after --timeout doesn't leave thumbnails behind.
+func saveFileContext(ctx context.Context, file string, encode func(w io.Writer) error) error {
+	if archive != nil {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return archive.add(file, encode)
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(file), "."+filepath.Base(file)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := encode(f); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	// flush to disk before the rename, so a crash can't leave a renamed but empty file
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := ctx.Err(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
 }
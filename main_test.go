@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/peferb/thumbnailer/thumbnailer"
+	"image"
+	"image/png"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"file busy", &fs.PathError{Op: "open", Path: "a.jpg", Err: syscall.EBUSY}, true},
+		{"text file busy", &fs.PathError{Op: "open", Path: "a.jpg", Err: syscall.ETXTBSY}, true},
+		{"I/O error", fmt.Errorf("error reading a.jpg: %w", &fs.PathError{Op: "read", Path: "a.jpg", Err: syscall.EIO}), true},
+		{"temporary errno", &fs.PathError{Op: "read", Path: "a.jpg", Err: syscall.EAGAIN}, true},
+		{"missing file", &fs.PathError{Op: "open", Path: "a.jpg", Err: syscall.ENOENT}, false},
+		{"permission denied", &fs.PathError{Op: "open", Path: "a.jpg", Err: syscall.EACCES}, false},
+		{"is a directory", &fs.PathError{Op: "read", Path: "a.jpg", Err: syscall.EISDIR}, false},
+		{"timeout", fmt.Errorf("error processing a.jpg: %w", errTimeout), false},
+		{"too many pixels", fmt.Errorf("error decoding image file a.jpg: %w", thumbnailer.ErrTooManyPixels), false},
+		{"tool failed", fmt.Errorf("exiftool failed after 3 attempts, %w: %w", thumbnailer.ErrToolFailed, &exec.ExitError{}), false},
+		{"tool failed on a busy file", fmt.Errorf("%w: %w", thumbnailer.ErrToolFailed, syscall.EBUSY), false},
+		{"missing tool", &exec.Error{Name: "dcraw", Err: exec.ErrNotFound}, false},
+		{"tool exited", &exec.ExitError{}, false},
+		{"decode error", errors.New("image: unknown format"), false},
+		{"no error", nil, false},
+	}
+	for _, tt := range tests {
+		if got := isTransient(tt.err); got != tt.want {
+			t.Errorf("%s: isTransient(%v) = %v, want %v", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestProcessWithRetries(t *testing.T) {
+	in, out := t.TempDir(), t.TempDir()
+	source := filepath.Join(in, "a.png")
+	f, err := os.Create(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := png.Encode(f, image.NewNRGBA(image.Rect(0, 0, 40, 30))); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	defer func(saved []thumbnailSize) { sizes = saved }(sizes)
+	defer func(in, out, format, ext string, r int, flat bool, d time.Duration) {
+		inputPath, outputPath, outputFormat, outputExt, retries, flatten, timeout = in, out, format, ext, r, flat, d
+	}(inputPath, outputPath, outputFormat, outputExt, retries, flatten, timeout)
+	inputPath, outputPath, outputFormat, outputExt, retries, flatten = in, out, "png", "png", 2, true
+	sizes = []thumbnailSize{{Width: 20, Height: 20, Primary: true}}
+	thumb := &thumbnailer.Thumbnailer{Width: 20, Height: 20, Format: "png", Quality: 80}
+
+	tests := []struct {
+		name    string
+		file    string
+		timeout time.Duration
+		wantErr error
+		output  string
+	}{
+		// before the thumbnail exists, which would get the image skipped
+		{name: "timeout", file: source, timeout: time.Nanosecond, wantErr: errTimeout},
+		{name: "processed", file: source, output: filepath.Join(out, "a.png")},
+		{name: "missing file", file: filepath.Join(in, "missing.png"), wantErr: fs.ErrNotExist},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			timeout = tt.timeout
+			start := time.Now()
+			result := processWithRetries(thumb, tt.file)
+			if tt.wantErr != nil {
+				if !errors.Is(result.Err, tt.wantErr) {
+					t.Errorf("error %v, want %v", result.Err, tt.wantErr)
+				}
+				// failed sources keep their size for the report
+				if info, err := os.Stat(tt.file); err == nil && result.SourceBytes != info.Size() {
+					t.Errorf("source bytes %d, want %d", result.SourceBytes, info.Size())
+				}
+				// errors that aren't transient fail at once
+				if elapsed := time.Since(start); elapsed >= retryBackoff {
+					t.Errorf("failing took %v, retried", elapsed)
+				}
+				return
+			}
+			if result.Err != nil {
+				t.Fatalf("error %v", result.Err)
+			}
+			if _, err := os.Stat(tt.output); err != nil {
+				t.Errorf("no thumbnail: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"path/filepath"
+	"sort"
+)
+
+// manifestName is the file the --manifest is written to in the output
+// directory.
+const manifestName = "manifest.json"
+
+// manifestEntry maps one source to its thumbnails in the manifest.
+type manifestEntry struct {
+	Source   string           `json:"source"`
+	BlurHash string           `json:"blurhash,omitempty"`
+	Outputs  []manifestOutput `json:"outputs"`
+}
+
+// manifestOutput is one thumbnail in the manifest. Path is relative to the
+// output directory, with forward slashes. Preview is only set on the first
+// thumbnail of a source.
+type manifestOutput struct {
+	Path    string `json:"path"`
+	Width   int    `json:"width"`
+	Height  int    `json:"height"`
+	Format  string `json:"format"`
+	SHA256  string `json:"sha256"`
+	Preview string `json:"preview,omitempty"`
+}
+
+// manifestFor returns the manifest entry of r, and false for sources without
+// thumbnails. Images skipped as up to date, or because their thumbnails
+// exist, list the thumbnails already on disk.
+func manifestFor(r imageResult) (manifestEntry, bool) {
+	entry := manifestEntry{Source: r.File}
+	switch {
+	case r.Err != nil:
+		return entry, false
+	case r.Skipped && (r.Existing || r.Width == 0):
+		entry.Outputs = existingManifestOutputs(r.File)
+		if len(entry.Outputs) > 0 {
+			first := filepath.Join(outputPath, filepath.FromSlash(entry.Outputs[0].Path))
+			if blurHash {
+				entry.BlurHash = existingBlurHash(first)
+			}
+			entry.Outputs[0].Preview = existingPreview(first, entry.Outputs[0].Format)
+		}
+	default:
+		entry.BlurHash = r.BlurHash
+		for _, o := range r.Outputs {
+			entry.Outputs = append(entry.Outputs, manifestOutput{
+				Path:    manifestPath(o.Path),
+				Width:   o.Width,
+				Height:  o.Height,
+				Format:  o.Format,
+				SHA256:  o.SHA256,
+				Preview: o.Preview,
+			})
+		}
+	}
+	return entry, len(entry.Outputs) > 0
+}
+
+// existingManifestOutputs describes the thumbnails of file that are on disk,
+// reading their dimensions from the headers.
+func existingManifestOutputs(file string) []manifestOutput {
+	sizes, err := sizesFor(file)
+	if err != nil {
+		return nil
+	}
+	var outputs []manifestOutput
+	for _, size := range sizes {
+		outputFile, err := outputFileFor(file, size)
+		if err != nil {
+			continue
+		}
+		hash, err := hashFile(outputFile)
+		if err != nil {
+			continue
+		}
+		format := size.Format
+		if format == "" {
+			format, _ = fileFormat(file)
+		}
+		output := manifestOutput{Path: manifestPath(outputFile), Format: format, SHA256: hash}
+		if config, err := decodeConfig(outputFile); err == nil {
+			output.Width, output.Height = config.Width, config.Height
+		}
+		outputs = append(outputs, output)
+	}
+	return outputs
+}
+
+// manifestPath returns file relative to the output directory.
+func manifestPath(file string) string {
+	if rel, err := filepath.Rel(outputPath, file); err == nil {
+		file = rel
+	}
+	return filepath.ToSlash(file)
+}
+
+// writeManifest writes the manifest of results to the output directory,
+// sorted by source so it only changes when the thumbnails do.
+func writeManifest(entries []manifestEntry) error {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Source < entries[j].Source
+	})
+	if entries == nil {
+		entries = []manifestEntry{}
+	}
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	file := filepath.Join(outputPath, manifestName)
+	if err := saveFile(file, func(w io.Writer) error {
+		_, err := w.Write(append(data, '\n'))
+		return err
+	}); err != nil {
+		return err
+	}
+	log.Printf("Manifest saved to %s", file)
+	return nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/peferb/thumbnailer/thumbnailer"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// outputTemplate is the parsed --output-template, nil for the default naming.
+var outputTemplate *template.Template
+
+// captionTemplate is the parsed --caption, nil without a caption.
+var captionTemplate *template.Template
+
+// templateData holds the variables available in --output-template.
+type templateData struct {
+	// Name is the source file name without extension.
+	Name string
+	// Ext is the source file extension without the dot.
+	Ext string
+	// Width and Height are the requested thumbnail size, 0 when unconstrained.
+	Width  int
+	Height int
+	// Format is the output format.
+	Format string
+
+	file string
+}
+
+// Hash returns the first 16 hex digits of the SHA-256 of the source file. It's
+// a method so the file is only read when the template uses it.
+func (d templateData) Hash() (string, error) {
+	hash, err := hashFile(d.file)
+	if err != nil {
+		return "", err
+	}
+	return hash[:16], nil
+}
+
+// CaptureTime returns when the source photo was taken, see captureDate,
+// formatted with --time-format. It's a method so the file is only read when
+// the template uses it.
+func (d templateData) CaptureTime() string {
+	return captureDate(d.file).Format(timeFormat)
+}
+
+// outputFileFor returns the thumbnail path of a source file for size. The file
+// name comes from outputTemplate, or is the source name with the size suffix
+// and outputExt, or the format of size or its directory config, as extension.
+// With byDate it goes into a folder for the day the photo was taken. An
+// output file given with singleOutput is used as is.
+// Otherwise, unless flatten is set, the source's location relative to the
+// input path it was found under is recreated under outputPath.
+func outputFileFor(file string, size thumbnailSize) (string, error) {
+	if singleOutput {
+		return outputPath, nil
+	}
+	base := filepath.Base(file)
+	name := strings.TrimSuffix(base, filepath.Ext(base))
+	format, ext := fileFormat(file)
+	if size.Format != "" {
+		format, ext = size.Format, thumbnailer.Extension(size.Format)
+	}
+
+	if outputTemplate != nil {
+		var buf bytes.Buffer
+		err := outputTemplate.Execute(&buf, templateData{
+			Name:   name,
+			Ext:    strings.TrimPrefix(filepath.Ext(base), "."),
+			Width:  size.Width,
+			Height: size.Height,
+			Format: format,
+			file:   file,
+		})
+		if err != nil {
+			return "", fmt.Errorf("error executing output template for %s: %v", file, err)
+		}
+		name = buf.String()
+	} else {
+		name += size.Suffix + "." + ext
+	}
+
+	if byDate {
+		return filepath.Join(outputPath, dateDir(file), name), nil
+	}
+	if flatten {
+		return filepath.Join(outputPath, name), nil
+	}
+
+	root, ok := fileRoot(file)
+	if !ok {
+		root = inputPath
+	}
+	rel, err := filepath.Rel(root, filepath.Dir(file))
+	if err != nil {
+		return "", fmt.Errorf("error computing relative path for %s: %v", file, err)
+	}
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		// the input path is the file itself, so there is no subtree to mirror
+		rel = "."
+	}
+
+	return filepath.Join(outputPath, rel, name), nil
+}
+
+// setCaption gives sized, the thumbnailer of file at size, its own caption
+// with the text of captionTemplate. It does nothing without a caption.
+func setCaption(sized *thumbnailer.Thumbnailer, file string, size thumbnailSize) error {
+	if captionTemplate == nil || sized.Caption == nil {
+		return nil
+	}
+	base := filepath.Base(file)
+
+	var buf bytes.Buffer
+	err := captionTemplate.Execute(&buf, templateData{
+		Name:   strings.TrimSuffix(base, filepath.Ext(base)),
+		Ext:    strings.TrimPrefix(filepath.Ext(base), "."),
+		Width:  size.Width,
+		Height: size.Height,
+		Format: sized.Format,
+		file:   file,
+	})
+	if err != nil {
+		return fmt.Errorf("error executing caption template for %s: %v", file, err)
+	}
+
+	caption := *sized.Caption
+	caption.Text = buf.String()
+	sized.Caption = &caption
+	return nil
+}
+
+// dateDir returns the YYYY/MM/DD folder for file, see captureDate.
+func dateDir(file string) string {
+	date := captureDate(file)
+	return filepath.Join(date.Format("2006"), date.Format("01"), date.Format("02"))
+}
+
+// captureDate returns when the photo in file was taken, from the EXIF capture
+// date or, without one, the modification time.
+func captureDate(file string) time.Time {
+	date, ok := thumbnailer.ReadCaptureTime(file)
+	if !ok {
+		if _, modTime, err := statSource(file); err == nil {
+			date = modTime
+		}
+	}
+	return date
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// progressInterval is how often the progress line is redrawn.
+const progressInterval = 200 * time.Millisecond
+
+// stderr is where logging goes. It keeps the progress line at the bottom of the
+// terminal by redrawing it after every log line.
+var stderr = &statusLine{w: os.Stderr}
+
+// statusLine is a writer that keeps a status line below everything written
+// through it.
+type statusLine struct {
+	mu   sync.Mutex
+	w    io.Writer
+	line string
+}
+
+func (s *statusLine) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.line != "" {
+		io.WriteString(s.w, "\r\033[K")
+	}
+	n, err := s.w.Write(p)
+	if s.line != "" {
+		io.WriteString(s.w, s.line)
+	}
+	return n, err
+}
+
+// Set replaces the status line, an empty line removes it.
+func (s *statusLine) Set(line string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	io.WriteString(s.w, "\r\033[K"+line)
+	s.line = line
+}
+
+// isTerminal reports whether f is a character device such as a terminal.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// startProgress shows "done/total (percent)" on stderr until the returned
+// function is called. total may still grow while files are found.
+func startProgress(done, found *atomic.Int64) func() {
+	render := func() {
+		n, total := done.Load(), found.Load()
+		percent := 100.0
+		if total > 0 {
+			percent = float64(n) * 100 / float64(total)
+		}
+		stderr.Set(fmt.Sprintf("%d/%d (%.1f%%)", n, total, percent))
+	}
+
+	ticker := time.NewTicker(progressInterval)
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		render()
+		for {
+			select {
+			case <-ticker.C:
+				render()
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		ticker.Stop()
+		close(stop)
+		wg.Wait()
+		stderr.Set("")
+	}
+}
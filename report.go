@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// jsonReport is the summary report written with --report-format json.
+type jsonReport struct {
+	Total           int              `json:"total"`
+	Success         int              `json:"success"`
+	Thumbnails      int              `json:"thumbnails"`
+	Errors          int              `json:"errors"`
+	Skipped         int              `json:"skipped"`
+	Duplicates      int              `json:"duplicates"`
+	TooLarge        int              `json:"too_large"`
+	NotOverwritten  int              `json:"not_overwritten"`
+	TotalDurationMs int64            `json:"total_duration_ms"`
+	InputBytes      int64            `json:"total_input_bytes"`
+	OutputBytes     int64            `json:"total_output_bytes"`
+	ReductionPct    float64          `json:"reduction_percent"`
+	LatencyMs       *latencySummary  `json:"latency_ms,omitempty"`
+	Files           []jsonReportFile `json:"files"`
+}
+
+// jsonReportFile is one entry of the JSON report. A source with several
+// sizes has one entry per output.
+type jsonReportFile struct {
+	Filename     string  `json:"filename"`
+	OutputPath   string  `json:"output_path,omitempty"`
+	DurationMs   int64   `json:"duration_ms"`
+	Status       string  `json:"status"`
+	Error        string  `json:"error,omitempty"`
+	DuplicateOf  string  `json:"duplicate_of,omitempty"`
+	BlurHash     string  `json:"blurhash,omitempty"`
+	SourceWidth  int     `json:"source_width,omitempty"`
+	SourceHeight int     `json:"source_height,omitempty"`
+	OutputWidth  int     `json:"output_width,omitempty"`
+	OutputHeight int     `json:"output_height,omitempty"`
+	SourceBytes  int64   `json:"source_bytes,omitempty"`
+	OutputBytes  int64   `json:"output_bytes,omitempty"`
+	DecodeMs     float64 `json:"decode_ms,omitempty"`
+	ConvertMs    float64 `json:"convert_ms,omitempty"`
+	ResizeMs     float64 `json:"resize_ms,omitempty"`
+	EncodeMs     float64 `json:"encode_ms,omitempty"`
+}
+
+// summaryReport collects the summary report as results are added. Entries
+// are formatted right away, into memory or with --stream into a temporary
+// file, and processing times are aggregated, so only failed results have to
+// be kept until the report is written. Entries are written in the order they
+// are added: run sorts the results first, but with --stream they're added as
+// images finish, so they stay in completion order. The failed files are
+// sorted either way.
+type summaryReport struct {
+	buf         bytes.Buffer
+	spool       *os.File
+	entries     int
+	inputBytes  int64
+	outputBytes int64
+	latency     latencyStats
+	existing    int
+	thumbnails  int
+	failed      []imageResult
+	err         error
+}
+
+func newSummaryReport(streaming bool) (*summaryReport, error) {
+	report := &summaryReport{}
+	if streaming {
+		f, err := os.CreateTemp("", "thumbnailer-report-*")
+		if err != nil {
+			return nil, err
+		}
+		report.spool = f
+	}
+	return report, nil
+}
+
+// add adds the entries of r to the report and its totals to the summary.
+func (s *summaryReport) add(r imageResult) {
+	// failed images have no meaningful processing time
+	if !r.Skipped && r.Err == nil {
+		s.latency.add(r.Duration)
+	}
+	if r.Existing {
+		s.existing++
+	}
+	if r.Err != nil {
+		s.failed = append(s.failed, imageResult{File: r.File, Err: r.Err})
+	} else {
+		if len(r.Outputs) > 0 {
+			s.inputBytes += r.SourceBytes
+		}
+		for _, o := range r.Outputs {
+			s.outputBytes += o.Bytes
+		}
+		s.thumbnails += len(r.Outputs)
+	}
+
+	var w io.Writer = &s.buf
+	if s.spool != nil {
+		w = s.spool
+	}
+	if s.err == nil {
+		s.err = s.writeEntries(w, r)
+	}
+}
+
+// csvHeader is the header row of the CSV report.
+var csvHeader = []string{"file", "output", "width", "height", "bytes_in", "bytes_out", "duration_ms", "status"}
+
+// writeEntries writes the entries of r to w: the text report line, or the
+// JSON report entries or CSV rows, one per output.
+func (s *summaryReport) writeEntries(w io.Writer, r imageResult) error {
+	switch reportFormat {
+	case "json":
+	case "csv":
+		return writeCSVRows(w, r)
+	default:
+		line := fmt.Sprintf("%s: %s, processing time: %v", r.File, r.Status(), r.Duration)
+		if r.DuplicateOf != "" {
+			line += fmt.Sprintf(", duplicate of %s", r.DuplicateOf)
+		}
+		if r.Existing {
+			line += ", thumbnail already exists"
+		}
+		_, err := io.WriteString(w, line+"\n")
+		return err
+	}
+
+	entry := jsonReportFile{
+		Filename:     r.File,
+		DurationMs:   r.Duration.Milliseconds(),
+		Status:       r.Status(),
+		DuplicateOf:  r.DuplicateOf,
+		BlurHash:     r.BlurHash,
+		SourceWidth:  r.Width,
+		SourceHeight: r.Height,
+		SourceBytes:  r.SourceBytes,
+		DecodeMs:     milliseconds(r.DecodeTime),
+		ConvertMs:    milliseconds(r.ConvertTime),
+	}
+	if r.Err != nil {
+		entry.Error = r.Err.Error()
+	}
+	outputs := r.Outputs
+	if len(outputs) == 0 {
+		outputs = []outputResult{{}}
+	}
+	for _, o := range outputs {
+		entry.OutputPath = o.Path
+		entry.OutputWidth = o.Width
+		entry.OutputHeight = o.Height
+		entry.OutputBytes = o.Bytes
+		entry.ResizeMs = milliseconds(o.ResizeTime)
+		entry.EncodeMs = milliseconds(o.EncodeTime)
+
+		// entries are indented to sit in the "files" array of the report
+		data, err := json.MarshalIndent(entry, "    ", "  ")
+		if err != nil {
+			return err
+		}
+		sep := ",\n    "
+		if s.entries == 0 {
+			sep = "\n    "
+		}
+		if _, err := io.WriteString(w, sep); err != nil {
+			return err
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+		s.entries++
+	}
+	return nil
+}
+
+// writeCSVRows writes the CSV report rows of r to w, one per output. encoding/csv
+// quotes paths containing commas or quotes.
+func writeCSVRows(w io.Writer, r imageResult) error {
+	outputs := r.Outputs
+	if len(outputs) == 0 {
+		outputs = []outputResult{{}}
+	}
+
+	cw := csv.NewWriter(w)
+	for _, o := range outputs {
+		row := []string{r.File, o.Path, "", "", strconv.FormatInt(r.SourceBytes, 10), "",
+			strconv.FormatInt(r.Duration.Milliseconds(), 10), r.Status()}
+		if o.Path != "" {
+			row[2], row[3] = strconv.Itoa(o.Width), strconv.Itoa(o.Height)
+			row[5] = strconv.FormatInt(o.Bytes, 10)
+		}
+		cw.Write(row)
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// write saves the report with the given counts to the output directory, and
+// the failed files to failures.txt.
+func (s *summaryReport) write(total, success, errors, skipped, duplicates, tooLarge int, duration time.Duration) {
+	if s.err != nil {
+		fatalf("Error writing summary report: %v", s.err)
+	}
+
+	sort.Slice(s.failed, func(i, j int) bool {
+		return s.failed[i].File < s.failed[j].File
+	})
+
+	var reduction float64
+	if s.inputBytes > 0 {
+		reduction = 100 * (1 - float64(s.outputBytes)/float64(s.inputBytes))
+	}
+
+	var header, footer []byte
+	var name string
+
+	switch reportFormat {
+	case "csv":
+		// only the rows, the totals can be summed in the spreadsheet
+		name = "summary_report.csv"
+		var buf bytes.Buffer
+		cw := csv.NewWriter(&buf)
+		cw.Write(csvHeader)
+		cw.Flush()
+		header = buf.Bytes()
+	case "json":
+		name = "summary_report.json"
+		report := jsonReport{
+			Total:           total,
+			Success:         success,
+			Thumbnails:      s.thumbnails,
+			Errors:          errors,
+			Skipped:         skipped,
+			Duplicates:      duplicates,
+			TooLarge:        tooLarge,
+			NotOverwritten:  s.existing,
+			TotalDurationMs: duration.Milliseconds(),
+			InputBytes:      s.inputBytes,
+			OutputBytes:     s.outputBytes,
+			ReductionPct:    math.Round(reduction*10) / 10,
+			Files:           []jsonReportFile{},
+		}
+		if s.latency.count > 0 {
+			latency := s.latency.summary()
+			report.LatencyMs = &latency
+		}
+
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			fatalf("Error encoding summary report: %v", err)
+		}
+		// the entries go into the empty files array
+		header = bytes.TrimSuffix(data, []byte("]\n}"))
+		footer = []byte("]\n}")
+		if s.entries > 0 {
+			footer = []byte("\n  ]\n}")
+		}
+	default:
+		name = "summary_report.txt"
+		header = []byte(fmt.Sprintf("Summary Report:\n"+
+			"Total images processed: %d\n"+
+			"Successfully processed: %d\n"+
+			"Thumbnails written: %d\n"+
+			"Errors encountered: %d\n"+
+			"Skipped: %d\n"+
+			"Duplicates: %d\n"+
+			"Too large: %d\n"+
+			"Not overwritten: %d\n"+
+			"Total time taken: %v\n"+
+			"Total input bytes: %d\n"+
+			"Total output bytes: %d\n"+
+			"Reduction: %.1f%%\n",
+			total, success, s.thumbnails, errors, skipped, duplicates, tooLarge, s.existing, duration, s.inputBytes, s.outputBytes, reduction))
+		if s.latency.count > 0 {
+			header = append(header, fmt.Sprintf("Processing time per image: %v\n", &s.latency)...)
+		}
+
+		var failures bytes.Buffer
+		if len(s.failed) > 0 {
+			failures.WriteString("\nFailed files:\n")
+			for _, r := range s.failed {
+				fmt.Fprintf(&failures, "%s: %v\n", r.File, r.Err)
+			}
+		}
+		footer = failures.Bytes()
+	}
+
+	var entries io.Reader = &s.buf
+	if s.spool != nil {
+		if _, err := s.spool.Seek(0, io.SeekStart); err != nil {
+			fatalf("Error writing summary report: %v", err)
+		}
+		entries = s.spool
+	}
+
+	reportFile := filepath.Join(outputPath, name)
+	if err := saveFile(reportFile, func(w io.Writer) error {
+		if _, err := w.Write(header); err != nil {
+			return err
+		}
+		if _, err := io.Copy(w, entries); err != nil {
+			return err
+		}
+		_, err := w.Write(footer)
+		return err
+	}); err != nil {
+		fatalf("Error writing summary report: %v", err)
+	}
+
+	log.Printf("Summary report saved to %s", reportFile)
+
+	writeFailures(s.failed)
+}
+
+// close removes the temporary file of a streamed report.
+func (s *summaryReport) close() {
+	if s.spool != nil {
+		s.spool.Close()
+		os.Remove(s.spool.Name())
+	}
+}
+
+// writeFailures writes the paths of the failed images to failures.txt in the
+// output directory, one per line, so they can be re-run with --input-list.
+// Images found in a directory are followed by a tab and the directory given
+// as input, so the re-run writes their thumbnails to the same place; entries
+// of a tar archive can only be re-run with the whole archive, which is listed
+// instead. A failures.txt left by an earlier run is removed when nothing
+// failed.
+func writeFailures(failed []imageResult) {
+	failuresFile := filepath.Join(outputPath, "failures.txt")
+	if len(failed) == 0 {
+		if archive != nil {
+			// archives are written from scratch, there's nothing to clean up
+			return
+		}
+		if err := os.Remove(failuresFile); err != nil && !os.IsNotExist(err) {
+			log.Printf("Error removing %s: %v", failuresFile, err)
+		}
+		return
+	}
+
+	if err := saveFile(failuresFile, func(w io.Writer) error {
+		archives := make(map[string]bool)
+		for _, r := range failed {
+			line := r.File
+			if root, ok := fileRoot(r.File); ok && isTarInput(root) {
+				if archives[root] {
+					continue
+				}
+				archives[root] = true
+				line = root
+			} else if ok && root != r.File {
+				line += "\t" + root
+			}
+			if _, err := fmt.Fprintln(w, line); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		fatalf("Error writing list of failed files: %v", err)
+	}
+
+	log.Printf("%d images failed, see %s", len(failed), failuresFile)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/peferb/thumbnailer/thumbnailer"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// s3Uploader uploads written thumbnails to an S3 bucket, keyed by their path
+// relative to outputPath below prefix.
+type s3Uploader struct {
+	client *s3.Client
+	bucket string
+	prefix string
+}
+
+// newS3Uploader creates an uploader using the standard AWS credential chain:
+// environment, shared config and credentials files, and instance roles.
+func newS3Uploader(ctx context.Context, bucket, prefix string) (*s3Uploader, error) {
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Uploader{client: s3.NewFromConfig(cfg), bucket: bucket, prefix: prefix}, nil
+}
+
+// wrap returns process extended to upload the thumbnails of each successfully
+// processed image. Uploads run on the worker, so they are bounded by the same
+// semaphore as processing. They stop when ctx is done, and take at most
+// --timeout per image.
+func (u *s3Uploader) wrap(ctx context.Context, process func(*thumbnailer.Thumbnailer, string) imageResult) func(*thumbnailer.Thumbnailer, string) imageResult {
+	return func(thumb *thumbnailer.Thumbnailer, file string) imageResult {
+		result := process(thumb, file)
+		if result.Err != nil {
+			return result
+		}
+
+		ctx := ctx
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		for _, output := range result.Outputs {
+			if err := u.upload(ctx, output.Path, thumbnailer.ContentType(output.Format)); err != nil {
+				log.Printf("Warning: %v", err)
+				result.Err = err
+				return result
+			}
+			logVerbose("Uploaded %s to s3://%s", output.Path, u.bucket)
+		}
+		return result
+	}
+}
+
+// upload uploads file with contentType, giving up when ctx is done.
+func (u *s3Uploader) upload(ctx context.Context, file, contentType string) error {
+	rel, err := filepath.Rel(outputPath, file)
+	if err != nil {
+		return err
+	}
+	key := path.Join(u.prefix, filepath.ToSlash(rel))
+
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := u.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(u.bucket),
+		Key:         aws.String(key),
+		Body:        f,
+		ContentType: aws.String(contentType),
+	}); err != nil {
+		return fmt.Errorf("error uploading %s to s3://%s/%s: %v", file, u.bucket, key, err)
+	}
+	return nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/peferb/thumbnailer/thumbnailer"
+	"github.com/spf13/cobra"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"runtime"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// shutdownTimeout is how long serve waits for in-flight requests on SIGINT or
+// SIGTERM.
+const shutdownTimeout = 30 * time.Second
+
+// maxServeDimension is the largest width and height a request may ask for.
+const maxServeDimension = 10_000
+
+// serveOptions holds the flags of the serve subcommand, which are separate
+// from those of the root command of the same names.
+type serveOptions struct {
+	addr        string
+	compression int
+	format      string
+	filter      string
+	maxFileSize string
+	maxPixels   int64
+	parallelism int
+	verbose     bool
+}
+
+// newServeCommand returns the serve subcommand, which thumbnails images posted
+// to /thumbnail instead of files on disk.
+func newServeCommand() *cobra.Command {
+	var opts serveOptions
+	cmd := &cobra.Command{
+		Use:   "serve",
+		Short: "Serve thumbnails of images posted to /thumbnail over HTTP",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			runServe(opts)
+		},
+	}
+
+	cmd.Flags().StringVar(&opts.addr, "addr", ":8080", "Address to listen on")
+	cmd.Flags().IntVarP(&opts.compression, "compression", "c", 75, "Compression level (1-100) of JPEG, WebP and AVIF output")
+	cmd.Flags().StringVarP(&opts.format, "format", "f", "jpeg", "Output image format when the request has no format parameter")
+	cmd.Flags().StringVar(&opts.filter, "filter", "lanczos", "Resample filter (lanczos, catmullrom, mitchell, linear, box, nearest)")
+	cmd.Flags().StringVar(&opts.maxFileSize, "max-file-size", "", "Reject request bodies larger than this, e.g. 50MB (default: no limit)")
+	cmd.Flags().Int64Var(&opts.maxPixels, "max-pixels", 100_000_000, "Reject images with more pixels (width x height) than this before decoding them, 0 for no limit")
+	cmd.Flags().IntVarP(&opts.parallelism, "parallelism", "p", runtime.NumCPU(), "Number of requests processed at the same time, others wait")
+	cmd.Flags().BoolVarP(&opts.verbose, "verbose", "v", false, "Log every processed request")
+	return cmd
+}
+
+func runServe(opts serveOptions) {
+	if opts.compression < 1 || opts.compression > 100 {
+		fatalf("Compression must be between 1 (smallest files) and 100 (best quality), got %d", opts.compression)
+	}
+	if !thumbnailer.SupportedFormat(opts.format) {
+		fatalf("Unsupported output format: %s", opts.format)
+	}
+	if !thumbnailer.SupportedFilter(opts.filter) {
+		fatalf("Unsupported resample filter: %s", opts.filter)
+	}
+	if opts.maxPixels < 0 {
+		fatal("Max pixels must not be negative")
+	}
+	if opts.parallelism < 1 {
+		fatalf("Parallelism must be at least 1, got %d", opts.parallelism)
+	}
+	var maxBytes int64
+	if opts.maxFileSize != "" {
+		var err error
+		if maxBytes, err = parseByteSize(opts.maxFileSize); err != nil {
+			fatalf("Invalid max file size %q: %v", opts.maxFileSize, err)
+		}
+	}
+
+	thumb := thumbnailer.Thumbnailer{
+		Format:     opts.format,
+		Quality:    opts.compression,
+		Mode:       thumbnailer.ModeFit,
+		NoUpscale:  true,
+		Filter:     opts.filter,
+		AutoOrient: true,
+		Metadata:   thumbnailer.MetadataStrip,
+		MaxPixels:  opts.maxPixels,
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/thumbnail", thumbnailHandler(thumb, opts.parallelism, maxBytes, opts.verbose))
+	server := &http.Server{Addr: opts.addr, Handler: mux}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		log.Println("Shutting down, waiting for in-flight requests")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	log.Printf("Listening on %s", opts.addr)
+	if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		fatalf("Error serving: %v", err)
+	}
+}
+
+// thumbnailHandler thumbnails the image in the body of POST requests with a
+// copy of base, sized by the width and height query parameters and encoded in
+// the format parameter or base.Format. At most limit requests are processed at
+// the same time; the others wait for a slot or until the client goes away.
+// With verbose every processed request is logged.
+func thumbnailHandler(base thumbnailer.Thumbnailer, limit int, maxBytes int64, verbose bool) http.Handler {
+	sem := make(chan struct{}, limit)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed, POST the image", http.StatusMethodNotAllowed)
+			return
+		}
+
+		thumb := base
+		if err := thumbnailQuery(&thumb, r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		select {
+		case sem <- struct{}{}:
+			defer func() { <-sem }()
+		case <-r.Context().Done():
+			return
+		}
+
+		body := r.Body
+		if maxBytes > 0 {
+			body = http.MaxBytesReader(w, body, maxBytes)
+		}
+		data, err := io.ReadAll(body)
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				http.Error(w, fmt.Sprintf("image larger than %d bytes", maxBytes), http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, fmt.Sprintf("error reading image: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		// encode into a buffer first, so a failure can still be reported with a
+		// status code
+		startTime := time.Now()
+		var buf bytes.Buffer
+		if err := thumb.Process(bytes.NewReader(data), &buf); err != nil {
+			log.Printf("Error processing posted image: %v", err)
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		if verbose {
+			log.Printf("Processed posted image into a %dx%d %s thumbnail in %v", thumb.Width, thumb.Height, thumb.Format, time.Since(startTime))
+		}
+
+		w.Header().Set("Content-Type", thumbnailer.ContentType(thumb.Format))
+		w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+		w.Write(buf.Bytes())
+	})
+}
+
+// thumbnailQuery sets the size and format of thumb from the query parameters
+// of r. Sizes are limited to maxServeDimension, and thumbnails are never
+// larger than the posted image, so a request can't make the server allocate
+// more than the image itself takes.
+func thumbnailQuery(thumb *thumbnailer.Thumbnailer, r *http.Request) error {
+	query := r.URL.Query()
+	for _, p := range []struct {
+		name string
+		dst  *int
+	}{{"width", &thumb.Width}, {"height", &thumb.Height}} {
+		v := query.Get(p.name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid %s %q, must be a positive number", p.name, v)
+		}
+		if n > maxServeDimension {
+			return fmt.Errorf("invalid %s %d, must be at most %d", p.name, n, maxServeDimension)
+		}
+		*p.dst = n
+	}
+	if thumb.Width == 0 && thumb.Height == 0 {
+		return fmt.Errorf("width or height must be given")
+	}
+
+	if format := query.Get("format"); format != "" {
+		if !thumbnailer.SupportedFormat(format) {
+			return fmt.Errorf("unsupported format %q", format)
+		}
+		thumb.Format = format
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"github.com/peferb/thumbnailer/thumbnailer"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestThumbnailHandler(t *testing.T) {
+	var source bytes.Buffer
+	if err := png.Encode(&source, image.NewNRGBA(image.Rect(0, 0, 80, 60))); err != nil {
+		t.Fatal(err)
+	}
+	base := thumbnailer.Thumbnailer{
+		Format:    "jpeg",
+		Quality:   75,
+		Mode:      thumbnailer.ModeFit,
+		NoUpscale: true,
+		Filter:    "lanczos",
+	}
+	handler := thumbnailHandler(base, 2, 1<<20, false)
+
+	tests := []struct {
+		name        string
+		method      string
+		query       string
+		body        []byte
+		status      int
+		contentType string
+		width       int
+		height      int
+	}{
+		{name: "width", method: "POST", query: "width=40", body: source.Bytes(), status: http.StatusOK, contentType: "image/jpeg", width: 40, height: 30},
+		{name: "format", method: "POST", query: "height=15&format=png", body: source.Bytes(), status: http.StatusOK, contentType: "image/png", width: 20, height: 15},
+		{name: "no upscaling", method: "POST", query: "width=500", body: source.Bytes(), status: http.StatusOK, contentType: "image/jpeg", width: 80, height: 60},
+		{name: "GET", method: "GET", query: "width=40", status: http.StatusMethodNotAllowed},
+		{name: "no size", method: "POST", body: source.Bytes(), status: http.StatusBadRequest},
+		{name: "invalid width", method: "POST", query: "width=-3", body: source.Bytes(), status: http.StatusBadRequest},
+		{name: "huge width", method: "POST", query: "width=20000", body: source.Bytes(), status: http.StatusBadRequest},
+		{name: "unsupported format", method: "POST", query: "width=40&format=xcf", body: source.Bytes(), status: http.StatusBadRequest},
+		{name: "too large", method: "POST", query: "width=40", body: make([]byte, 1<<20+1), status: http.StatusRequestEntityTooLarge},
+		{name: "not an image", method: "POST", query: "width=40", body: []byte("not an image"), status: http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/thumbnail?"+tt.query, bytes.NewReader(tt.body))
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			if got := w.Header().Get("Content-Type"); got != tt.contentType {
+				t.Errorf("content type %s, want %s", got, tt.contentType)
+			}
+			config, _, err := image.DecodeConfig(w.Body)
+			if err != nil {
+				t.Fatalf("decoding the thumbnail: %v", err)
+			}
+			if config.Width != tt.width || config.Height != tt.height {
+				t.Errorf("thumbnail is %dx%d, want %dx%d", config.Width, config.Height, tt.width, tt.height)
+			}
+		})
+	}
+}
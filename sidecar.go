@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"os"
+)
+
+// cropSidecarExt is appended to the name of an image to get the name of its
+// crop sidecar, e.g. photo.jpg.crop.json.
+const cropSidecarExt = ".crop.json"
+
+// cropBox is the content of a crop sidecar, in pixels of the auto-oriented
+// source.
+type cropBox struct {
+	X *int `json:"x"`
+	Y *int `json:"y"`
+	W *int `json:"w"`
+	H *int `json:"h"`
+}
+
+// readCropSidecar reads the crop sidecar of file. ok is false when there is
+// none.
+func readCropSidecar(file string) (r image.Rectangle, ok bool, err error) {
+	if _, ok := lookupTarEntry(file); ok {
+		// sidecars aren't read from inside archives
+		return image.Rectangle{}, false, nil
+	}
+	sidecar := file + cropSidecarExt
+	data, err := os.ReadFile(sidecar)
+	if errors.Is(err, os.ErrNotExist) {
+		return image.Rectangle{}, false, nil
+	}
+	if err != nil {
+		return image.Rectangle{}, false, fmt.Errorf("error reading crop sidecar %s: %w", sidecar, err)
+	}
+
+	var box cropBox
+	if err := json.Unmarshal(data, &box); err != nil {
+		return image.Rectangle{}, false, fmt.Errorf("error parsing crop sidecar %s: %v", sidecar, err)
+	}
+	if box.X == nil || box.Y == nil || box.W == nil || box.H == nil {
+		return image.Rectangle{}, false, fmt.Errorf("crop sidecar %s needs x, y, w and h", sidecar)
+	}
+	return image.Rect(*box.X, *box.Y, *box.X+*box.W, *box.Y+*box.H), true, nil
+}
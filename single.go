@@ -0,0 +1,80 @@
+package main
+
+import (
+	"github.com/peferb/thumbnailer/thumbnailer"
+	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// singleOutput is set when --output is the file name of the thumbnail of a
+// single input file, e.g. -i photo.jpg -o thumb.png, rather than a directory.
+var singleOutput bool
+
+// extensionFormats maps the extensions of output file names to the format
+// they stand for.
+var extensionFormats = map[string]string{
+	".jpg":  "jpeg",
+	".jpeg": "jpeg",
+	".png":  "png",
+	".gif":  "gif",
+	".bmp":  "bmp",
+	".tif":  "tiff",
+	".tiff": "tiff",
+	".webp": "webp",
+	".avif": "avif",
+}
+
+// singleOutputFormat reports whether output names the thumbnail file of the
+// single input file input, because it has the extension of an image format
+// and isn't an existing directory, and returns the format the extension
+// stands for. It's "" for image formats that can only be read, e.g. .heic.
+func singleOutputFormat(input, output string) (string, bool) {
+	if info, err := os.Stat(input); err != nil || info.IsDir() || isTarInput(input) {
+		return "", false
+	}
+	if info, err := os.Stat(output); err == nil && info.IsDir() {
+		return "", false
+	}
+
+	ext := strings.ToLower(filepath.Ext(output))
+	if format, ok := extensionFormats[ext]; ok {
+		return format, true
+	}
+	for _, input := range thumbnailer.InputExtensions() {
+		if ext == input {
+			return "", true
+		}
+	}
+	return "", false
+}
+
+// processSingle writes the thumbnail of the single input file to the output
+// file, without a summary report.
+func processSingle(thumb *thumbnailer.Thumbnailer) {
+	if dryRun {
+		previewImage(thumb, inputPath)
+		return
+	}
+
+	startTime := time.Now()
+	result := processWithRetries(thumb, inputPath)
+	if result.Err != nil {
+		if !ignoreErrors {
+			os.Exit(exitFailed)
+		}
+		return
+	}
+	duration := time.Since(startTime)
+	switch {
+	case result.Existing:
+		log.Printf("Skipped %s, %s already exists, use --overwrite to replace it", inputPath, outputPath)
+	case result.Skipped:
+		log.Printf("Skipped %s, its size of %dx%d is below the minimum", inputPath, result.Width, result.Height)
+	default:
+		logEvent(slog.LevelInfo, "finish", inputPath, duration, "Finished processing image %s in %v, saved to %s", inputPath, duration, outputPath)
+	}
+}
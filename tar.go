@@ -0,0 +1,206 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"github.com/peferb/thumbnailer/thumbnailer"
+	"image"
+	"image/gif"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tarEntry is an image read from a tar archive given as input. It's kept in
+// memory from the walk until it has been processed.
+type tarEntry struct {
+	data    []byte
+	modTime time.Time
+}
+
+// tarEntries maps the paths of tar entries, the archive path joined with the
+// name inside it, to their content. Tar inputs are always streamed, so only
+// the entries waiting for or in processing are held.
+var (
+	tarEntries   = make(map[string]tarEntry)
+	tarEntriesMu sync.Mutex
+)
+
+// isTarInput reports whether path is a tar archive, optionally gzipped, to read
+// the input images from.
+func isTarInput(path string) bool {
+	lower := strings.ToLower(path)
+	if !strings.HasSuffix(lower, ".tar") && !strings.HasSuffix(lower, ".tar.gz") && !strings.HasSuffix(lower, ".tgz") {
+		return false
+	}
+	info, err := os.Stat(path)
+	return err == nil && !info.IsDir()
+}
+
+// walkTar calls fn for every regular file in the tar archive at root, with its
+// path below root, its header info and a reader for its content. Returning
+// filepath.SkipAll from fn stops the walk without an error.
+func walkTar(root string, fn func(path string, info os.FileInfo, r io.Reader) error) error {
+	f, err := os.Open(root)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if lower := strings.ToLower(root); strings.HasSuffix(lower, ".gz") || strings.HasSuffix(lower, ".tgz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return fmt.Errorf("error reading %s: %v", root, err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error reading %s: %v", root, err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := path.Clean(hdr.Name)
+		if !filepath.IsLocal(filepath.FromSlash(name)) {
+			log.Printf("Warning: skipping %s in %s, it points outside the archive", hdr.Name, root)
+			continue
+		}
+		err = fn(filepath.Join(root, filepath.FromSlash(name)), hdr.FileInfo(), tr)
+		if err == filepath.SkipAll {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// addTarEntry keeps data, the content of the tar entry file, until
+// forgetTarEntry.
+func addTarEntry(file string, data []byte, modTime time.Time) {
+	tarEntriesMu.Lock()
+	defer tarEntriesMu.Unlock()
+	tarEntries[file] = tarEntry{data: data, modTime: modTime}
+}
+
+// forgetTarEntry releases the content of the tar entry file once it has been
+// processed. It does nothing for other files.
+func forgetTarEntry(file string) {
+	tarEntriesMu.Lock()
+	defer tarEntriesMu.Unlock()
+	delete(tarEntries, file)
+}
+
+// lookupTarEntry returns the tar entry file, and false when file isn't one.
+func lookupTarEntry(file string) (tarEntry, bool) {
+	tarEntriesMu.Lock()
+	defer tarEntriesMu.Unlock()
+	entry, ok := tarEntries[file]
+	return entry, ok
+}
+
+// needsExtracting reports whether the source file, which may be a tar entry,
+// is in a format that is decoded by external tools, which only read files on
+// disk. The content decides, also for tar entries.
+func needsExtracting(file string) bool {
+	if entry, ok := lookupTarEntry(file); ok {
+		return thumbnailer.NeedsTools(entry.data, file)
+	}
+	return thumbnailer.IsRawFile(file) || thumbnailer.IsHEICFile(file) || thumbnailer.IsPDFFile(file)
+}
+
+// openSource opens the source image file, which may be a tar entry.
+func openSource(file string) (io.ReadCloser, error) {
+	if entry, ok := lookupTarEntry(file); ok {
+		return io.NopCloser(bytes.NewReader(entry.data)), nil
+	}
+	return os.Open(file)
+}
+
+// statSource returns the size and modification time of the source image
+// file, which may be a tar entry.
+func statSource(file string) (int64, time.Time, error) {
+	if entry, ok := lookupTarEntry(file); ok {
+		return int64(len(entry.data)), entry.modTime, nil
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	return info.Size(), info.ModTime(), nil
+}
+
+// decodeSource decodes the source image file with thumb, from memory when
+// it's a tar entry.
+func decodeSource(ctx context.Context, thumb *thumbnailer.Thumbnailer, file string) (image.Image, error) {
+	entry, ok := lookupTarEntry(file)
+	if !ok {
+		return thumb.DecodeFile(ctx, file)
+	}
+	img, err := thumb.Decode(bytes.NewReader(entry.data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	return img, nil
+}
+
+// isRawSource is thumbnailer.IsRawFile for a source that may be a tar entry.
+func isRawSource(file string) bool {
+	if _, ok := lookupTarEntry(file); ok {
+		// RAW entries are skipped by the walk
+		return false
+	}
+	return thumbnailer.IsRawFile(file)
+}
+
+// isSVGSource is thumbnailer.IsSVGFile for a source that may be a tar entry.
+func isSVGSource(file string) bool {
+	if entry, ok := lookupTarEntry(file); ok {
+		return thumbnailer.IsSVGData(entry.data, file)
+	}
+	return thumbnailer.IsSVGFile(file)
+}
+
+// decodeSourceAnimation is thumbnailer.DecodeAnimationFile for a source that
+// may be a tar entry.
+func decodeSourceAnimation(file string) (*gif.GIF, error) {
+	if entry, ok := lookupTarEntry(file); ok {
+		return thumbnailer.DecodeAnimation(bytes.NewReader(entry.data))
+	}
+	return thumbnailer.DecodeAnimationFile(file)
+}
+
+// readSourceExif is thumbnailer.ReadExifFile for a source that may be a tar
+// entry.
+func readSourceExif(file string) ([]byte, error) {
+	if entry, ok := lookupTarEntry(file); ok {
+		return thumbnailer.ReadExif(bytes.NewReader(entry.data))
+	}
+	return thumbnailer.ReadExifFile(file)
+}
+
+// readSourceICC is thumbnailer.ReadICCFile for a source that may be a tar
+// entry.
+func readSourceICC(file string) ([]byte, error) {
+	if entry, ok := lookupTarEntry(file); ok {
+		return thumbnailer.ReadICC(bytes.NewReader(entry.data))
+	}
+	return thumbnailer.ReadICCFile(file)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// writeTar writes a tar archive, gzipped if its name says so, of headers with
+// content as the data of the regular files.
+func writeTar(t *testing.T, file string, headers []tar.Header, content string) {
+	t.Helper()
+	f, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var w io.Writer = f
+	if filepath.Ext(file) == ".tgz" {
+		gz := gzip.NewWriter(f)
+		defer gz.Close()
+		w = gz
+	}
+	tw := tar.NewWriter(w)
+	for _, hdr := range headers {
+		if hdr.Typeflag == tar.TypeReg {
+			hdr.Size = int64(len(content))
+		}
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			io.WriteString(tw, content)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIsTarInput(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.tar", "b.TAR.GZ", "c.tgz", "d.zip"} {
+		writeTar(t, filepath.Join(dir, name), nil, "")
+	}
+	os.Mkdir(filepath.Join(dir, "e.tar"), 0755)
+
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"a.tar", true},
+		{"b.TAR.GZ", true},
+		{"c.tgz", true},
+		{"d.zip", false},
+		{"e.tar", false},
+		{"missing.tar", false},
+	}
+	for _, tt := range tests {
+		if got := isTarInput(filepath.Join(dir, tt.name)); got != tt.want {
+			t.Errorf("isTarInput(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestWalkTar(t *testing.T) {
+	headers := []tar.Header{
+		{Name: "a.jpg", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "sub/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "sub/b.png", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "./sub/../c.gif", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "link.jpg", Typeflag: tar.TypeSymlink, Linkname: "a.jpg"},
+		{Name: "../outside.jpg", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "/absolute.jpg", Typeflag: tar.TypeReg, Mode: 0644},
+	}
+	want := []string{"a.jpg", filepath.Join("sub", "b.png"), "c.gif"}
+
+	for _, name := range []string{"images.tar", "images.tgz"} {
+		root := filepath.Join(t.TempDir(), name)
+		writeTar(t, root, headers, "image data")
+
+		var got []string
+		err := walkTar(root, func(path string, info os.FileInfo, r io.Reader) error {
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			got = append(got, rel)
+			if data, err := io.ReadAll(r); err != nil || string(data) != "image data" {
+				t.Errorf("%s: %s holds %q, %v", name, rel, data, err)
+			}
+			if info.Size() != int64(len("image data")) {
+				t.Errorf("%s: %s has size %d", name, rel, info.Size())
+			}
+			return nil
+		})
+		if err != nil {
+			t.Errorf("%s: walkTar: %v", name, err)
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("%s: walked %v, want %v", name, got, want)
+		}
+
+		// SkipAll stops the walk without an error
+		var n int
+		err = walkTar(root, func(string, os.FileInfo, io.Reader) error {
+			n++
+			return filepath.SkipAll
+		})
+		if err != nil || n != 1 {
+			t.Errorf("%s: walkTar returning SkipAll walked %d files, %v", name, n, err)
+		}
+	}
+
+	broken := filepath.Join(t.TempDir(), "broken.tgz")
+	os.WriteFile(broken, []byte("not gzipped"), 0644)
+	if err := walkTar(broken, func(string, os.FileInfo, io.Reader) error { return nil }); err == nil {
+		t.Errorf("walkTar of a broken archive succeeded")
+	}
+}
+
+func TestTarEntries(t *testing.T) {
+	file := filepath.Join("images.tar", "a.jpg")
+	if _, ok := lookupTarEntry(file); ok {
+		t.Fatalf("%s found before it was added", file)
+	}
+	addTarEntry(file, []byte("image data"), time.Unix(1000, 0))
+	defer forgetTarEntry(file)
+
+	size, modTime, err := statSource(file)
+	if err != nil || size != int64(len("image data")) || !modTime.Equal(time.Unix(1000, 0)) {
+		t.Errorf("statSource = %d, %v, %v", size, modTime, err)
+	}
+	r, err := openSource(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := io.ReadAll(r); string(data) != "image data" {
+		t.Errorf("openSource read %q", data)
+	}
+	r.Close()
+
+	forgetTarEntry(file)
+	if _, err := openSource(file); err == nil {
+		t.Errorf("openSource of a forgotten entry succeeded")
+	}
+}
@@ -0,0 +1,179 @@
+package thumbnailer
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/disintegration/imaging"
+	"github.com/gen2brain/webp"
+	"image"
+	"image/draw"
+	"image/gif"
+	"io"
+	"os"
+)
+
+// isGIF reports whether data starts with a GIF signature.
+func isGIF(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("GIF87a")) || bytes.HasPrefix(data, []byte("GIF89a"))
+}
+
+// DecodeAnimationFile decodes all frames of a GIF file. It returns nil without
+// an error when file isn't a GIF with more than one frame.
+func DecodeAnimationFile(file string) (*gif.GIF, error) {
+	if sniffFile(file) != kindGIF {
+		return nil, nil
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return decodeAnimation(f)
+}
+
+// DecodeAnimation is DecodeAnimationFile for a GIF read from r.
+func DecodeAnimation(r io.Reader) (*gif.GIF, error) {
+	return decodeAnimation(r)
+}
+
+func decodeAnimation(r io.Reader) (*gif.GIF, error) {
+	g, err := gif.DecodeAll(r)
+	if err != nil {
+		// let the regular decoder report the error
+		return nil, nil
+	}
+	if len(g.Image) < 2 {
+		return nil, nil
+	}
+	return g, nil
+}
+
+// AnimatedFormat reports whether format keeps all frames of animated GIFs:
+// GIF, WebP and APNG.
+func AnimatedFormat(format string) bool {
+	return format == "gif" || format == "webp" || format == "apng"
+}
+
+// Animation is an animated GIF resized by ResizeAnimation. Every frame is a
+// complete picture of the same size.
+type Animation struct {
+	Frames []image.Image
+	// Delay is the delay after every frame in 100ths of a second, and
+	// LoopCount the number of repeats, -1 for none and 0 for forever, both
+	// as in gif.GIF.
+	Delay     []int
+	LoopCount int
+}
+
+// Size returns the dimensions of the frames of a.
+func (a *Animation) Size() (int, int) {
+	b := a.Frames[0].Bounds()
+	return b.Dx(), b.Dy()
+}
+
+// plays returns how many times a is played, 0 for forever, as WebP and APNG
+// store it.
+func (a *Animation) plays() int {
+	switch {
+	case a.LoopCount < 0:
+		return 1
+	case a.LoopCount == 0:
+		return 0
+	}
+	return a.LoopCount + 1
+}
+
+// ResizeAnimation resizes every frame of g, keeping the delays and loop
+// count. Frames are composited onto the full canvas before resizing, so every
+// output frame is a complete picture.
+func (t *Thumbnailer) ResizeAnimation(g *gif.GIF) *Animation {
+	bounds := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	if bounds.Empty() {
+		for _, frame := range g.Image {
+			bounds = bounds.Union(frame.Bounds())
+		}
+	}
+	canvas := image.NewRGBA(bounds)
+
+	out := &Animation{
+		Delay:     append([]int(nil), g.Delay...),
+		LoopCount: g.LoopCount,
+	}
+	for i, frame := range g.Image {
+		var disposal byte
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+		var previous []byte
+		if disposal == gif.DisposalPrevious {
+			previous = append([]byte(nil), canvas.Pix...)
+		}
+
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		resized := t.Resize(canvas)
+		if resized == image.Image(canvas) {
+			// not resized, the canvas changes with the next frame
+			resized = imaging.Clone(canvas)
+		}
+		out.Frames = append(out.Frames, resized)
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			copy(canvas.Pix, previous)
+		}
+	}
+	return out
+}
+
+// EncodeAnimation writes a to w as an animated GIF, WebP or APNG, depending on
+// Format. With a Background the frames are flattened onto it, like still
+// images.
+func (t *Thumbnailer) EncodeAnimation(w io.Writer, a *Animation) error {
+	if t.Background != nil {
+		flat := *a
+		flat.Frames = make([]image.Image, len(a.Frames))
+		for i, frame := range a.Frames {
+			flat.Frames[i] = flattenAlpha(frame, t.Background)
+		}
+		a = &flat
+	}
+
+	switch t.Format {
+	case "gif":
+		return gif.EncodeAll(w, a.gif())
+	case "webp":
+		// WebP delays are in milliseconds
+		delays := make([]int, len(a.Delay))
+		for i, d := range a.Delay {
+			delays[i] = d * 10
+		}
+		return webp.EncodeAll(w, &webp.WEBP{Image: a.Frames, Delay: delays, LoopCount: a.plays()},
+			webp.Options{Quality: t.quality(), Method: webp.DefaultMethod})
+	case "apng":
+		return encodeAPNG(w, a, t.PNGCompression)
+	default:
+		return fmt.Errorf("unsupported animation format: %s", t.Format)
+	}
+}
+
+// gif returns a as a GIF. Every frame gets a palette of its own, quantized
+// from the resized frame, as resampling blends in colors the palettes of the
+// source frames don't have.
+func (a *Animation) gif() *gif.GIF {
+	w, h := a.Size()
+	g := &gif.GIF{
+		Delay:     a.Delay,
+		LoopCount: a.LoopCount,
+		Config:    image.Config{Width: w, Height: h},
+	}
+	for _, frame := range a.Frames {
+		g.Image = append(g.Image, quantize(frame, 256))
+		// every frame is complete, so clear the canvas before the next one
+		g.Disposal = append(g.Disposal, gif.DisposalBackground)
+	}
+	return g
+}
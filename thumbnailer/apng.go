@@ -0,0 +1,208 @@
+package thumbnailer
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"github.com/disintegration/imaging"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"io"
+	"math"
+)
+
+// PNG color types of encodeAPNG, 8 bits per sample.
+const (
+	pngColorRGB  = 2
+	pngColorRGBA = 6
+)
+
+// encodeAPNG writes a to w as an animated PNG. Every frame replaces the whole
+// picture, as all frames of a are complete. The frames are stored as RGB, or
+// RGBA when any of them has transparency, since an APNG has one color type
+// for all of them.
+func encodeAPNG(w io.Writer, a *Animation, level png.CompressionLevel) error {
+	width, height := a.Size()
+	frames := make([]*image.NRGBA, len(a.Frames))
+	opaque := true
+	for i, frame := range a.Frames {
+		if b := frame.Bounds(); b.Dx() != width || b.Dy() != height {
+			return fmt.Errorf("error encoding APNG: frame %d is %dx%d, not %dx%d", i, b.Dx(), b.Dy(), width, height)
+		}
+		frames[i] = imaging.Clone(frame)
+		opaque = opaque && frames[i].Opaque()
+	}
+	colorType, bpp := byte(pngColorRGBA), 4
+	if opaque {
+		colorType, bpp = pngColorRGB, 3
+	}
+
+	out := append([]byte(nil), pngSignature...)
+	ihdr := binary.BigEndian.AppendUint32(nil, uint32(width))
+	ihdr = binary.BigEndian.AppendUint32(ihdr, uint32(height))
+	ihdr = append(ihdr, 8, colorType, 0, 0, 0)
+	out = appendPNGChunk(out, "IHDR", ihdr)
+	actl := binary.BigEndian.AppendUint32(nil, uint32(len(a.Frames)))
+	actl = binary.BigEndian.AppendUint32(actl, uint32(a.plays()))
+	out = appendPNGChunk(out, "acTL", actl)
+
+	// fcTL and fdAT chunks share one sequence of numbers
+	var seq uint32
+	for i, frame := range frames {
+		var delay int
+		if i < len(a.Delay) {
+			delay = min(max(a.Delay[i], 0), math.MaxUint16)
+		}
+		fctl := binary.BigEndian.AppendUint32(nil, seq)
+		fctl = binary.BigEndian.AppendUint32(fctl, uint32(width))
+		fctl = binary.BigEndian.AppendUint32(fctl, uint32(height))
+		// x and y offsets of 0, the delay in 100ths of a second, no disposal
+		// and no blending with the previous frame
+		fctl = binary.BigEndian.AppendUint64(fctl, 0)
+		fctl = binary.BigEndian.AppendUint16(fctl, uint16(delay))
+		fctl = binary.BigEndian.AppendUint16(fctl, 100)
+		fctl = append(fctl, 0, 0)
+		out = appendPNGChunk(out, "fcTL", fctl)
+		seq++
+
+		data, err := compressPNGFrame(frame.Pix, width, height, bpp, level)
+		if err != nil {
+			return fmt.Errorf("error encoding APNG: %v", err)
+		}
+		// the first frame is the image decoders without APNG support show
+		if i == 0 {
+			out = appendPNGChunk(out, "IDAT", data)
+		} else {
+			out = appendPNGChunk(out, "fdAT", append(binary.BigEndian.AppendUint32(nil, seq), data...))
+			seq++
+		}
+	}
+	out = appendPNGChunk(out, "IEND", nil)
+
+	_, err := w.Write(out)
+	return err
+}
+
+// appendPNGChunk appends a PNG chunk of type typ holding data to out.
+func appendPNGChunk(out []byte, typ string, data []byte) []byte {
+	out = binary.BigEndian.AppendUint32(out, uint32(len(data)))
+	start := len(out)
+	out = append(out, typ...)
+	out = append(out, data...)
+	return binary.BigEndian.AppendUint32(out, crc32.ChecksumIEEE(out[start:]))
+}
+
+// compressPNGFrame returns the zlib compressed, filtered rows of pix, NRGBA
+// pixels of a width x height image, with bpp bytes per pixel: 4 keeps the
+// alpha, 3 drops it. Every row gets the filter that leaves the smallest sum of
+// absolute values, the heuristic image/png uses too.
+func compressPNGFrame(pix []byte, width, height, bpp int, level png.CompressionLevel) ([]byte, error) {
+	var buf bytes.Buffer
+	zw, err := zlib.NewWriterLevel(&buf, zlibLevel(level))
+	if err != nil {
+		return nil, err
+	}
+
+	rowBytes := width * bpp
+	prev := make([]byte, rowBytes)
+	cur := make([]byte, rowBytes)
+	var filtered [5][]byte
+	for f := range filtered {
+		filtered[f] = make([]byte, 1+rowBytes)
+		filtered[f][0] = byte(f)
+	}
+	for y := 0; y < height; y++ {
+		row := pix[y*width*4 : (y+1)*width*4]
+		if bpp == 4 {
+			copy(cur, row)
+		} else {
+			for x := 0; x < width; x++ {
+				copy(cur[3*x:3*x+3], row[4*x:4*x+3])
+			}
+		}
+
+		best, bestSum := 0, math.MaxInt
+		for f := range filtered {
+			sum := filterPNGRow(filtered[f][1:], cur, prev, bpp, f)
+			if sum < bestSum {
+				best, bestSum = f, sum
+			}
+		}
+		if _, err := zw.Write(filtered[best]); err != nil {
+			return nil, err
+		}
+		prev, cur = cur, prev
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// filterPNGRow writes cur filtered with PNG filter f (none, sub, up, average
+// or Paeth) against the row above, prev, to dst and returns the sum of the
+// absolute values of the result as signed bytes.
+func filterPNGRow(dst, cur, prev []byte, bpp, f int) int {
+	sum := 0
+	for i := range cur {
+		var left, upLeft byte
+		if i >= bpp {
+			left, upLeft = cur[i-bpp], prev[i-bpp]
+		}
+		up := prev[i]
+		var predicted byte
+		switch f {
+		case 1:
+			predicted = left
+		case 2:
+			predicted = up
+		case 3:
+			predicted = byte((int(left) + int(up)) / 2)
+		case 4:
+			predicted = paeth(left, up, upLeft)
+		}
+		dst[i] = cur[i] - predicted
+		if v := int(int8(dst[i])); v < 0 {
+			sum -= v
+		} else {
+			sum += v
+		}
+	}
+	return sum
+}
+
+// paeth returns whichever of a (left), b (up) and c (up left) is closest to
+// a + b - c.
+func paeth(a, b, c byte) byte {
+	p := int(a) + int(b) - int(c)
+	pa, pb, pc := abs(p-int(a)), abs(p-int(b)), abs(p-int(c))
+	switch {
+	case pa <= pb && pa <= pc:
+		return a
+	case pb <= pc:
+		return b
+	}
+	return c
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// zlibLevel returns the zlib level of a PNG compression level.
+func zlibLevel(level png.CompressionLevel) int {
+	switch level {
+	case png.NoCompression:
+		return zlib.NoCompression
+	case png.BestSpeed:
+		return zlib.BestSpeed
+	case png.BestCompression:
+		return zlib.BestCompression
+	}
+	return zlib.DefaultCompression
+}
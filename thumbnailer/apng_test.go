@@ -0,0 +1,222 @@
+package thumbnailer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/disintegration/imaging"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"slices"
+	"testing"
+)
+
+// pngChunk is a chunk read back by readPNGChunks.
+type pngChunk struct {
+	typ  string
+	data []byte
+}
+
+// readPNGChunks splits a PNG into its chunks, checking their CRCs.
+func readPNGChunks(t *testing.T, data []byte) []pngChunk {
+	t.Helper()
+	if !bytes.HasPrefix(data, pngSignature) {
+		t.Fatalf("missing PNG signature")
+	}
+	var chunks []pngChunk
+	for p := len(pngSignature); p < len(data); {
+		if p+12 > len(data) {
+			t.Fatalf("truncated chunk at offset %d", p)
+		}
+		n := int(binary.BigEndian.Uint32(data[p:]))
+		end := p + 8 + n
+		if end+4 > len(data) {
+			t.Fatalf("chunk at offset %d runs past the end", p)
+		}
+		if crc := binary.BigEndian.Uint32(data[end:]); crc != crc32.ChecksumIEEE(data[p+4:end]) {
+			t.Fatalf("bad CRC in %s chunk", data[p+4:p+8])
+		}
+		chunks = append(chunks, pngChunk{string(data[p+4 : p+8]), data[p+8 : end]})
+		p = end + 4
+	}
+	return chunks
+}
+
+// testFrame returns a w x h frame filled with c, with a gradient in the red
+// channel so the rows filter differently.
+func testFrame(w, h int, c color.NRGBA) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			px := c
+			px.R = uint8(x * 255 / w)
+			img.SetNRGBA(x, y, px)
+		}
+	}
+	return img
+}
+
+func TestEncodeAPNG(t *testing.T) {
+	tests := []struct {
+		name      string
+		frames    []image.Image
+		delay     []int
+		loopCount int
+		colorType byte
+		plays     uint32
+	}{
+		{
+			name:      "opaque frames are RGB",
+			frames:    []image.Image{testFrame(8, 6, color.NRGBA{0, 10, 20, 255}), testFrame(8, 6, color.NRGBA{0, 200, 100, 255})},
+			delay:     []int{10, 20},
+			loopCount: 0,
+			colorType: pngColorRGB,
+			plays:     0,
+		},
+		{
+			name:      "any transparent frame makes all RGBA",
+			frames:    []image.Image{testFrame(5, 5, color.NRGBA{0, 10, 20, 255}), testFrame(5, 5, color.NRGBA{0, 200, 100, 128})},
+			delay:     []int{5, 5},
+			loopCount: -1,
+			colorType: pngColorRGBA,
+			plays:     1,
+		},
+		{
+			name:      "long delays are clamped, missing ones 0",
+			frames:    []image.Image{testFrame(3, 2, color.NRGBA{1, 2, 3, 255}), testFrame(3, 2, color.NRGBA{4, 5, 6, 255}), testFrame(3, 2, color.NRGBA{7, 8, 9, 255})},
+			delay:     []int{70000},
+			loopCount: 2,
+			colorType: pngColorRGB,
+			plays:     3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &Animation{Frames: tt.frames, Delay: tt.delay, LoopCount: tt.loopCount}
+			var buf bytes.Buffer
+			if err := encodeAPNG(&buf, a, png.DefaultCompression); err != nil {
+				t.Fatalf("encodeAPNG: %v", err)
+			}
+
+			var types []string
+			var seq uint32
+			var delays []uint16
+			chunks := readPNGChunks(t, buf.Bytes())
+			for _, c := range chunks {
+				types = append(types, c.typ)
+				switch c.typ {
+				case "IHDR":
+					if c.data[9] != tt.colorType {
+						t.Errorf("color type %d, want %d", c.data[9], tt.colorType)
+					}
+				case "acTL":
+					if n := binary.BigEndian.Uint32(c.data); n != uint32(len(tt.frames)) {
+						t.Errorf("acTL has %d frames, want %d", n, len(tt.frames))
+					}
+					if plays := binary.BigEndian.Uint32(c.data[4:]); plays != tt.plays {
+						t.Errorf("acTL has %d plays, want %d", plays, tt.plays)
+					}
+				case "fcTL", "fdAT":
+					if got := binary.BigEndian.Uint32(c.data); got != seq {
+						t.Errorf("%s has sequence number %d, want %d", c.typ, got, seq)
+					}
+					seq++
+					if c.typ == "fcTL" {
+						delays = append(delays, binary.BigEndian.Uint16(c.data[20:]))
+					}
+				}
+			}
+
+			want := []string{"IHDR", "acTL", "fcTL", "IDAT"}
+			for range tt.frames[1:] {
+				want = append(want, "fcTL", "fdAT")
+			}
+			want = append(want, "IEND")
+			if !slices.Equal(types, want) {
+				t.Errorf("chunks %v, want %v", types, want)
+			}
+			for i, d := range delays {
+				wantDelay := 0
+				if i < len(tt.delay) {
+					wantDelay = min(tt.delay[i], 65535)
+				}
+				if int(d) != wantDelay {
+					t.Errorf("frame %d has delay %d, want %d", i, d, wantDelay)
+				}
+			}
+
+			// decoders without APNG support show the first frame
+			img, err := png.Decode(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatalf("png.Decode: %v", err)
+			}
+			first := tt.frames[0].(*image.NRGBA)
+			got := imaging.Clone(img)
+			if !bytes.Equal(got.Pix, first.Pix) {
+				t.Errorf("first frame doesn't match the source")
+			}
+		})
+	}
+}
+
+func TestEncodeAPNGFrameSize(t *testing.T) {
+	a := &Animation{Frames: []image.Image{testFrame(4, 4, color.NRGBA{A: 255}), testFrame(4, 3, color.NRGBA{A: 255})}}
+	if err := encodeAPNG(&bytes.Buffer{}, a, png.DefaultCompression); err == nil {
+		t.Errorf("encodeAPNG of frames of different sizes succeeded")
+	}
+}
+
+func TestPaeth(t *testing.T) {
+	tests := []struct {
+		a, b, c, want byte
+	}{
+		{0, 0, 0, 0},
+		{10, 20, 10, 20},
+		{20, 10, 10, 20},
+		{10, 10, 20, 10},
+		{100, 50, 60, 100},
+		{50, 100, 60, 100},
+		{255, 0, 255, 0},
+		{0, 255, 255, 0},
+		{30, 40, 35, 35},
+	}
+	for _, tt := range tests {
+		if got := paeth(tt.a, tt.b, tt.c); got != tt.want {
+			t.Errorf("paeth(%d, %d, %d) = %d, want %d", tt.a, tt.b, tt.c, got, tt.want)
+		}
+	}
+}
+
+func TestFilterPNGRow(t *testing.T) {
+	prev := []byte{10, 20, 30, 40, 50, 60, 70, 80, 90}
+	cur := []byte{12, 22, 32, 44, 54, 64, 200, 0, 255}
+	const bpp = 3
+	tests := []struct {
+		name   string
+		filter int
+		want   []byte
+	}{
+		{"none", 0, []byte{12, 22, 32, 44, 54, 64, 200, 0, 255}},
+		{"sub", 1, []byte{12, 22, 32, 32, 32, 32, 156, 202, 191}},
+		{"up", 2, []byte{2, 2, 2, 4, 4, 4, 130, 176, 165}},
+		{"average", 3, []byte{7, 12, 17, 18, 18, 18, 143, 189, 178}},
+		{"paeth", 4, []byte{2, 2, 2, 4, 4, 4, 130, 176, 165}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dst := make([]byte, len(cur))
+			sum := filterPNGRow(dst, cur, prev, bpp, tt.filter)
+			if !bytes.Equal(dst, tt.want) {
+				t.Errorf("filtered %v, want %v", dst, tt.want)
+			}
+			wantSum := 0
+			for _, b := range tt.want {
+				wantSum += abs(int(int8(b)))
+			}
+			if sum != wantSum {
+				t.Errorf("sum %d, want %d", sum, wantSum)
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package thumbnailer
+
+import (
+	"fmt"
+	"github.com/disintegration/imaging"
+	"image"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ParseAspect parses an aspect ratio given as WIDTH:HEIGHT, e.g. 16:9 or 1:1,
+// into the ratio of width to height.
+func ParseAspect(s string) (float64, error) {
+	ws, hs, ok := strings.Cut(s, ":")
+	if !ok {
+		return 0, fmt.Errorf("invalid aspect ratio %q, expected WIDTH:HEIGHT like 16:9", s)
+	}
+	w, werr := strconv.ParseFloat(strings.TrimSpace(ws), 64)
+	h, herr := strconv.ParseFloat(strings.TrimSpace(hs), 64)
+	if werr != nil || herr != nil || w <= 0 || h <= 0 || math.IsInf(w/h, 0) {
+		return 0, fmt.Errorf("invalid aspect ratio %q, expected WIDTH:HEIGHT like 16:9", s)
+	}
+	return w / h, nil
+}
+
+// aspectCrop returns the size of the largest region of a w x h source with
+// the Aspect ratio.
+func (t *Thumbnailer) aspectCrop(w, h float64) (float64, float64) {
+	if t.Aspect <= 0 || w <= 0 || h <= 0 {
+		return w, h
+	}
+	if w/h > t.Aspect {
+		return h * t.Aspect, h
+	}
+	return w, w / t.Aspect
+}
+
+// aspectSize is aspectCrop in whole pixels.
+func (t *Thumbnailer) aspectSize(w, h int) (int, int) {
+	cw, ch := t.aspectCrop(float64(w), float64(h))
+	return int(math.Max(1, math.Round(cw))), int(math.Max(1, math.Round(ch)))
+}
+
+// cropAspect center-crops img to the Aspect ratio.
+func (t *Thumbnailer) cropAspect(img image.Image) image.Image {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	cw, ch := t.aspectSize(w, h)
+	if cw == w && ch == h {
+		return img
+	}
+	return imaging.CropAnchor(img, cw, ch, imaging.Center)
+}
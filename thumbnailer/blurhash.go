@@ -0,0 +1,133 @@
+package thumbnailer
+
+import (
+	"fmt"
+	"github.com/disintegration/imaging"
+	"image"
+	"math"
+	"strings"
+)
+
+// base83 is the alphabet BlurHash strings are written in.
+const base83 = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// BlurHash returns the BlurHash of img, a short string describing a blurred
+// version of it that can be shown as a placeholder while the image loads, see
+// https://blurha.sh. xComponents and yComponents (1-9) set how much detail it
+// keeps across and down, 4 and 3 suit most landscape photos. Transparent
+// pixels count with their color, as if the image were opaque.
+func BlurHash(img image.Image, xComponents, yComponents int) (string, error) {
+	if xComponents < 1 || xComponents > 9 || yComponents < 1 || yComponents > 9 {
+		return "", fmt.Errorf("BlurHash components must be between 1 and 9, got %dx%d", xComponents, yComponents)
+	}
+	src := imaging.Clone(img)
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	if w == 0 || h == 0 {
+		return "", fmt.Errorf("can't compute the BlurHash of an empty image")
+	}
+
+	// the cosines of every component along each axis are shared by its rows
+	// and columns
+	cosX := make([][]float64, xComponents)
+	for i := range cosX {
+		cosX[i] = make([]float64, w)
+		for x := range cosX[i] {
+			cosX[i][x] = math.Cos(math.Pi * float64(i) * float64(x) / float64(w))
+		}
+	}
+	cosY := make([][]float64, yComponents)
+	for j := range cosY {
+		cosY[j] = make([]float64, h)
+		for y := range cosY[j] {
+			cosY[j][y] = math.Cos(math.Pi * float64(j) * float64(y) / float64(h))
+		}
+	}
+
+	var linear [256]float64
+	for v := range linear {
+		linear[v] = srgbToLinear(v)
+	}
+
+	factors := make([][3]float64, xComponents*yComponents)
+	for y := 0; y < h; y++ {
+		row := src.Pix[y*src.Stride:]
+		for x := 0; x < w; x++ {
+			r, g, b := linear[row[x*4]], linear[row[x*4+1]], linear[row[x*4+2]]
+			for j := 0; j < yComponents; j++ {
+				for i := 0; i < xComponents; i++ {
+					basis := cosX[i][x] * cosY[j][y]
+					f := &factors[j*xComponents+i]
+					f[0] += basis * r
+					f[1] += basis * g
+					f[2] += basis * b
+				}
+			}
+		}
+	}
+	for k := range factors {
+		norm := 2.0
+		if k == 0 {
+			norm = 1
+		}
+		scale := norm / float64(w*h)
+		factors[k][0] *= scale
+		factors[k][1] *= scale
+		factors[k][2] *= scale
+	}
+
+	var sb strings.Builder
+	writeBase83(&sb, (xComponents-1)+(yComponents-1)*9, 1)
+
+	maximum := 1.0
+	if ac := factors[1:]; len(ac) > 0 {
+		actual := 0.0
+		for _, f := range ac {
+			actual = math.Max(actual, math.Max(math.Abs(f[0]), math.Max(math.Abs(f[1]), math.Abs(f[2]))))
+		}
+		quantized := int(math.Max(0, math.Min(82, math.Floor(actual*166-0.5))))
+		maximum = float64(quantized+1) / 166
+		writeBase83(&sb, quantized, 1)
+	} else {
+		writeBase83(&sb, 0, 1)
+	}
+
+	dc := factors[0]
+	writeBase83(&sb, linearToSRGB(dc[0])<<16|linearToSRGB(dc[1])<<8|linearToSRGB(dc[2]), 4)
+	for _, f := range factors[1:] {
+		writeBase83(&sb, quantizeAC(f[0], maximum)*19*19+quantizeAC(f[1], maximum)*19+quantizeAC(f[2], maximum), 2)
+	}
+	return sb.String(), nil
+}
+
+// writeBase83 writes value as length base83 digits, most significant first.
+func writeBase83(sb *strings.Builder, value, length int) {
+	for i := 1; i <= length; i++ {
+		digit := value / int(math.Pow(83, float64(length-i))) % 83
+		sb.WriteByte(base83[digit])
+	}
+}
+
+// quantizeAC maps an AC component, relative to maximum, to 0-18.
+func quantizeAC(v, maximum float64) int {
+	v /= maximum
+	signed := math.Copysign(math.Sqrt(math.Abs(v)), v)
+	return int(math.Max(0, math.Min(18, math.Floor(signed*9+9.5))))
+}
+
+// srgbToLinear converts an 8-bit sRGB value to linear light from 0 to 1.
+func srgbToLinear(v int) float64 {
+	c := float64(v) / 255
+	if c <= 0.04045 {
+		return c / 12.92
+	}
+	return math.Pow((c+0.055)/1.055, 2.4)
+}
+
+// linearToSRGB converts linear light to an 8-bit sRGB value.
+func linearToSRGB(v float64) int {
+	v = math.Max(0, math.Min(1, v))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
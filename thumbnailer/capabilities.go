@@ -0,0 +1,137 @@
+package thumbnailer
+
+import (
+	"fmt"
+	"github.com/gen2brain/avif"
+	"github.com/gen2brain/webp"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+// InputFormat is a group of input formats that are decoded the same way.
+type InputFormat struct {
+	Name       string
+	Extensions []string
+	// Tools are the external tools the files are converted with, any one of
+	// them is enough. Built-in formats need none.
+	Tools []string
+}
+
+// Tool is an external program that some formats need.
+type Tool struct {
+	Name string
+	// Use says what the tool is needed for.
+	Use string
+	// Path is where the tool was found, "" when it isn't installed.
+	Path string
+}
+
+// tools lists the external tools and their use, in the order they're tried.
+var tools = []struct{ name, use string }{
+	{"exiftool", "previews and orientation of RAW files"},
+	{"dcraw", "renders of RAW files without a preview"},
+	{"dcraw_emu", "renders of RAW files, when dcraw isn't installed"},
+	{"heif-convert", "HEIC and HEIF files"},
+	{"mutool", "PDF pages"},
+	{"gs", "PDF pages, when mutool isn't installed"},
+	{"jpegtran", "progressive JPEG output"},
+}
+
+// InputFormats returns the input formats DecodeFile reads and the external
+// tools they need.
+func InputFormats() []InputFormat {
+	sorted := func(set map[string]bool) []string {
+		var exts []string
+		for ext := range set {
+			exts = append(exts, ext)
+		}
+		sort.Strings(exts)
+		return exts
+	}
+	return []InputFormat{
+		{Name: "Built in", Extensions: inputExtensions},
+		{Name: "Camera RAW", Extensions: sorted(rawExtensions), Tools: toolKinds[kindRaw].tools},
+		{Name: "HEIC", Extensions: sorted(heicExtensions), Tools: toolKinds[kindHEIC].tools},
+		{Name: "PDF", Extensions: []string{".pdf"}, Tools: toolKinds[kindPDF].tools},
+	}
+}
+
+// toolKinds maps the kinds of files that are converted with external tools
+// to their name, the tools, any one of which is enough, and what to install.
+var toolKinds = map[string]struct {
+	name, install string
+	tools         []string
+}{
+	kindRaw:  {"RAW", "exiftool (libimage-exiftool-perl on Debian and Ubuntu, exiftool on Homebrew), dcraw or libraw (dcraw_emu)", []string{"exiftool", "dcraw", "dcraw_emu"}},
+	kindHEIC: {"HEIC", "libheif (libheif-examples on Debian and Ubuntu, libheif on Homebrew)", []string{"heif-convert"}},
+	kindPDF:  {"PDF", "MuPDF (mupdf-tools on Debian and Ubuntu, mupdf on Homebrew) or Ghostscript", []string{"mutool", "gs"}},
+}
+
+// CheckTools returns an error saying what to install for the first of files
+// that needs an external tool to be decoded when none of its tools is
+// installed, so a batch can fail before it starts. Files are only read when
+// some tools are missing.
+func CheckTools(files []string) error {
+	missing := make(map[string]bool)
+	for kind, k := range toolKinds {
+		missing[kind] = true
+		for _, tool := range k.tools {
+			if _, err := exec.LookPath(tool); err == nil {
+				missing[kind] = false
+				break
+			}
+		}
+	}
+	if !missing[kindRaw] && !missing[kindHEIC] && !missing[kindPDF] {
+		return nil
+	}
+
+	for _, file := range files {
+		kind := sniffFile(file)
+		if missing[kind] {
+			k := toolKinds[kind]
+			return fmt.Errorf("%s is a %s file, which needs %s, install %s", file, k.name, strings.Join(k.tools, " or "), k.install)
+		}
+	}
+	return nil
+}
+
+// OutputFormats returns the supported output formats, sorted.
+func OutputFormats() []string {
+	var names []string
+	for format := range formats {
+		names = append(names, format)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Tools returns the external tools some formats need and where they were
+// found on the PATH.
+func Tools() []Tool {
+	found := make([]Tool, len(tools))
+	for i, tool := range tools {
+		found[i] = Tool{Name: tool.name, Use: tool.use}
+		found[i].Path, _ = exec.LookPath(tool.name)
+	}
+	return found
+}
+
+// Codec describes what encodes and decodes format: the system library or
+// the bundled WebAssembly build for WebP and AVIF, Go code for the others.
+func Codec(format string) string {
+	var dynamicErr error
+	switch format {
+	case "webp":
+		dynamicErr = webp.Dynamic()
+	case "avif":
+		dynamicErr = avif.Dynamic()
+	default:
+		return "built in"
+	}
+	if dynamicErr == nil {
+		return "system library"
+	}
+	return "bundled WebAssembly build"
+}
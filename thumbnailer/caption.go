@@ -0,0 +1,135 @@
+package thumbnailer
+
+import (
+	"fmt"
+	"github.com/disintegration/imaging"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+	"image"
+	"image/color"
+	"math"
+	"sync"
+)
+
+// captionScale is the height of caption text as a share of the thumbnail's
+// shorter side, so it covers the same part of every size. Text too wide for
+// the thumbnail is set smaller.
+const captionScale = 0.06
+
+// minCaptionSize is the smallest caption text in pixels still worth drawing.
+const minCaptionSize = 6
+
+// captionFont is the parsed Go Bold font captions are set in, see
+// loadCaptionFont.
+var (
+	captionFont     *opentype.Font
+	captionFontErr  error
+	captionFontOnce sync.Once
+)
+
+// Caption is a line of text drawn onto every thumbnail.
+type Caption struct {
+	Text string
+	// Position is the corner, edge or center the text is placed at, see
+	// Positions.
+	Position string
+	// Color is the color of the text, white when nil.
+	Color color.Color
+	// Outline draws a thin outline in black, or white for dark text, around
+	// the text, so it stays readable over busy images.
+	Outline bool
+}
+
+// NewCaption returns a caption of text placed at position, checking the
+// position.
+func NewCaption(text, position string, c color.Color, outline bool) (*Caption, error) {
+	if err := checkPosition(position); err != nil {
+		return nil, err
+	}
+	return &Caption{Text: text, Position: position, Color: c, Outline: outline}, nil
+}
+
+// loadCaptionFont parses the caption font the first time it's needed.
+func loadCaptionFont() (*opentype.Font, error) {
+	captionFontOnce.Do(func() {
+		captionFont, captionFontErr = opentype.Parse(gobold.TTF)
+	})
+	return captionFont, captionFontErr
+}
+
+// caption draws the Caption onto img, sized relative to it and placed at its
+// Position. Without text, or when the text can't be set legibly, img is
+// returned as is.
+func (t *Thumbnailer) caption(img image.Image) image.Image {
+	c := t.Caption
+	if c == nil || c.Text == "" {
+		return img
+	}
+	b := img.Bounds()
+	f, err := loadCaptionFont()
+	if err != nil || b.Empty() {
+		return img
+	}
+
+	size := float64(min(b.Dx(), b.Dy())) * captionScale
+	face, w, err := captionFace(f, c.Text, size)
+	if err != nil {
+		return img
+	}
+	// margins on both sides, and the outline, have to fit next to the text
+	if avail := float64(b.Dx())*(1-2*positionMargin) - 2; float64(w) > avail {
+		face.Close()
+		if size *= avail / float64(w); size < minCaptionSize {
+			return img
+		}
+		if face, w, err = captionFace(f, c.Text, size); err != nil {
+			return img
+		}
+	}
+	defer face.Close()
+
+	metrics := face.Metrics()
+	h := (metrics.Ascent + metrics.Descent).Ceil()
+	pt := positionPoint(b, w, h, c.Position)
+
+	var text color.Color = color.White
+	if c.Color != nil {
+		text = c.Color
+	}
+	dst := imaging.Clone(img)
+	d := &font.Drawer{Dst: dst, Face: face}
+	dot := fixed.P(pt.X, pt.Y+metrics.Ascent.Ceil())
+	if c.Outline {
+		d.Src = image.NewUniform(outlineColor(text))
+		for _, off := range []image.Point{{-1, -1}, {0, -1}, {1, -1}, {-1, 0}, {1, 0}, {-1, 1}, {0, 1}, {1, 1}} {
+			d.Dot = dot.Add(fixed.P(off.X, off.Y))
+			d.DrawString(c.Text)
+		}
+	}
+	d.Src = image.NewUniform(text)
+	d.Dot = dot
+	d.DrawString(c.Text)
+	return dst
+}
+
+// captionFace returns the face of f at size pixels and the width of text set
+// in it.
+func captionFace(f *opentype.Font, text string, size float64) (font.Face, int, error) {
+	face, err := opentype.NewFace(f, &opentype.FaceOptions{Size: math.Max(size, minCaptionSize), DPI: 72, Hinting: font.HintingFull})
+	if err != nil {
+		return nil, 0, fmt.Errorf("error loading caption font: %v", err)
+	}
+	return face, font.MeasureString(face, text).Ceil(), nil
+}
+
+// outlineColor returns black to outline light text with and white for dark
+// text.
+func outlineColor(c color.Color) color.Color {
+	r, g, b, _ := c.RGBA()
+	if 0.299*float64(r)+0.587*float64(g)+0.114*float64(b) > 0x7fff {
+		return color.Black
+	}
+	return color.White
+}
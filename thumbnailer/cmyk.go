@@ -0,0 +1,73 @@
+package thumbnailer
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"strings"
+)
+
+// adobeCMYK is an Adobe APP14 segment with transform 0, which makes
+// image/jpeg decode a 4-component JPEG as CMYK without color transform.
+var adobeCMYK = []byte{0xff, 0xee, 0x00, 0x0e, 'A', 'd', 'o', 'b', 'e', 0x00, 0x64, 0x00, 0x00, 0x00, 0x00, 0x00}
+
+// isUnmarkedCMYK reports whether err is image/jpeg refusing a CMYK JPEG
+// because it lacks the Adobe APP14 segment that tells how it is stored.
+func isUnmarkedCMYK(err error) bool {
+	var unsupported jpeg.UnsupportedError
+	return errors.As(err, &unsupported) && strings.Contains(string(unsupported), "APP14")
+}
+
+// decodeUnmarkedCMYK decodes a CMYK JPEG without Adobe APP14 segment, as
+// written by some print workflows. Unlike Adobe's inverted CMYK, where 255
+// means no ink, these store plain ink values, so the decoded channels are
+// inverted back; without that the thumbnails look like negatives.
+func decodeUnmarkedCMYK(data []byte, autoOrient bool) (image.Image, error) {
+	if len(data) < 2 {
+		return nil, jpeg.FormatError("missing SOI marker")
+	}
+
+	marked := make([]byte, 0, len(data)+len(adobeCMYK))
+	marked = append(append(append(marked, data[:2]...), adobeCMYK...), data[2:]...)
+	img, err := jpeg.Decode(bytes.NewReader(marked))
+	if err != nil {
+		return nil, err
+	}
+	if cmyk, ok := img.(*image.CMYK); ok {
+		for i := range cmyk.Pix {
+			cmyk.Pix[i] = 255 - cmyk.Pix[i]
+		}
+	}
+
+	img = toRGB(img)
+	if !autoOrient {
+		return img, nil
+	}
+	exif, _ := ReadExif(bytes.NewReader(data))
+	return orient(img, exifOrientation(exif)), nil
+}
+
+// toRGB converts CMYK images to NRGBA before resizing and encoding, which
+// otherwise convert them pixel by pixel. Embedded ICC profiles are not
+// applied, the conversion is the plain one of color.CMYKToRGB.
+func toRGB(img image.Image) image.Image {
+	cmyk, ok := img.(*image.CMYK)
+	if !ok {
+		return img
+	}
+
+	b := cmyk.Bounds()
+	rgb := image.NewNRGBA(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		src := cmyk.Pix[cmyk.PixOffset(b.Min.X, y):]
+		dst := rgb.Pix[rgb.PixOffset(b.Min.X, y):]
+		for x := 0; x < b.Dx(); x++ {
+			s, d := src[4*x:4*x+4], dst[4*x:4*x+4]
+			d[0], d[1], d[2] = color.CMYKToRGB(s[0], s[1], s[2], s[3])
+			d[3] = 0xff
+		}
+	}
+	return rgb
+}
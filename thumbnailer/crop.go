@@ -0,0 +1,17 @@
+package thumbnailer
+
+import (
+	"fmt"
+	"github.com/disintegration/imaging"
+	"image"
+)
+
+// Crop cuts the rectangle r out of img, with r relative to the top left
+// corner of img. It fails when r is empty or reaches outside of img.
+func Crop(img image.Image, r image.Rectangle) (image.Image, error) {
+	b := img.Bounds()
+	if r.Empty() || !r.In(image.Rect(0, 0, b.Dx(), b.Dy())) {
+		return nil, fmt.Errorf("crop box %dx%d at %d,%d doesn't fit inside the %dx%d image", r.Dx(), r.Dy(), r.Min.X, r.Min.Y, b.Dx(), b.Dy())
+	}
+	return imaging.Crop(img, r.Add(b.Min)), nil
+}
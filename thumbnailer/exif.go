@@ -0,0 +1,324 @@
+package thumbnailer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// Metadata modes.
+const (
+	// MetadataStrip drops all metadata from the output.
+	MetadataStrip = "strip"
+	// MetadataKeep copies the source's EXIF into JPEG output.
+	MetadataKeep = "keep"
+)
+
+const (
+	tagOrientation      = 0x0112
+	tagExifIFD          = 0x8769
+	tagGPSIFD           = 0x8825
+	tagDateTimeOriginal = 0x9003
+)
+
+// exifTimeLayout is the format of EXIF date and time values, in local time.
+const exifTimeLayout = "2006:01:02 15:04:05"
+
+// maxTIFFHeader is how much of a TIFF-based file ReadCaptureTime reads; the
+// EXIF IFD sits near the start.
+const maxTIFFHeader = 1 << 20
+
+var exifHeader = []byte("Exif\x00\x00")
+
+// ReadExif returns the EXIF data (a TIFF structure) embedded in a JPEG
+// stream, or nil when the stream is not a JPEG or carries no EXIF.
+func ReadExif(r io.Reader) ([]byte, error) {
+	var exif []byte
+	err := readSegments(r, func(marker byte, segment []byte) bool {
+		if marker == 0xE1 && bytes.HasPrefix(segment, exifHeader) {
+			exif = segment[len(exifHeader):]
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading EXIF: %v", err)
+	}
+	return exif, nil
+}
+
+// readSegments calls fn with the marker and content of every metadata segment
+// of a JPEG stream up to the image data, until fn returns false. Streams that
+// are not a JPEG have no segments.
+func readSegments(r io.Reader, fn func(marker byte, segment []byte) bool) error {
+	br := bufio.NewReader(r)
+
+	var marker [2]byte
+	if _, err := io.ReadFull(br, marker[:]); err != nil {
+		return err
+	}
+	if marker != [2]byte{0xFF, 0xD8} {
+		return nil
+	}
+
+	for {
+		if _, err := io.ReadFull(br, marker[:]); err != nil {
+			return err
+		}
+		if marker[0] != 0xFF {
+			return nil
+		}
+		switch {
+		case marker[1] == 0xDA || marker[1] == 0xD9:
+			// start of scan or end of image, no more metadata segments
+			return nil
+		case marker[1] == 0x01 || (marker[1] >= 0xD0 && marker[1] <= 0xD7):
+			// markers without a length
+			continue
+		}
+
+		var size [2]byte
+		if _, err := io.ReadFull(br, size[:]); err != nil {
+			return err
+		}
+		n := int(binary.BigEndian.Uint16(size[:])) - 2
+		if n < 0 {
+			return fmt.Errorf("invalid segment length")
+		}
+		segment := make([]byte, n)
+		if _, err := io.ReadFull(br, segment); err != nil {
+			return err
+		}
+
+		if !fn(marker[1], segment) {
+			return nil
+		}
+	}
+}
+
+// ReadExifFile returns the EXIF data embedded in a JPEG file, see ReadExif.
+func ReadExifFile(file string) ([]byte, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("error opening image file %s: %w", file, err)
+	}
+	defer f.Close()
+
+	return ReadExif(f)
+}
+
+// EncodeWithMetadata encodes img like Encode and, for JPEG output in
+// MetadataKeep mode, embeds exif into the result.
+func (t *Thumbnailer) EncodeWithMetadata(w io.Writer, img image.Image, exif []byte) error {
+	if exif == nil || t.Metadata != MetadataKeep || t.Format != "jpeg" {
+		return t.Encode(w, img)
+	}
+
+	exif = append([]byte(nil), exif...)
+	if t.StripGPS {
+		stripGPS(exif)
+	}
+	if t.AutoOrient {
+		// the pixels are already rotated, keeping the tag would rotate them twice
+		setOrientation(exif, 1)
+	}
+
+	var buf bytes.Buffer
+	if err := t.Encode(&buf, img); err != nil {
+		return err
+	}
+
+	data, err := insertExif(buf.Bytes(), exif)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// insertExif adds an APP1 EXIF segment right after the SOI marker of a JPEG.
+func insertExif(jpeg, exif []byte) ([]byte, error) {
+	size := 2 + len(exifHeader) + len(exif)
+	if size > 0xFFFF {
+		return nil, fmt.Errorf("EXIF data too large to embed (%d bytes)", len(exif))
+	}
+
+	out := make([]byte, 0, len(jpeg)+size+2)
+	out = append(out, jpeg[:2]...)
+	out = append(out, 0xFF, 0xE1, byte(size>>8), byte(size))
+	out = append(out, exifHeader...)
+	out = append(out, exif...)
+	return append(out, jpeg[2:]...), nil
+}
+
+// ifdEntry is one 12 byte entry of a TIFF image file directory.
+type ifdEntry struct {
+	offset int
+	tag    uint16
+	typ    uint16
+	count  uint32
+}
+
+// tiffOrder returns the byte order of a TIFF structure and the offset of its
+// first IFD.
+func tiffOrder(tiff []byte) (binary.ByteOrder, int, bool) {
+	if len(tiff) < 8 {
+		return nil, 0, false
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, 0, false
+	}
+	return order, int(order.Uint32(tiff[4:8])), true
+}
+
+// ifdEntries lists the entries of the IFD at offset, ignoring an IFD that
+// runs past the end of the data.
+func ifdEntries(tiff []byte, order binary.ByteOrder, offset int) []ifdEntry {
+	if offset < 0 || offset+2 > len(tiff) {
+		return nil
+	}
+
+	n := int(order.Uint16(tiff[offset:]))
+	if offset+2+12*n > len(tiff) {
+		return nil
+	}
+
+	entries := make([]ifdEntry, n)
+	for i := range entries {
+		e := offset + 2 + 12*i
+		entries[i] = ifdEntry{
+			offset: e,
+			tag:    order.Uint16(tiff[e:]),
+			typ:    order.Uint16(tiff[e+2:]),
+			count:  order.Uint32(tiff[e+4:]),
+		}
+	}
+	return entries
+}
+
+// tiffTypeSizes maps TIFF field types to their size in bytes.
+var tiffTypeSizes = map[uint16]int{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8}
+
+// stripGPS zeroes all GPS tags and their values and empties the GPS IFD.
+func stripGPS(tiff []byte) {
+	order, ifd0, ok := tiffOrder(tiff)
+	if !ok {
+		return
+	}
+
+	for _, e := range ifdEntries(tiff, order, ifd0) {
+		if e.tag != tagGPSIFD {
+			continue
+		}
+
+		gpsIFD := int(order.Uint32(tiff[e.offset+8:]))
+		for _, g := range ifdEntries(tiff, order, gpsIFD) {
+			size := tiffTypeSizes[g.typ] * int(g.count)
+			if size > 4 {
+				valueOffset := int(order.Uint32(tiff[g.offset+8:]))
+				if valueOffset >= 0 && valueOffset+size <= len(tiff) {
+					clear(tiff[valueOffset : valueOffset+size])
+				}
+			}
+			clear(tiff[g.offset : g.offset+12])
+		}
+		if gpsIFD+2 <= len(tiff) {
+			order.PutUint16(tiff[gpsIFD:], 0)
+		}
+	}
+}
+
+// setOrientation overwrites the orientation tag in IFD0.
+func setOrientation(tiff []byte, o uint16) {
+	order, ifd0, ok := tiffOrder(tiff)
+	if !ok {
+		return
+	}
+
+	for _, e := range ifdEntries(tiff, order, ifd0) {
+		if e.tag == tagOrientation && e.typ == 3 {
+			order.PutUint16(tiff[e.offset+8:], o)
+		}
+	}
+}
+
+// exifOrientation returns the orientation tag in IFD0, or 1 when there is
+// none.
+func exifOrientation(tiff []byte) int {
+	order, ifd0, ok := tiffOrder(tiff)
+	if !ok {
+		return 1
+	}
+
+	for _, e := range ifdEntries(tiff, order, ifd0) {
+		if e.tag == tagOrientation && e.typ == 3 {
+			return int(order.Uint16(tiff[e.offset+8:]))
+		}
+	}
+	return 1
+}
+
+// ReadCaptureTime returns when the photo in file was taken, from the EXIF
+// DateTimeOriginal of a JPEG or a TIFF-based file such as most camera RAW
+// formats. ok is false when there is no such tag.
+func ReadCaptureTime(file string) (t time.Time, ok bool) {
+	f, err := os.Open(file)
+	if err != nil {
+		return time.Time{}, false
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	magic, _ := br.Peek(2)
+	var tiff []byte
+	switch string(magic) {
+	case "\xff\xd8":
+		tiff, err = ReadExif(br)
+	case "II", "MM":
+		tiff, err = io.ReadAll(io.LimitReader(br, maxTIFFHeader))
+	}
+	if err != nil || tiff == nil {
+		return time.Time{}, false
+	}
+	return captureTime(tiff)
+}
+
+// captureTime reads DateTimeOriginal from the EXIF IFD of tiff.
+func captureTime(tiff []byte) (time.Time, bool) {
+	order, ifd0, ok := tiffOrder(tiff)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	for _, e := range ifdEntries(tiff, order, ifd0) {
+		if e.tag != tagExifIFD {
+			continue
+		}
+		for _, d := range ifdEntries(tiff, order, int(order.Uint32(tiff[e.offset+8:]))) {
+			if d.tag != tagDateTimeOriginal || d.typ != 2 || d.count <= 4 {
+				continue
+			}
+			valueOffset := int(order.Uint32(tiff[d.offset+8:]))
+			if valueOffset < 0 || valueOffset+int(d.count) > len(tiff) {
+				return time.Time{}, false
+			}
+			value := strings.TrimRight(string(tiff[valueOffset:valueOffset+int(d.count)]), "\x00 ")
+			t, err := time.ParseInLocation(exifTimeLayout, value, time.Local)
+			return t, err == nil
+		}
+	}
+	return time.Time{}, false
+}
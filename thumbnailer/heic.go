@@ -0,0 +1,55 @@
+package thumbnailer
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"os"
+	"os/exec"
+)
+
+// heicExtensions lists the HEIF formats that are decoded by converting them
+// to JPEG with heif-convert from libheif.
+var heicExtensions = map[string]bool{
+	".heic": true,
+	".heif": true,
+}
+
+// IsHEICFile reports whether file holds a HEIC image, judged by its content
+// rather than its extension, see sniffFile.
+func IsHEICFile(file string) bool {
+	return sniffFile(file) == kindHEIC
+}
+
+// ReadHEICImage decodes a HEIC file by converting it to a temporary JPEG with
+// heif-convert. libheif applies the rotation stored in the file, so the
+// result needs no further orientation. The heif-convert process is killed
+// when ctx is done.
+func ReadHEICImage(ctx context.Context, file string) (image.Image, error) {
+	if _, err := exec.LookPath("heif-convert"); err != nil {
+		return nil, fmt.Errorf("error decoding HEIC file %s: heif-convert not found, install libheif (libheif-examples on Debian and Ubuntu, libheif on Homebrew)", file)
+	}
+
+	tmp, err := os.CreateTemp("", "thumbnailer-*.jpg")
+	if err != nil {
+		return nil, fmt.Errorf("error creating temporary file for HEIC file %s: %w", file, err)
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	if _, err := runTool(ctx, "heif-convert", "-q", "100", file, tmp.Name()); err != nil {
+		return nil, fmt.Errorf("error converting HEIC file %s: %w", file, err)
+	}
+
+	f, err := os.Open(tmp.Name())
+	if err != nil {
+		return nil, fmt.Errorf("error opening converted HEIC file %s: %w", file, err)
+	}
+	defer f.Close()
+
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding converted HEIC file %s: %v", file, err)
+	}
+	return img, nil
+}
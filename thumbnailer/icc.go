@@ -0,0 +1,180 @@
+package thumbnailer
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// iccHeader starts the APP2 segments that carry an ICC profile in a JPEG,
+// followed by the 1-based number of the chunk and the number of chunks.
+var iccHeader = []byte("ICC_PROFILE\x00")
+
+// maxICCChunk is the most profile data that fits in one APP2 segment.
+const maxICCChunk = 0xFFFF - 2 - 14
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// ReadICC returns the ICC color profile embedded in a JPEG or PNG stream, or
+// nil when the stream is neither or carries no profile.
+func ReadICC(r io.Reader) ([]byte, error) {
+	br := bufio.NewReader(r)
+	if head, _ := br.Peek(len(pngSignature)); bytes.Equal(head, pngSignature) {
+		return readPNGICC(br)
+	}
+
+	var chunks [][]byte
+	err := readSegments(br, func(marker byte, segment []byte) bool {
+		if marker != 0xE2 || len(segment) < len(iccHeader)+2 || !bytes.HasPrefix(segment, iccHeader) {
+			return true
+		}
+		seq, count := int(segment[len(iccHeader)]), int(segment[len(iccHeader)+1])
+		if chunks == nil {
+			chunks = make([][]byte, count)
+		}
+		if seq >= 1 && seq <= len(chunks) {
+			chunks[seq-1] = segment[len(iccHeader)+2:]
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading ICC profile: %v", err)
+	}
+
+	var profile []byte
+	for _, chunk := range chunks {
+		if chunk == nil {
+			// an incomplete profile is worse than none
+			return nil, nil
+		}
+		profile = append(profile, chunk...)
+	}
+	return profile, nil
+}
+
+// ReadICCFile returns the ICC color profile embedded in a JPEG or PNG file,
+// see ReadICC.
+func ReadICCFile(file string) ([]byte, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("error opening image file %s: %w", file, err)
+	}
+	defer f.Close()
+
+	return ReadICC(f)
+}
+
+// readPNGICC returns the profile of the iCCP chunk of a PNG stream, which
+// comes before the image data.
+func readPNGICC(r io.Reader) ([]byte, error) {
+	if _, err := io.CopyN(io.Discard, r, int64(len(pngSignature))); err != nil {
+		return nil, fmt.Errorf("error reading ICC profile: %v", err)
+	}
+
+	for {
+		var header [8]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return nil, fmt.Errorf("error reading ICC profile: %v", err)
+		}
+		n := int64(binary.BigEndian.Uint32(header[:4]))
+		switch string(header[4:]) {
+		case "IDAT", "IEND":
+			return nil, nil
+		case "iCCP":
+			data := make([]byte, n)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return nil, fmt.Errorf("error reading ICC profile: %v", err)
+			}
+			// profile name, null separator and compression method 0
+			name := bytes.IndexByte(data, 0)
+			if name < 0 || name+2 > len(data) {
+				return nil, fmt.Errorf("error reading ICC profile: invalid iCCP chunk")
+			}
+			zr, err := zlib.NewReader(bytes.NewReader(data[name+2:]))
+			if err != nil {
+				return nil, fmt.Errorf("error reading ICC profile: %v", err)
+			}
+			defer zr.Close()
+			profile, err := io.ReadAll(zr)
+			if err != nil {
+				return nil, fmt.Errorf("error reading ICC profile: %v", err)
+			}
+			return profile, nil
+		}
+		// skip the chunk data and CRC
+		if _, err := io.CopyN(io.Discard, r, n+4); err != nil {
+			return nil, fmt.Errorf("error reading ICC profile: %v", err)
+		}
+	}
+}
+
+// isRGBProfile reports whether profile describes an RGB color space. Only
+// those fit thumbnails, which are always RGB, even of CMYK sources.
+func isRGBProfile(profile []byte) bool {
+	return len(profile) >= 20 && string(profile[16:20]) == "RGB "
+}
+
+// embedsICC reports whether Encode embeds the ICC profile.
+func (t *Thumbnailer) embedsICC() bool {
+	return (t.Format == "jpeg" || t.Format == "png" || t.Format == "apng") && isRGBProfile(t.ICC)
+}
+
+// embedICC adds profile to an encoded JPEG or PNG.
+func embedICC(format string, data, profile []byte) ([]byte, error) {
+	if format == "png" || format == "apng" {
+		return insertPNGICC(data, profile)
+	}
+	return insertJPEGICC(data, profile)
+}
+
+// insertJPEGICC adds profile as APP2 segments right after the SOI marker of a
+// JPEG.
+func insertJPEGICC(jpeg, profile []byte) ([]byte, error) {
+	count := (len(profile) + maxICCChunk - 1) / maxICCChunk
+	if count > 255 {
+		return nil, fmt.Errorf("ICC profile too large to embed (%d bytes)", len(profile))
+	}
+
+	out := make([]byte, 0, len(jpeg)+len(profile)+count*18)
+	out = append(out, jpeg[:2]...)
+	for i := 0; i < count; i++ {
+		chunk := profile[i*maxICCChunk : min((i+1)*maxICCChunk, len(profile))]
+		size := 2 + len(iccHeader) + 2 + len(chunk)
+		out = append(out, 0xFF, 0xE2, byte(size>>8), byte(size))
+		out = append(out, iccHeader...)
+		out = append(out, byte(i+1), byte(count))
+		out = append(out, chunk...)
+	}
+	return append(out, jpeg[2:]...), nil
+}
+
+// insertPNGICC adds profile as an iCCP chunk right after the IHDR chunk of a
+// PNG, which must precede the image data.
+func insertPNGICC(png, profile []byte) ([]byte, error) {
+	// signature, then IHDR: length, type, 13 bytes of data and the CRC
+	ihdrEnd := len(pngSignature) + 8 + 13 + 4
+	if len(png) < ihdrEnd || string(png[len(pngSignature)+4:len(pngSignature)+8]) != "IHDR" {
+		return nil, fmt.Errorf("error embedding ICC profile: invalid PNG")
+	}
+
+	var chunk bytes.Buffer
+	chunk.WriteString("iCCP")
+	chunk.WriteString("ICC profile\x00\x00")
+	zw := zlib.NewWriter(&chunk)
+	zw.Write(profile)
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, len(png)+chunk.Len()+8)
+	out = append(out, png[:ihdrEnd]...)
+	out = binary.BigEndian.AppendUint32(out, uint32(chunk.Len()-4))
+	out = append(out, chunk.Bytes()...)
+	out = binary.BigEndian.AppendUint32(out, crc32.ChecksumIEEE(chunk.Bytes()))
+	return append(out, png[ihdrEnd:]...), nil
+}
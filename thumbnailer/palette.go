@@ -0,0 +1,158 @@
+package thumbnailer
+
+import (
+	"github.com/disintegration/imaging"
+	"image"
+	"image/color"
+	"sort"
+)
+
+// paletteColor is one distinct color of an image and how many pixels have
+// it.
+type paletteColor struct {
+	c     [4]uint8
+	count int
+}
+
+// paletteBox is a set of distinct colors that becomes one palette entry.
+type paletteBox []paletteColor
+
+// quantize returns img as a paletted image of at most n colors, chosen with
+// median cut. Images with no more than n distinct colors, such as most icons
+// and logos, keep them exactly. Transparency is kept, as a color of its own.
+func quantize(img image.Image, n int) *image.Paletted {
+	src := imaging.Clone(img)
+	b := src.Bounds()
+
+	counts := make(map[[4]uint8]int)
+	for i := 0; i < len(src.Pix); i += 4 {
+		counts[nrgbaKey(src.Pix[i:i+4])]++
+	}
+	colors := make(paletteBox, 0, len(counts))
+	for c, count := range counts {
+		colors = append(colors, paletteColor{c, count})
+	}
+	// map order is random, sorting keeps the palette the same every run
+	sort.Slice(colors, func(i, j int) bool {
+		return nrgbaValue(colors[i].c) < nrgbaValue(colors[j].c)
+	})
+
+	boxes := []paletteBox{colors}
+	for len(boxes) < n {
+		i, channel := widestBox(boxes)
+		if i < 0 {
+			break
+		}
+		low, high := boxes[i].split(channel)
+		boxes[i] = low
+		boxes = append(boxes, high)
+	}
+
+	palette := make(color.Palette, len(boxes))
+	index := make(map[[4]uint8]uint8, len(colors))
+	for i, box := range boxes {
+		palette[i] = box.average()
+		for _, c := range box {
+			index[c.c] = uint8(i)
+		}
+	}
+
+	dst := image.NewPaletted(image.Rect(0, 0, b.Dx(), b.Dy()), palette)
+	for y := 0; y < b.Dy(); y++ {
+		row := src.Pix[y*src.Stride:]
+		for x := 0; x < b.Dx(); x++ {
+			dst.Pix[y*dst.Stride+x] = index[nrgbaKey(row[4*x:4*x+4])]
+		}
+	}
+	return dst
+}
+
+// nrgbaKey returns the NRGBA color in p. Fully transparent pixels are all
+// the same color, whatever their RGB.
+func nrgbaKey(p []uint8) [4]uint8 {
+	if p[3] == 0 {
+		return [4]uint8{}
+	}
+	return [4]uint8{p[0], p[1], p[2], p[3]}
+}
+
+func nrgbaValue(c [4]uint8) uint32 {
+	return uint32(c[0])<<24 | uint32(c[1])<<16 | uint32(c[2])<<8 | uint32(c[3])
+}
+
+// widestBox returns the box of boxes to split next, the one whose widest
+// channel spans the most, weighted by its pixels, and that channel. It
+// returns -1 when every box has a single color.
+func widestBox(boxes []paletteBox) (int, int) {
+	best, bestChannel, bestScore := -1, 0, 0
+	for i, box := range boxes {
+		if len(box) < 2 {
+			continue
+		}
+		channel, span := box.widestChannel()
+		pixels := 0
+		for _, c := range box {
+			pixels += c.count
+		}
+		if score := span * pixels; span > 0 && score > bestScore {
+			best, bestChannel, bestScore = i, channel, score
+		}
+	}
+	return best, bestChannel
+}
+
+// widestChannel returns the channel (0-3 for R, G, B and A) whose values
+// span the most in box, and the span.
+func (box paletteBox) widestChannel() (int, int) {
+	lo, hi := [4]int{255, 255, 255, 255}, [4]int{}
+	for _, c := range box {
+		for ch, v := range c.c {
+			lo[ch] = min(lo[ch], int(v))
+			hi[ch] = max(hi[ch], int(v))
+		}
+	}
+	channel := 0
+	for ch := 1; ch < 4; ch++ {
+		if hi[ch]-lo[ch] > hi[channel]-lo[channel] {
+			channel = ch
+		}
+	}
+	return channel, hi[channel] - lo[channel]
+}
+
+// split divides box at the pixel median of channel.
+func (box paletteBox) split(channel int) (paletteBox, paletteBox) {
+	sort.SliceStable(box, func(i, j int) bool {
+		return box[i].c[channel] < box[j].c[channel]
+	})
+	total := 0
+	for _, c := range box {
+		total += c.count
+	}
+	seen, at := 0, 1
+	for i, c := range box[:len(box)-1] {
+		if seen += c.count; seen*2 >= total {
+			at = i + 1
+			break
+		}
+	}
+	return box[:at:at], box[at:]
+}
+
+// average returns the mean color of box, weighted by its pixels.
+func (box paletteBox) average() color.NRGBA {
+	var sum [4]int
+	pixels := 0
+	for _, c := range box {
+		for ch, v := range c.c {
+			sum[ch] += int(v) * c.count
+		}
+		pixels += c.count
+	}
+	return color.NRGBA{
+		R: uint8((sum[0] + pixels/2) / pixels),
+		G: uint8((sum[1] + pixels/2) / pixels),
+		B: uint8((sum[2] + pixels/2) / pixels),
+		A: uint8((sum[3] + pixels/2) / pixels),
+	}
+}
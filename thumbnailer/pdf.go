@@ -0,0 +1,64 @@
+package thumbnailer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"os/exec"
+	"strconv"
+)
+
+// pdfResolution is the DPI PDF pages are rendered at. An A4 page becomes
+// about 1240x1754 pixels, plenty for thumbnails.
+const pdfResolution = 150
+
+// IsPDFFile reports whether file holds a PDF document, judged by its content
+// rather than its extension, see sniffFile.
+func IsPDFFile(file string) bool {
+	return sniffFile(file) == kindPDF
+}
+
+// ReadPDFImage renders one page of a PDF file, 1-based with 0 meaning the
+// first, using mutool from MuPDF or else Ghostscript. The renderer is killed
+// when ctx is done.
+func ReadPDFImage(ctx context.Context, file string, page int) (image.Image, error) {
+	if page < 1 {
+		page = 1
+	}
+
+	tool, args := pdfRenderer(file, page)
+	if tool == "" {
+		return nil, fmt.Errorf("error rendering PDF file %s: neither mutool nor gs found, install MuPDF (mupdf-tools on Debian and Ubuntu, mupdf on Homebrew) or Ghostscript", file)
+	}
+
+	render, err := runTool(ctx, tool, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error rendering PDF file %s: %w", file, err)
+	}
+	if len(render) == 0 {
+		// Ghostscript renders nothing for pages past the end
+		return nil, fmt.Errorf("error rendering PDF file %s: no page %d", file, page)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(render))
+	if err != nil {
+		return nil, fmt.Errorf("error decoding render of PDF file %s: %v", file, err)
+	}
+	return img, nil
+}
+
+// pdfRenderer returns the installed tool and its arguments that render page
+// of file as a PNG on stdout, or "" when neither is installed.
+func pdfRenderer(file string, page int) (string, []string) {
+	dpi := strconv.Itoa(pdfResolution)
+	if _, err := exec.LookPath("mutool"); err == nil {
+		return "mutool", []string{"draw", "-q", "-F", "png", "-r", dpi, "-o", "-", file, strconv.Itoa(page)}
+	}
+	if _, err := exec.LookPath("gs"); err == nil {
+		n := strconv.Itoa(page)
+		return "gs", []string{"-q", "-dSAFER", "-dBATCH", "-dNOPAUSE", "-sDEVICE=png16m", "-r" + dpi,
+			"-dFirstPage=" + n, "-dLastPage=" + n, "-sOutputFile=-", file}
+	}
+	return "", nil
+}
@@ -0,0 +1,35 @@
+package thumbnailer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+)
+
+// ErrTooManyPixels is returned for images with more than MaxPixels pixels,
+// before they are decoded.
+var ErrTooManyPixels = errors.New("image has too many pixels")
+
+// CheckPixels returns an error wrapping ErrTooManyPixels when a w x h image is
+// over MaxPixels.
+func (t *Thumbnailer) CheckPixels(w, h int) error {
+	if t.MaxPixels > 0 && int64(w)*int64(h) > t.MaxPixels {
+		return fmt.Errorf("%w: %dx%d is over the limit of %d", ErrTooManyPixels, w, h, t.MaxPixels)
+	}
+	return nil
+}
+
+// checkPixels checks the dimensions in the header of the image in data with
+// CheckPixels. Headers that can't be read are left for the decoder to reject,
+// and SVGs are rendered at the thumbnail size rather than their own.
+func (t *Thumbnailer) checkPixels(data []byte) error {
+	if t.MaxPixels <= 0 {
+		return nil
+	}
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || format == "svg" {
+		return nil
+	}
+	return t.CheckPixels(config.Width, config.Height)
+}
@@ -0,0 +1,70 @@
+package thumbnailer
+
+import (
+	"fmt"
+	"github.com/disintegration/imaging"
+	"image"
+	"math"
+	"sort"
+	"strings"
+)
+
+// positionMargin is the gap between a watermark or caption and the edges of
+// the thumbnail, as a share of the thumbnail's shorter side.
+const positionMargin = 0.02
+
+// positionAnchors maps the names of the positions of watermarks and captions
+// to the anchors they align to.
+var positionAnchors = map[string]imaging.Anchor{
+	"top-left":     imaging.TopLeft,
+	"top":          imaging.Top,
+	"top-right":    imaging.TopRight,
+	"left":         imaging.Left,
+	"center":       imaging.Center,
+	"right":        imaging.Right,
+	"bottom-left":  imaging.BottomLeft,
+	"bottom":       imaging.Bottom,
+	"bottom-right": imaging.BottomRight,
+}
+
+// Positions lists the names accepted as the position of a Watermark or a
+// Caption: the corners, the middle of the edges and the center.
+func Positions() []string {
+	var names []string
+	for name := range positionAnchors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// checkPosition returns an error when position isn't one of Positions.
+func checkPosition(position string) error {
+	if _, ok := positionAnchors[position]; !ok {
+		return fmt.Errorf("unknown position %q, expected one of %s", position, strings.Join(Positions(), ", "))
+	}
+	return nil
+}
+
+// positionPoint returns the top left corner of a w x h box placed at position
+// inside bounds, a positionMargin away from the edges it's aligned to.
+func positionPoint(bounds image.Rectangle, w, h int, position string) image.Point {
+	margin := int(math.Round(float64(min(bounds.Dx(), bounds.Dy())) * positionMargin))
+	anchor := positionAnchors[position]
+
+	x := bounds.Min.X + (bounds.Dx()-w)/2
+	switch anchor {
+	case imaging.TopLeft, imaging.Left, imaging.BottomLeft:
+		x = bounds.Min.X + margin
+	case imaging.TopRight, imaging.Right, imaging.BottomRight:
+		x = bounds.Max.X - w - margin
+	}
+	y := bounds.Min.Y + (bounds.Dy()-h)/2
+	switch anchor {
+	case imaging.TopLeft, imaging.Top, imaging.TopRight:
+		y = bounds.Min.Y + margin
+	case imaging.BottomLeft, imaging.Bottom, imaging.BottomRight:
+		y = bounds.Max.Y - h - margin
+	}
+	return image.Pt(x, y)
+}
@@ -0,0 +1,49 @@
+package thumbnailer
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/disintegration/imaging"
+	"github.com/peferb/thumbnailer/thumbnailer/internal/jpeg444"
+	"image"
+	"io"
+	"os/exec"
+)
+
+// encodeProgressiveJPEG writes img to w as a progressive JPEG. Go's encoder
+// only writes baseline JPEGs, so the baseline result is converted losslessly
+// with jpegtran from libjpeg.
+func (t *Thumbnailer) encodeProgressiveJPEG(w io.Writer, img image.Image) error {
+	if _, err := exec.LookPath("jpegtran"); err != nil {
+		return fmt.Errorf("progressive JPEG needs jpegtran, install libjpeg-turbo (libjpeg-turbo-progs on Debian and Ubuntu, jpeg-turbo on Homebrew)")
+	}
+
+	var baseline bytes.Buffer
+	if err := t.encodeBaselineJPEG(&baseline, img); err != nil {
+		return err
+	}
+
+	cmd := exec.Command("jpegtran", "-progressive", "-optimize", "-copy", "none")
+	cmd.Stdin = &baseline
+	cmd.Stdout = w
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("error converting to progressive JPEG: %v, %s", err, stderr.String())
+	}
+	return nil
+}
+
+// encodeBaselineJPEG writes img to w as a baseline JPEG. Go's encoder always
+// subsamples the chroma to 4:2:0, even at quality 100, so NoSubsampling uses
+// the 4:4:4 copy of it in jpeg444.
+func (t *Thumbnailer) encodeBaselineJPEG(w io.Writer, img image.Image) error {
+	if !t.NoSubsampling {
+		return imaging.Encode(w, img, imaging.JPEG, imaging.JPEGQuality(t.quality()))
+	}
+	// like imaging, encode opaque NRGBA as RGBA, which the encoder reads faster
+	if nrgba, ok := img.(*image.NRGBA); ok && nrgba.Opaque() {
+		img = &image.RGBA{Pix: nrgba.Pix, Stride: nrgba.Stride, Rect: nrgba.Rect}
+	}
+	return jpeg444.Encode(w, img, t.quality())
+}
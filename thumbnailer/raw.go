@@ -0,0 +1,145 @@
+package thumbnailer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// rawExtensions lists the camera RAW formats, which are decoded through the
+// embedded JPEG preview extracted by exiftool or rendered by dcraw.
+var rawExtensions = map[string]bool{
+	".cr2": true,
+	".cr3": true,
+	".nef": true,
+	".arw": true,
+	".dng": true,
+	".raf": true,
+	".orf": true,
+	".rw2": true,
+}
+
+var (
+	// ErrRawToolMissing is returned when none of the external tools that
+	// decode RAW files is installed.
+	ErrRawToolMissing = errors.New("no RAW decoder found, install exiftool, dcraw or libraw (dcraw_emu)")
+	// ErrNoRawImage is returned for RAW files without an extractable image.
+	ErrNoRawImage = errors.New("file has no extractable image")
+)
+
+// IsRawFile reports whether file holds a camera RAW image, judged by its
+// content rather than its extension, see sniffFile.
+func IsRawFile(file string) bool {
+	return sniffFile(file) == kindRaw
+}
+
+// SetRawExtensions replaces the extensions treated as camera RAW, given with
+// or without the leading dot. It must not be called while images are decoded.
+func SetRawExtensions(exts []string) {
+	rawExtensions = make(map[string]bool, len(exts))
+	for _, ext := range exts {
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if ext != "" && !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		rawExtensions[ext] = true
+	}
+}
+
+// ReadRawImage decodes a RAW file. It extracts the embedded JPEG preview with
+// exiftool, trying -JpgFromRaw first and falling back to -PreviewImage, and
+// renders the sensor data with dcraw or libraw's dcraw_emu when there is no
+// preview. The external processes are killed when ctx is done.
+func ReadRawImage(ctx context.Context, file string) (image.Image, error) {
+	img, _, err := readRaw(ctx, file)
+	return img, err
+}
+
+// readRaw is ReadRawImage, also reporting whether the image is already
+// rotated upright, which is only the case for renders.
+func readRaw(ctx context.Context, file string) (image.Image, bool, error) {
+	_, lookErr := exec.LookPath("exiftool")
+	haveExiftool := lookErr == nil
+	if haveExiftool {
+		img, err := readRawPreview(ctx, file)
+		if err != nil || img != nil {
+			return img, false, err
+		}
+	}
+
+	tool, args := rawRenderer(file)
+	if tool == "" {
+		if haveExiftool {
+			return nil, false, fmt.Errorf("error decoding RAW file %s: no embedded preview and neither dcraw nor dcraw_emu is installed to render it: %w", file, ErrRawToolMissing)
+		}
+		return nil, false, fmt.Errorf("error decoding RAW file %s: %w", file, ErrRawToolMissing)
+	}
+
+	render, err := runTool(ctx, tool, args...)
+	if err != nil {
+		return nil, false, fmt.Errorf("error rendering RAW file %s: %w", file, err)
+	}
+	if len(render) == 0 {
+		return nil, false, fmt.Errorf("error decoding RAW file %s: %w", file, ErrNoRawImage)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(render))
+	if err != nil {
+		return nil, false, fmt.Errorf("error decoding render of RAW file %s: %v", file, err)
+	}
+	return img, true, nil
+}
+
+// readRawPreview extracts the embedded JPEG preview of a RAW file with
+// exiftool. It returns nil without an error when there is none.
+func readRawPreview(ctx context.Context, file string) (image.Image, error) {
+	for _, tag := range []string{"-JpgFromRaw", "-PreviewImage"} {
+		preview, err := runTool(ctx, "exiftool", "-b", tag, file)
+		if err != nil {
+			return nil, fmt.Errorf("error extracting preview from RAW file %s: %w", file, err)
+		}
+		if len(preview) == 0 {
+			continue
+		}
+
+		img, _, err := image.Decode(bytes.NewReader(preview))
+		if err != nil {
+			return nil, fmt.Errorf("error decoding preview from RAW file %s: %v", file, err)
+		}
+		return img, nil
+	}
+	return nil, nil
+}
+
+// rawRenderer returns the installed tool and its arguments that render file
+// as a half-size TIFF on stdout, or "" when neither dcraw nor dcraw_emu is
+// installed. Half size is plenty for thumbnails and much faster.
+func rawRenderer(file string) (string, []string) {
+	if _, err := exec.LookPath("dcraw"); err == nil {
+		return "dcraw", []string{"-c", "-w", "-h", "-T", file}
+	}
+	if _, err := exec.LookPath("dcraw_emu"); err == nil {
+		return "dcraw_emu", []string{"-w", "-h", "-T", "-Z", "-", file}
+	}
+	return "", nil
+}
+
+// rawOrientation reads the EXIF orientation of a RAW file, returning 1 (no
+// transformation) when it can't be determined.
+func rawOrientation(ctx context.Context, file string) int {
+	out, err := runTool(ctx, "exiftool", "-s3", "-n", "-Orientation", file)
+	if err != nil {
+		return 1
+	}
+
+	o, err := strconv.Atoi(strings.TrimSpace(string(out)))
+	if err != nil {
+		return 1
+	}
+	return o
+}
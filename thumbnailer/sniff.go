@@ -0,0 +1,214 @@
+package thumbnailer
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Decode paths chosen by sniffFile.
+const (
+	kindImage = "image" // decoded by image.Decode
+	kindRaw   = "raw"
+	kindHEIC  = "heic"
+	kindSVG   = "svg"
+	kindGIF   = "gif"
+	kindPDF   = "pdf"
+)
+
+// sniffSize is how much of a file sniffFile reads. It covers the first IFD of
+// TIFF-based RAW files, which is checked for the DNG version tag.
+const sniffSize = 4096
+
+// heicBrands are the ISO BMFF brands of HEIF images holding HEVC data.
+var heicBrands = map[string]bool{
+	"heic": true, "heix": true, "heim": true, "heis": true,
+	"hevc": true, "hevx": true, "hevm": true, "hevs": true,
+}
+
+// sniffFile picks the decode path of file from its content, so files with a
+// wrong or missing extension are decoded correctly. The extension only
+// decides for TIFF-based RAW formats without a signature of their own, such
+// as NEF and ARW, and for RAW formats that aren't recognized at all. When
+// file can't be read, the extension decides too and decoding reports the
+// error.
+func sniffFile(file string) string {
+	f, err := os.Open(file)
+	if err != nil {
+		return kindByExtension(file)
+	}
+	defer f.Close()
+
+	head := make([]byte, sniffSize)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return kindByExtension(file)
+	}
+	return sniffData(head[:n], file)
+}
+
+// sniffData is sniffFile for data, the content of a file named name that
+// isn't on disk, e.g. an entry of an archive.
+func sniffData(data []byte, name string) string {
+	return sniff(data[:min(len(data), sniffSize)], rawExtensions[strings.ToLower(filepath.Ext(name))])
+}
+
+// NeedsTools reports whether data, the content of a file named name, is a
+// RAW, HEIC or PDF file, which external tools decode from files on disk only.
+// The content decides, like DecodeFile.
+func NeedsTools(data []byte, name string) bool {
+	switch sniffData(data, name) {
+	case kindRaw, kindHEIC, kindPDF:
+		return true
+	}
+	return false
+}
+
+// IsSVGData reports whether data, the content of a file named name, is an
+// SVG document, like IsSVGFile does for files.
+func IsSVGData(data []byte, name string) bool {
+	return sniffData(data, name) == kindSVG
+}
+
+// IsImageFile reports whether the content of file is in one of the input
+// formats, recognized by its signature alone, for files whose extension
+// doesn't tell. It's false when file can't be read.
+func IsImageFile(file string) bool {
+	f, err := os.Open(file)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	head := make([]byte, sniffSize)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return false
+	}
+	return IsImageData(head[:n])
+}
+
+// IsImageData is IsImageFile for data, the content of a file that isn't on
+// disk.
+func IsImageData(data []byte) bool {
+	head := data[:min(len(data), sniffSize)]
+	if _, ok := sniffBMFF(head); ok {
+		return true
+	}
+	// anything else sniff doesn't recognize falls back to image.Decode
+	return sniff(head, false) != kindImage || isTIFF(head) || strings.HasPrefix(http.DetectContentType(head), "image/")
+}
+
+// sniff picks the decode path of data that starts with head. rawExt tells
+// whether the file has a camera RAW extension.
+func sniff(head []byte, rawExt bool) string {
+	if kind, ok := sniffBMFF(head); ok {
+		return kind
+	}
+
+	switch {
+	case bytes.HasPrefix(head, []byte("FUJIFILMCCD-RAW")),
+		len(head) >= 14 && string(head[6:14]) == "HEAPCCDR", // Canon CRW
+		bytes.HasPrefix(head, []byte("IIRO")), bytes.HasPrefix(head, []byte("IIRS")),
+		bytes.HasPrefix(head, []byte("MMOR")),    // Olympus ORF
+		bytes.HasPrefix(head, []byte("IIU\x00")): // Panasonic RW2
+		return kindRaw
+	case bytes.HasPrefix(head, []byte("II*\x00")), bytes.HasPrefix(head, []byte("MM\x00*")):
+		if isRawTIFF(head) || rawExt {
+			return kindRaw
+		}
+		return kindImage
+	case bytes.HasPrefix(head, []byte("%PDF-")):
+		return kindPDF
+	case isSVG(head):
+		return kindSVG
+	case isGIF(head):
+		return kindGIF
+	case strings.HasPrefix(http.DetectContentType(head), "image/"):
+		return kindImage
+	case rawExt:
+		return kindRaw
+	}
+	return kindImage
+}
+
+// sniffBMFF recognizes the ISO BMFF containers of Canon CR3 and HEIF files by
+// the brands of their leading ftyp box. AVIF, also HEIF, is decoded natively.
+func sniffBMFF(head []byte) (string, bool) {
+	if len(head) < 12 || string(head[4:8]) != "ftyp" {
+		return "", false
+	}
+
+	size := int(uint32(head[0])<<24 | uint32(head[1])<<16 | uint32(head[2])<<8 | uint32(head[3]))
+	if size < 16 || size > len(head) {
+		size = 16
+		if size > len(head) {
+			size = len(head)
+		}
+	}
+	// the major brand followed by the minor version and compatible brands
+	brands := []string{string(head[8:12])}
+	for i := 16; i+4 <= size; i += 4 {
+		brands = append(brands, string(head[i:i+4]))
+	}
+
+	switch major := brands[0]; {
+	case major == "crx ":
+		return kindRaw, true
+	case major == "avif" || major == "avis":
+		return kindImage, true
+	case heicBrands[major]:
+		return kindHEIC, true
+	}
+	// generic HEIF brands such as mif1 list the codec as a compatible brand
+	for _, brand := range brands[1:] {
+		if brand == "avif" || brand == "avis" {
+			return kindImage, true
+		}
+	}
+	for _, brand := range brands[1:] {
+		if heicBrands[brand] {
+			return kindHEIC, true
+		}
+	}
+	return "", false
+}
+
+// isRawTIFF reports whether the TIFF structure in head is a Canon CR2, marked
+// after the header, or a DNG, which has a DNGVersion tag in its first IFD.
+func isRawTIFF(head []byte) bool {
+	if len(head) >= 10 && string(head[8:10]) == "CR" {
+		return true
+	}
+	order, ifd0, ok := tiffOrder(head)
+	if !ok {
+		return false
+	}
+	for _, e := range ifdEntries(head, order, ifd0) {
+		if e.tag == 0xC612 {
+			return true
+		}
+	}
+	return false
+}
+
+// kindByExtension picks the decode path from the extension of file alone.
+func kindByExtension(file string) string {
+	ext := strings.ToLower(filepath.Ext(file))
+	switch {
+	case rawExtensions[ext]:
+		return kindRaw
+	case heicExtensions[ext]:
+		return kindHEIC
+	case ext == ".svg":
+		return kindSVG
+	case ext == ".gif":
+		return kindGIF
+	case ext == ".pdf":
+		return kindPDF
+	}
+	return kindImage
+}
@@ -0,0 +1,152 @@
+package thumbnailer
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// ftyp returns the head of an ISO BMFF file whose ftyp box has the major brand
+// major and the compatible brands.
+func ftyp(major string, compatible ...string) []byte {
+	box := make([]byte, 16)
+	binary.BigEndian.PutUint32(box, uint32(16+4*len(compatible)))
+	copy(box[4:], "ftyp")
+	copy(box[8:], major)
+	for _, brand := range compatible {
+		box = append(box, brand...)
+	}
+	return append(box, "\x00\x00\x00\x08mdat"...)
+}
+
+func TestSniff(t *testing.T) {
+	dng := []byte("II*\x00\x08\x00\x00\x00\x01\x00\x12\xc6\x01\x00\x04\x00\x00\x00\x01\x01\x00\x00\x00\x00\x00\x00")
+	tests := []struct {
+		name   string
+		head   []byte
+		rawExt bool
+		want   string
+	}{
+		{"JPEG", []byte("\xff\xd8\xff\xe0\x00\x10JFIF\x00"), false, kindImage},
+		{"PNG", []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"), false, kindImage},
+		{"GIF", []byte("GIF89a\x01\x00\x01\x00"), false, kindGIF},
+		{"SVG", []byte(`<?xml version="1.0"?>` + "\n" + `<svg xmlns="http://www.w3.org/2000/svg"/>`), false, kindSVG},
+		{"TIFF", []byte("II*\x00\x08\x00\x00\x00\x00\x00\x00\x00\x00\x00"), false, kindImage},
+		{"TIFF with a RAW extension", []byte("II*\x00\x08\x00\x00\x00\x00\x00\x00\x00\x00\x00"), true, kindRaw},
+		{"CR2", []byte("II*\x00\x10\x00\x00\x00CR\x02\x00\x00\x00\x00\x00"), false, kindRaw},
+		{"DNG", dng, false, kindRaw},
+		{"CR3", ftyp("crx ", "crx ", "isom"), false, kindRaw},
+		{"RAF", []byte("FUJIFILMCCD-RAW 0201"), false, kindRaw},
+		{"ORF", []byte("IIRO\x08\x00\x00\x00"), false, kindRaw},
+		{"RW2", []byte("IIU\x00\x08\x00\x00\x00"), false, kindRaw},
+		{"HEIC", ftyp("heic", "mif1", "heic"), false, kindHEIC},
+		{"HEIF listing HEVC", ftyp("mif1", "mif1", "heic"), false, kindHEIC},
+		{"AVIF", ftyp("avif", "avif", "mif1"), false, kindImage},
+		{"HEIF listing AVIF", ftyp("mif1", "mif1", "avif"), false, kindImage},
+		{"MP4", ftyp("isom", "isom", "mp41"), false, kindImage},
+		{"unknown with a RAW extension", []byte("\x00\x01\x02\x03"), true, kindRaw},
+		{"unknown", []byte("\x00\x01\x02\x03"), false, kindImage},
+		{"empty", nil, false, kindImage},
+	}
+	for _, tt := range tests {
+		if got := sniff(tt.head, tt.rawExt); got != tt.want {
+			t.Errorf("%s: sniff = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSniffFile(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		// the content decides, whatever the extension
+		"gif.jpg":  "GIF89a\x01\x00\x01\x00",
+		"png.gif":  "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR",
+		"svg":      `<svg xmlns="http://www.w3.org/2000/svg"/>`,
+		"heic.jpg": string(ftyp("heic", "mif1", "heic")),
+		"tiff.nef": "II*\x00\x08\x00\x00\x00\x00\x00\x00\x00\x00\x00",
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		file string
+		want string
+	}{
+		{"gif.jpg", kindGIF},
+		{"png.gif", kindImage},
+		{"svg", kindSVG},
+		{"heic.jpg", kindHEIC},
+		{"tiff.nef", kindRaw},
+		// files that can't be read go by their extension
+		{"missing.gif", kindGIF},
+		{"missing.heic", kindHEIC},
+		{"missing.nef", kindRaw},
+		{"missing.jpg", kindImage},
+	}
+	for _, tt := range tests {
+		if got := sniffFile(filepath.Join(dir, tt.file)); got != tt.want {
+			t.Errorf("sniffFile(%q) = %s, want %s", tt.file, got, tt.want)
+		}
+	}
+}
+
+func TestIsImageFile(t *testing.T) {
+	dir := t.TempDir()
+	var photo bytes.Buffer
+	if err := jpeg.Encode(&photo, image.NewRGBA(image.Rect(0, 0, 32, 24)), nil); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		"photo":  photo.Bytes(),
+		"gif":    []byte("GIF89a\x01\x00\x01\x00"),
+		"tiff":   []byte("II*\x00\x08\x00\x00\x00\x00\x00\x00\x00\x00\x00"),
+		"heic":   ftyp("heic", "mif1", "heic"),
+		"avif":   ftyp("avif", "avif", "mif1"),
+		"README": []byte("Holiday photos, sorted by day.\n"),
+		"mp4":    ftyp("isom", "isom", "mp41"),
+		"empty":  nil,
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		file string
+		want bool
+	}{
+		{"photo", true},
+		{"gif", true},
+		{"tiff", true},
+		{"heic", true},
+		{"avif", true},
+		{"README", false},
+		{"mp4", false},
+		{"empty", false},
+		{"missing", false},
+	}
+	for _, tt := range tests {
+		if got := IsImageFile(filepath.Join(dir, tt.file)); got != tt.want {
+			t.Errorf("IsImageFile(%q) = %v, want %v", tt.file, got, tt.want)
+		}
+	}
+
+	// an extensionless JPEG decodes like any other
+	th := Thumbnailer{AutoOrient: true}
+	img, err := th.DecodeFile(context.Background(), filepath.Join(dir, "photo"))
+	if err != nil {
+		t.Fatalf("DecodeFile of an extensionless JPEG: %v", err)
+	}
+	if b := img.Bounds(); b.Dx() != 32 || b.Dy() != 24 {
+		t.Errorf("decoded %dx%d, want 32x24", b.Dx(), b.Dy())
+	}
+}
@@ -0,0 +1,107 @@
+package thumbnailer
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/srwiley/oksvg"
+	"github.com/srwiley/rasterx"
+	"image"
+	"image/color"
+	"io"
+	"math"
+)
+
+func init() {
+	// registering SVG lets image.DecodeConfig report its size; Decode renders
+	// it at the thumbnail size instead of going through image.Decode
+	for _, magic := range []string{"<?xml", "<svg"} {
+		image.RegisterFormat("svg", magic, decodeSVG, decodeSVGConfig)
+	}
+}
+
+// IsSVGFile reports whether file holds an SVG document, judged by its content
+// rather than its extension, see sniffFile.
+func IsSVGFile(file string) bool {
+	return sniffFile(file) == kindSVG
+}
+
+// isSVG reports whether the start of data looks like an SVG document.
+func isSVG(data []byte) bool {
+	data = bytes.TrimSpace(data)
+	if !bytes.HasPrefix(data, []byte("<?xml")) && !bytes.HasPrefix(data, []byte("<svg")) {
+		return false
+	}
+	return bytes.Contains(data, []byte("<svg"))
+}
+
+// renderSVG renders the SVG document read from r directly at the thumbnail
+// size. SVGs are resolution-independent, so unlike raster images they are
+// scaled up as well as down to fill the box.
+func (t *Thumbnailer) renderSVG(r io.Reader) (image.Image, error) {
+	icon, err := oksvg.ReadIconStream(r, oksvg.IgnoreErrorMode)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing SVG: %v", err)
+	}
+	w, h := icon.ViewBox.W, icon.ViewBox.H
+	if w <= 0 || h <= 0 {
+		return nil, fmt.Errorf("error parsing SVG: missing width, height or viewBox")
+	}
+
+	// with Scale and MaxOutPixels the render stays at the intrinsic size,
+	// Resize scales it;
+	// with Zoom and Aspect the part left after Resize crops it is sized to fit
+	zw, zh := t.zoomCrop(w, h)
+	cw, ch := t.aspectCrop(zw, zh)
+	scale := 1.0
+	switch {
+	case t.Scale > 0, t.MaxOutPixels > 0:
+	case t.Width > 0 && t.Height > 0 && t.Mode == ModeFill && t.Aspect == 0:
+		scale = math.Max(float64(t.Width)/zw, float64(t.Height)/zh)
+	case t.Width > 0 && t.Height > 0:
+		scale = math.Min(float64(t.Width)/cw, float64(t.Height)/ch)
+	case t.Width > 0:
+		scale = float64(t.Width) / cw
+	case t.Height > 0:
+		scale = float64(t.Height) / ch
+	}
+	if t.NoUpscale && scale > 1 {
+		scale = 1
+	}
+	return rasterizeSVG(icon, int(math.Max(1, math.Round(w*scale))), int(math.Max(1, math.Round(h*scale)))), nil
+}
+
+// rasterizeSVG draws icon onto a transparent w x h canvas.
+func rasterizeSVG(icon *oksvg.SvgIcon, w, h int) image.Image {
+	icon.SetTarget(0, 0, float64(w), float64(h))
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	scanner := rasterx.NewScannerGV(w, h, img, img.Bounds())
+	icon.Draw(rasterx.NewDasher(w, h, scanner), 1)
+	return img
+}
+
+// decodeSVG renders an SVG at its intrinsic size, for image.Decode.
+func decodeSVG(r io.Reader) (image.Image, error) {
+	icon, err := oksvg.ReadIconStream(r, oksvg.IgnoreErrorMode)
+	if err != nil {
+		return nil, err
+	}
+	cfg := svgConfig(icon)
+	return rasterizeSVG(icon, cfg.Width, cfg.Height), nil
+}
+
+// decodeSVGConfig returns the intrinsic size of an SVG, for image.DecodeConfig.
+func decodeSVGConfig(r io.Reader) (image.Config, error) {
+	icon, err := oksvg.ReadIconStream(r, oksvg.IgnoreErrorMode)
+	if err != nil {
+		return image.Config{}, err
+	}
+	return svgConfig(icon), nil
+}
+
+func svgConfig(icon *oksvg.SvgIcon) image.Config {
+	return image.Config{
+		ColorModel: color.RGBAModel,
+		Width:      int(math.Max(1, math.Round(icon.ViewBox.W))),
+		Height:     int(math.Max(1, math.Round(icon.ViewBox.H))),
+	}
+}
@@ -0,0 +1,54 @@
+package thumbnailer
+
+import (
+	"bytes"
+	"image"
+	"io"
+)
+
+// maxTargetSizeSteps caps the encodes tried by EncodeTargetSize. Seven steps
+// of the binary search cover the full 1-100 quality range.
+const maxTargetSizeSteps = 7
+
+// SupportsTargetSize reports whether TargetBytes applies to format, which
+// must have a quality setting.
+func SupportsTargetSize(format string) bool {
+	return format == "jpeg" || format == "webp"
+}
+
+// EncodeTargetSize encodes img like EncodeWithMetadata, at the highest
+// quality whose output fits in TargetBytes. The quality is binary searched
+// by encoding to memory; when even the lowest quality is too large, that
+// output is written anyway. It returns the quality used.
+func (t *Thumbnailer) EncodeTargetSize(w io.Writer, img image.Image, exif []byte) (int, error) {
+	trial := *t
+	trial.FormatQuality = nil
+	var best []byte
+	quality := 0
+	low, high := 1, 100
+	for step := 0; step < maxTargetSizeSteps && low <= high; step++ {
+		trial.Quality = (low + high) / 2
+		var buf bytes.Buffer
+		if err := trial.EncodeWithMetadata(&buf, img, exif); err != nil {
+			return 0, err
+		}
+		if int64(buf.Len()) <= t.TargetBytes {
+			best, quality = buf.Bytes(), trial.Quality
+			low = trial.Quality + 1
+		} else {
+			high = trial.Quality - 1
+		}
+	}
+
+	if best == nil {
+		trial.Quality = 1
+		var buf bytes.Buffer
+		if err := trial.EncodeWithMetadata(&buf, img, exif); err != nil {
+			return 0, err
+		}
+		best, quality = buf.Bytes(), trial.Quality
+	}
+
+	_, err := w.Write(best)
+	return quality, err
+}
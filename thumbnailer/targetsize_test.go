@@ -0,0 +1,112 @@
+package thumbnailer
+
+import (
+	"bytes"
+	"image"
+	"testing"
+)
+
+// noise returns a w x h image of pseudo-random pixels, which compress
+// differently at every quality.
+func noise(w, h int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	v := uint32(1)
+	for i := range img.Pix {
+		v = v*1664525 + 1013904223
+		img.Pix[i] = byte(v >> 24)
+		if i%4 == 3 {
+			img.Pix[i] = 0xff
+		}
+	}
+	return img
+}
+
+// encodedSize returns the size of img encoded by th at quality.
+func encodedSize(t *testing.T, th Thumbnailer, img image.Image, quality int) int64 {
+	t.Helper()
+	th.Quality = quality
+	th.FormatQuality = nil
+	var buf bytes.Buffer
+	if err := th.EncodeWithMetadata(&buf, img, nil); err != nil {
+		t.Fatalf("encoding at quality %d: %v", quality, err)
+	}
+	return int64(buf.Len())
+}
+
+func TestEncodeTargetSize(t *testing.T) {
+	img := noise(120, 90)
+	for _, format := range []string{"jpeg", "webp"} {
+		th := Thumbnailer{Format: format}
+		tests := []struct {
+			name string
+			// the target is bytes plus the size of the output at quality,
+			// if set
+			quality     int
+			bytes       int64
+			wantQuality int
+		}{
+			{name: "everything fits", bytes: 1 << 30, wantQuality: 100},
+			{name: "nothing fits", bytes: 10, wantQuality: 1},
+			{name: "exactly the size of quality 50", quality: 50},
+			{name: "exactly the size of quality 80", quality: 80},
+			{name: "just below the size of quality 30", quality: 30, bytes: -1},
+		}
+		for _, tt := range tests {
+			t.Run(format+" "+tt.name, func(t *testing.T) {
+				th := th
+				th.TargetBytes = tt.bytes
+				if tt.quality > 0 {
+					th.TargetBytes += encodedSize(t, th, img, tt.quality)
+				}
+				// the quality configured for the format is ignored
+				th.Quality = 90
+				th.FormatQuality = map[string]int{format: 95}
+
+				var buf bytes.Buffer
+				quality, err := th.EncodeTargetSize(&buf, img, nil)
+				if err != nil {
+					t.Fatalf("EncodeTargetSize: %v", err)
+				}
+				if got := encodedSize(t, th, img, quality); got != int64(buf.Len()) {
+					t.Errorf("wrote %d bytes, quality %d encodes to %d", buf.Len(), quality, got)
+				}
+				if tt.wantQuality > 0 && quality != tt.wantQuality {
+					t.Errorf("quality %d, want %d", quality, tt.wantQuality)
+				}
+				if quality > 1 && int64(buf.Len()) > th.TargetBytes {
+					t.Errorf("wrote %d bytes, more than the target %d", buf.Len(), th.TargetBytes)
+				}
+				// the binary search covers every quality, the next one up
+				// doesn't fit
+				if quality < 100 && quality > 1 && encodedSize(t, th, img, quality+1) <= th.TargetBytes {
+					t.Errorf("quality %d fits %d bytes too", quality+1, th.TargetBytes)
+				}
+				switch {
+				case tt.bytes < 0 && quality >= tt.quality:
+					t.Errorf("quality %d, want below %d", quality, tt.quality)
+				case tt.bytes == 0 && quality < tt.quality:
+					t.Errorf("quality %d, want at least %d", quality, tt.quality)
+				}
+			})
+		}
+	}
+}
+
+func TestSupportsTargetSize(t *testing.T) {
+	tests := []struct {
+		format string
+		want   bool
+	}{
+		{"jpeg", true},
+		{"webp", true},
+		{"png", false},
+		{"gif", false},
+		{"avif", false},
+		{"bmp", false},
+	}
+	for _, tt := range tests {
+		if got := SupportsTargetSize(tt.format); got != tt.want {
+			t.Errorf("SupportsTargetSize(%q) = %v, want %v", tt.format, got, tt.want)
+		}
+	}
+}
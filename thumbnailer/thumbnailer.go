@@ -0,0 +1,608 @@
+// Package thumbnailer decodes images, resizes them into thumbnails and
+// encodes the result. It is the core used by the thumbnailer command and can
+// be used in-process without touching the filesystem.
+package thumbnailer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/disintegration/imaging"
+	"github.com/gen2brain/avif"
+	"github.com/gen2brain/webp"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// formats maps the supported output formats to their MIME type.
+var formats = map[string]string{
+	"jpeg": "image/jpeg",
+	"png":  "image/png",
+	"apng": "image/apng",
+	"gif":  "image/gif",
+	"bmp":  "image/bmp",
+	"tiff": "image/tiff",
+	"webp": "image/webp",
+	"avif": "image/avif",
+}
+
+// inputExtensions lists the extensions of the formats Decode handles, those
+// needing external tools are added by InputExtensions.
+var inputExtensions = []string{".jpg", ".jpeg", ".png", ".gif", ".bmp", ".tif", ".tiff", ".webp", ".avif", ".svg"}
+
+// InputExtensions returns the lowercase file extensions, including the dot,
+// of all formats that DecodeFile can read.
+func InputExtensions() []string {
+	exts := append([]string(nil), inputExtensions...)
+	for ext := range rawExtensions {
+		exts = append(exts, ext)
+	}
+	for ext := range heicExtensions {
+		exts = append(exts, ext)
+	}
+	exts = append(exts, ".pdf")
+	sort.Strings(exts)
+	return exts
+}
+
+// Extension returns the file name extension, without the dot, of thumbnails
+// in format: the format itself, except png for apng.
+func Extension(format string) string {
+	if format == "apng" {
+		return "png"
+	}
+	return format
+}
+
+// SupportedFormat reports whether format can be used as an output format.
+func SupportedFormat(format string) bool {
+	return formats[format] != ""
+}
+
+// SupportsQuality reports whether format has a quality setting, for
+// Quality and FormatQuality.
+func SupportsQuality(format string) bool {
+	return format == "jpeg" || format == "webp" || format == "avif"
+}
+
+// ContentType returns the MIME type of an output format, or
+// application/octet-stream for unsupported formats.
+func ContentType(format string) string {
+	if t, ok := formats[format]; ok {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+// pngCompressionLevels maps the names accepted by ParsePNGCompression to
+// compression levels.
+var pngCompressionLevels = map[string]png.CompressionLevel{
+	"default":          png.DefaultCompression,
+	"best-speed":       png.BestSpeed,
+	"best-compression": png.BestCompression,
+	"no-compression":   png.NoCompression,
+}
+
+// ParsePNGCompression returns the PNG compression level named name, one of
+// default, best-speed, best-compression and no-compression.
+func ParsePNGCompression(name string) (png.CompressionLevel, error) {
+	level, ok := pngCompressionLevels[name]
+	if !ok {
+		return 0, fmt.Errorf("unsupported PNG compression level: %s", name)
+	}
+	return level, nil
+}
+
+// filters maps the names accepted in Thumbnailer.Filter to resample filters.
+var filters = map[string]imaging.ResampleFilter{
+	"lanczos":    imaging.Lanczos,
+	"catmullrom": imaging.CatmullRom,
+	"mitchell":   imaging.MitchellNetravali,
+	"linear":     imaging.Linear,
+	"box":        imaging.Box,
+	"nearest":    imaging.NearestNeighbor,
+}
+
+// SupportedFilter reports whether name can be used as Thumbnailer.Filter.
+func SupportedFilter(name string) bool {
+	_, ok := filters[name]
+	return ok
+}
+
+// Resize modes.
+const (
+	// ModeFit scales the image to fit inside the Width x Height box.
+	ModeFit = "fit"
+	// ModeFill scales and center-crops the image to exactly Width x Height.
+	ModeFill = "fill"
+	// ModePad fits the image inside the Width x Height box like ModeFit and
+	// centers it on a canvas of exactly that size filled with Background, or
+	// transparent without one.
+	ModePad = "pad"
+)
+
+// Thumbnailer holds the options used to create a thumbnail. When both Width
+// and Height are set the image is fitted inside the Width x Height box, or
+// cropped to it in ModeFill. Without Width, Height, Scale and MaxOutPixels
+// images keep their size and are only re-encoded.
+type Thumbnailer struct {
+	Width  int
+	Height int
+	// Scale resizes images by a factor of their own size instead of to Width
+	// and Height, e.g. 0.5 for half size. 0 disables it.
+	Scale  float64
+	Format string
+	// MaxOutPixels resizes images to the largest size of at most this many
+	// pixels (width x height) that keeps their aspect ratio, instead of to
+	// Width and Height. Smaller images keep their size, 0 disables it.
+	MaxOutPixels int64
+	// Quality is the JPEG, WebP and AVIF quality (1-100).
+	Quality int
+	// FormatQuality overrides Quality for the formats it lists, e.g. to give
+	// AVIF a lower quality than JPEG for a similar look.
+	FormatQuality map[string]int
+	// TargetBytes makes Process pick the JPEG or WebP quality that keeps
+	// thumbnails just under this size instead of using Quality, see
+	// EncodeTargetSize. 0 disables it.
+	TargetBytes int64
+	// Progressive writes progressive JPEGs, which needs jpegtran.
+	Progressive bool
+	// NoSubsampling writes JPEGs with full-resolution chroma (4:4:4) instead
+	// of 4:2:0, for sharp colored edges and text at the cost of size.
+	NoSubsampling bool
+	// PNGCompression is the compression level of PNG output.
+	PNGCompression png.CompressionLevel
+	// Palette quantizes PNG output to an indexed image of at most this many
+	// colors (2-256), much smaller for icons and logos, 0 keeps full color.
+	// Other formats ignore it.
+	Palette int
+	// Mode is ModeFit, ModeFill or ModePad. ModeFill and ModePad require both
+	// Width and Height.
+	Mode string
+	// Aspect center-crops sources to this ratio of width to height before
+	// resizing, 0 disables it. The crop replaces the one of ModeFill, the
+	// cropped image is always fitted inside Width x Height.
+	Aspect float64
+	// Zoom center-crops sources to this share of their width and height
+	// before the Aspect crop and resizing, e.g. 0.8 to punch in on the
+	// middle. 0 and 1 keep the whole frame.
+	Zoom float64
+	// Filter is the resample filter: lanczos (the default when empty),
+	// catmullrom, mitchell, linear, box or nearest.
+	Filter string
+	// AutoOrient rotates and flips images according to their EXIF
+	// orientation before resizing.
+	AutoOrient bool
+	// Metadata is MetadataStrip or MetadataKeep.
+	Metadata string
+	// StripGPS removes GPS tags from metadata kept with MetadataKeep.
+	StripGPS bool
+	// ICC is an ICC color profile embedded into JPEG and PNG output, usually
+	// the one of the source read with ReadICC. Profiles of other color spaces
+	// than RGB are not embedded.
+	ICC []byte
+	// PreserveICC makes Process embed the ICC profile of its source.
+	PreserveICC bool
+	// Page is the 1-based page decoded from multi-page TIFFs and PDFs, 0
+	// means the first page.
+	Page int
+	// Background is composited under transparent areas. Formats without alpha
+	// (jpeg, bmp) use white when it's nil; others keep their transparency.
+	Background color.Color
+	// NoUpscale leaves images that are smaller than the requested size at
+	// their own size instead of enlarging them.
+	NoUpscale bool
+	// Sharpen is the sigma of the sharpening applied after downscaling, 0
+	// disables it.
+	Sharpen float64
+	// Contrast changes the contrast of thumbnails by a percentage between
+	// -100 and 100, 0 leaves it unchanged.
+	Contrast float64
+	// Grayscale converts thumbnails to grayscale.
+	Grayscale bool
+	// Sepia gives thumbnails a sepia tone.
+	Sepia bool
+	// MaxPixels rejects sources whose header declares more pixels than this
+	// with ErrTooManyPixels, before decoding them. 0 disables it.
+	MaxPixels int64
+	// Watermark is overlaid on thumbnails after resizing and padding, nil
+	// for none.
+	Watermark *Watermark
+	// Caption is drawn onto thumbnails after the watermark, nil for none.
+	Caption *Caption
+}
+
+// Process decodes an image from r, resizes it and writes the encoded
+// thumbnail to w. An animated GIF keeps all its frames when Format is gif, webp
+// or apng, see AnimatedFormat.
+func (t *Thumbnailer) Process(r io.Reader, w io.Writer) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("error reading image: %v", err)
+	}
+
+	if err := t.checkPixels(data); err != nil {
+		return err
+	}
+	if AnimatedFormat(t.Format) && isGIF(data) {
+		if g, _ := decodeAnimation(bytes.NewReader(data)); g != nil {
+			return t.EncodeAnimation(w, t.ResizeAnimation(g))
+		}
+	}
+
+	var exif []byte
+	if t.Metadata == MetadataKeep {
+		if exif, err = ReadExif(bytes.NewReader(data)); err != nil {
+			return err
+		}
+	}
+	if t.PreserveICC {
+		withICC := *t
+		if withICC.ICC, err = ReadICC(bytes.NewReader(data)); err != nil {
+			return err
+		}
+		t = &withICC
+	}
+
+	img, err := t.Decode(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if t.TargetBytes > 0 && SupportsTargetSize(t.Format) {
+		_, err = t.EncodeTargetSize(w, t.Resize(img), exif)
+		return err
+	}
+	return t.EncodeWithMetadata(w, t.Resize(img), exif)
+}
+
+// Decode decodes an image in any of the registered formats.
+func (t *Thumbnailer) Decode(r io.Reader) (image.Image, error) {
+	img, err := t.decode(r)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding image: %v", err)
+	}
+	return img, nil
+}
+
+// DecodeFile decodes the image stored in file, choosing the decoder by the
+// content rather than the extension. RAW files are decoded through their
+// embedded preview or a render, see ReadRawImage, HEIC files are converted
+// with ReadHEICImage and PDF pages are rendered with ReadPDFImage; ctx bounds
+// the external tools.
+func (t *Thumbnailer) DecodeFile(ctx context.Context, file string) (image.Image, error) {
+	switch sniffFile(file) {
+	case kindHEIC:
+		return ReadHEICImage(ctx, file)
+	case kindPDF:
+		return ReadPDFImage(ctx, file, t.Page)
+	case kindRaw:
+		img, upright, err := readRaw(ctx, file)
+		if err != nil || upright || !t.AutoOrient {
+			return img, err
+		}
+		// the extracted preview carries no EXIF, the orientation is in the RAW
+		return orient(img, rawOrientation(ctx, file)), nil
+	}
+
+	imgFile, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("error opening image file %s: %w", file, err)
+	}
+	defer imgFile.Close()
+
+	img, err := t.decode(imgFile)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding image file %s: %w", file, err)
+	}
+	return img, nil
+}
+
+func (t *Thumbnailer) decode(r io.Reader) (image.Image, error) {
+	br := bufio.NewReader(r)
+	if head, _ := br.Peek(512); isSVG(head) {
+		return t.renderSVG(br)
+	}
+
+	r, err := t.pageReader(br)
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.checkPixels(data); err != nil {
+		return nil, err
+	}
+	if isTIFF(data) {
+		if img, ok, err := decodeTIFFParallel(data); ok {
+			return img, err
+		}
+	}
+
+	img, err := imaging.Decode(bytes.NewReader(data), imaging.AutoOrientation(t.AutoOrient))
+	if isUnmarkedCMYK(err) {
+		return decodeUnmarkedCMYK(data, t.AutoOrient)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return toRGB(img), nil
+}
+
+// orient applies the EXIF orientation o (1-8) to img.
+func orient(img image.Image, o int) image.Image {
+	switch o {
+	case 2:
+		return imaging.FlipH(img)
+	case 3:
+		return imaging.Rotate180(img)
+	case 4:
+		return imaging.FlipV(img)
+	case 5:
+		return imaging.Transpose(img)
+	case 6:
+		return imaging.Rotate270(img)
+	case 7:
+		return imaging.Transverse(img)
+	case 8:
+		return imaging.Rotate90(img)
+	}
+	return img
+}
+
+// Resize zooms into img and crops it to the configured aspect ratio, scales
+// it down to the configured width and height and applies the configured
+// adjustments, the watermark and the caption to the result.
+func (t *Thumbnailer) Resize(img image.Image) image.Image {
+	return t.caption(t.watermark(t.pad(t.adjust(t.scale(t.cropAspect(t.cropZoom(img)))))))
+}
+
+// pad centers img on a Width x Height canvas in ModePad. The padding is added
+// after the adjustments, so it keeps the Background color.
+func (t *Thumbnailer) pad(img image.Image) image.Image {
+	if t.Mode != ModePad || t.Width <= 0 || t.Height <= 0 {
+		return img
+	}
+	if b := img.Bounds(); b.Dx() == t.Width && b.Dy() == t.Height {
+		return img
+	}
+
+	var bg color.Color = color.Transparent
+	if t.Background != nil {
+		bg = t.Background
+	}
+	return imaging.PasteCenter(imaging.New(t.Width, t.Height, bg), img)
+}
+
+func (t *Thumbnailer) scale(img image.Image) image.Image {
+	filter, ok := filters[t.Filter]
+	if !ok {
+		filter = imaging.Lanczos
+	}
+
+	if t.NoUpscale && t.Mode != ModePad {
+		w, h := img.Bounds().Dx(), img.Bounds().Dy()
+		if tw, th := t.targetSize(w, h); tw > w || th > h {
+			return img
+		}
+	}
+	if t.Scale > 0 || t.MaxOutPixels > 0 {
+		// img is already cropped to Zoom and Aspect
+		w, h := t.targetSize(img.Bounds().Dx(), img.Bounds().Dy())
+		return imaging.Resize(img, w, h, filter)
+	}
+	if t.Width == 0 && t.Height == 0 {
+		return img
+	}
+	if t.Mode == ModeFill && t.Aspect == 0 && t.Width > 0 && t.Height > 0 {
+		return imaging.Fill(img, t.Width, t.Height, imaging.Center, filter)
+	}
+	if t.Width > 0 && t.Height > 0 {
+		return imaging.Fit(img, t.Width, t.Height, filter)
+	}
+	// a zero dimension keeps the aspect ratio
+	return imaging.Resize(img, t.Width, t.Height, filter)
+}
+
+// encodeAVIF writes img to w as lossy AVIF. The encoder runs libavif, either
+// the system library or a bundled WebAssembly build, and panics when neither
+// can be loaded, which is turned into an error here.
+func encodeAVIF(w io.Writer, img image.Image, quality int) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("AVIF encoder unavailable: %v", r)
+		}
+	}()
+	return avif.Encode(w, img, avif.Options{
+		Quality:           quality,
+		QualityAlpha:      quality,
+		Speed:             avif.DefaultSpeed,
+		ChromaSubsampling: image.YCbCrSubsampleRatio420,
+	})
+}
+
+// adjust applies the sharpening, contrast, grayscale and sepia adjustments to
+// img.
+func (t *Thumbnailer) adjust(img image.Image) image.Image {
+	if t.Sharpen > 0 {
+		img = imaging.Sharpen(img, t.Sharpen)
+	}
+	if t.Contrast != 0 {
+		img = imaging.AdjustContrast(img, t.Contrast)
+	}
+	if t.Grayscale {
+		img = imaging.Grayscale(img)
+	}
+	if t.Sepia {
+		img = imaging.AdjustFunc(img, sepia)
+	}
+	return img
+}
+
+// sepia tones c with the usual sepia weights.
+func sepia(c color.NRGBA) color.NRGBA {
+	r, g, b := float64(c.R), float64(c.G), float64(c.B)
+	return color.NRGBA{
+		R: uint8(math.Min(255, 0.393*r+0.769*g+0.189*b)),
+		G: uint8(math.Min(255, 0.349*r+0.686*g+0.168*b)),
+		B: uint8(math.Min(255, 0.272*r+0.534*g+0.131*b)),
+		A: c.A,
+	}
+}
+
+// formatHasAlpha reports whether format can store transparency.
+func formatHasAlpha(format string) bool {
+	return format != "jpeg" && format != "bmp"
+}
+
+// flattenAlpha composites img onto a solid bg.
+func flattenAlpha(img image.Image, bg color.Color) image.Image {
+	b := img.Bounds()
+	dst := image.NewRGBA(b)
+	draw.Draw(dst, b, &image.Uniform{C: bg}, image.Point{}, draw.Src)
+	draw.Draw(dst, b, img, b.Min, draw.Over)
+	return dst
+}
+
+// ParseColor parses a hex color like #fff, #ffffff or #ffffff80, the leading
+// # is optional.
+func ParseColor(s string) (color.Color, error) {
+	hex := strings.TrimPrefix(s, "#")
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	if len(hex) == 6 {
+		hex += "ff"
+	}
+
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil || len(hex) != 8 {
+		return nil, fmt.Errorf("invalid color: %s", s)
+	}
+	// non-premultiplied, the alpha only affects how the color itself is blended
+	return color.NRGBA{R: uint8(v >> 24), G: uint8(v >> 16), B: uint8(v >> 8), A: uint8(v)}, nil
+}
+
+// TargetSize returns the dimensions Resize produces for a w x h source.
+func (t *Thumbnailer) TargetSize(w, h int) (int, int) {
+	if w > 0 && h > 0 {
+		w, h = t.aspectSize(t.zoomSize(w, h))
+	}
+	tw, th := t.targetSize(w, h)
+	if t.NoUpscale && t.Mode != ModePad && (tw > w || th > h) {
+		return w, h
+	}
+	return tw, th
+}
+
+func (t *Thumbnailer) targetSize(w, h int) (int, int) {
+	if w <= 0 || h <= 0 {
+		return 0, 0
+	}
+	if t.Scale == 0 && t.MaxOutPixels == 0 && t.Width == 0 && t.Height == 0 {
+		return w, h
+	}
+
+	if t.Scale > 0 {
+		return int(math.Max(1, math.Round(float64(w)*t.Scale))), int(math.Max(1, math.Round(float64(h)*t.Scale)))
+	}
+	if t.MaxOutPixels > 0 {
+		if int64(w)*int64(h) <= t.MaxOutPixels {
+			return w, h
+		}
+		// rounding down keeps the product within the limit
+		f := math.Sqrt(float64(t.MaxOutPixels) / (float64(w) * float64(h)))
+		return int(math.Max(1, math.Floor(float64(w)*f))), int(math.Max(1, math.Floor(float64(h)*f)))
+	}
+	if (t.Mode == ModeFill && t.Aspect == 0 || t.Mode == ModePad) && t.Width > 0 && t.Height > 0 {
+		return t.Width, t.Height
+	}
+	if t.Width > 0 && t.Height > 0 {
+		// imaging.Fit never upscales
+		if w <= t.Width && h <= t.Height {
+			return w, h
+		}
+		if float64(w)/float64(h) > float64(t.Width)/float64(t.Height) {
+			return t.Width, int(float64(t.Width) * float64(h) / float64(w))
+		}
+		return int(float64(t.Height) * float64(w) / float64(h)), t.Height
+	}
+
+	// same rounding as imaging.Resize
+	if t.Width > 0 {
+		return t.Width, int(math.Max(1, math.Floor(float64(t.Width)*float64(h)/float64(w)+0.5)))
+	}
+	return int(math.Max(1, math.Floor(float64(t.Height)*float64(w)/float64(h)+0.5))), t.Height
+}
+
+// Encode writes img to w in the configured format.
+func (t *Thumbnailer) Encode(w io.Writer, img image.Image) error {
+	if !t.embedsICC() {
+		return t.encode(w, img)
+	}
+
+	var buf bytes.Buffer
+	if err := t.encode(&buf, img); err != nil {
+		return err
+	}
+	data, err := embedICC(t.Format, buf.Bytes(), t.ICC)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func (t *Thumbnailer) encode(w io.Writer, img image.Image) error {
+	if bg := t.Background; bg != nil || !formatHasAlpha(t.Format) {
+		if bg == nil {
+			bg = color.White
+		}
+		img = flattenAlpha(img, bg)
+	}
+
+	switch t.Format {
+	case "jpeg":
+		if t.Progressive {
+			return t.encodeProgressiveJPEG(w, img)
+		}
+		return t.encodeBaselineJPEG(w, img)
+	case "png", "apng":
+		// an APNG of one frame is a plain PNG
+		if t.Palette > 0 {
+			img = quantize(img, t.Palette)
+		}
+		return imaging.Encode(w, img, imaging.PNG, imaging.PNGCompressionLevel(t.PNGCompression))
+	case "gif":
+		return imaging.Encode(w, img, imaging.GIF)
+	case "bmp":
+		return imaging.Encode(w, img, imaging.BMP)
+	case "tiff":
+		return imaging.Encode(w, img, imaging.TIFF)
+	case "webp":
+		// lossy WebP, using the quality like JPEG does
+		return webp.Encode(w, img, webp.Options{Quality: t.quality(), Method: webp.DefaultMethod})
+	case "avif":
+		return encodeAVIF(w, img, t.quality())
+	default:
+		return fmt.Errorf("unsupported output format: %s", t.Format)
+	}
+}
+
+// quality returns the quality Format is encoded with.
+func (t *Thumbnailer) quality() int {
+	if q, ok := t.FormatQuality[t.Format]; ok {
+		return q
+	}
+	return t.Quality
+}
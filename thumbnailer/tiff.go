@@ -0,0 +1,61 @@
+package thumbnailer
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// isTIFF reports whether data starts with a TIFF header.
+func isTIFF(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("II*\x00")) || bytes.HasPrefix(data, []byte("MM\x00*"))
+}
+
+// selectTIFFPage returns a copy of a multi-page TIFF whose header points at
+// the 1-based page, so decoders that only read the first page decode it.
+func selectTIFFPage(data []byte, page int) ([]byte, error) {
+	order, offset, ok := tiffOrder(data)
+	if !ok {
+		return nil, fmt.Errorf("invalid TIFF header")
+	}
+
+	for i := 1; i < page; i++ {
+		if offset < 8 || offset+2 > len(data) {
+			return nil, fmt.Errorf("TIFF has only %d pages", i-1)
+		}
+		next := offset + 2 + 12*int(order.Uint16(data[offset:]))
+		if next+4 > len(data) {
+			return nil, fmt.Errorf("invalid TIFF directory at offset %d", offset)
+		}
+		offset = int(order.Uint32(data[next:]))
+		if offset == 0 {
+			return nil, fmt.Errorf("TIFF has only %d pages", i)
+		}
+	}
+
+	data = append([]byte(nil), data...)
+	order.PutUint32(data[4:8], uint32(offset))
+	return data, nil
+}
+
+// pageReader returns a reader for the configured page of r when it is a TIFF
+// and a page other than the first is selected, and r unchanged otherwise.
+func (t *Thumbnailer) pageReader(r io.Reader) (io.Reader, error) {
+	if t.Page <= 1 {
+		return r, nil
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if !isTIFF(data) {
+		return bytes.NewReader(data), nil
+	}
+
+	data, err = selectTIFFPage(data, t.Page)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(data), nil
+}
@@ -0,0 +1,363 @@
+package thumbnailer
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"golang.org/x/image/tiff"
+	"image"
+	"io"
+	"slices"
+	"testing"
+)
+
+// testTIFF is a page of a TIFF written by buildTIFF, 8 bits per sample, with
+// the pixels of testSample.
+type testTIFF struct {
+	width, height int
+	// samples is 1 for gray, 3 for RGB and 4 for RGBA
+	samples int
+	// extra is the ExtraSamples value of RGBA, 1 for associated and 2 for
+	// unassociated alpha
+	extra       uint32
+	compression uint32
+	predictor   uint32
+	// rowsPerStrip splits the pixels in strips, unless tileWidth and
+	// tileLength split them in tiles
+	rowsPerStrip          int
+	tileWidth, tileLength int
+	// tags replace the values buildTIFF writes, nil removes the tag
+	tags map[uint16][]uint32
+}
+
+// tiffLongTags are written as LONG by buildTIFF, all other tags as SHORT.
+var tiffLongTags = map[uint16]bool{
+	tagImageWidth: true, tagImageLength: true, tagRowsPerStrip: true, tagStripOffsets: true,
+	tagStripByteCounts: true, tagTileWidth: true, tagTileLength: true, tagTileOffsets: true, tagTileByteCounts: true,
+}
+
+// testSample returns sample s of pixel x, y of the TIFFs of buildTIFF.
+func testSample(x, y, s int) byte {
+	return byte(x*7 + y*13 + s*61)
+}
+
+// buildTIFF returns a TIFF of pages in byte order order.
+func buildTIFF(order binary.ByteOrder, pages ...testTIFF) []byte {
+	out := []byte("II*\x00\x00\x00\x00\x00")
+	if order == binary.BigEndian {
+		out = []byte("MM\x00*\x00\x00\x00\x00")
+	}
+	put16 := func(b []byte, v uint16) []byte {
+		b = append(b, 0, 0)
+		order.PutUint16(b[len(b)-2:], v)
+		return b
+	}
+	put32 := func(b []byte, v uint32) []byte {
+		b = append(b, 0, 0, 0, 0)
+		order.PutUint32(b[len(b)-4:], v)
+		return b
+	}
+
+	// next is where the offset of the next IFD goes
+	next := 4
+	for _, p := range pages {
+		var offsets, counts []uint32
+		for _, chunk := range p.chunks() {
+			offsets = append(offsets, uint32(len(out)))
+			counts = append(counts, uint32(len(chunk)))
+			out = append(out, chunk...)
+		}
+		tags := p.tagValues(offsets, counts)
+		keys := make([]uint16, 0, len(tags))
+		for tag := range tags {
+			keys = append(keys, tag)
+		}
+		slices.Sort(keys)
+
+		if len(out)%2 == 1 {
+			out = append(out, 0)
+		}
+		order.PutUint32(out[next:], uint32(len(out)))
+		// values of more than 4 bytes follow the IFD
+		valuesStart := len(out) + 2 + 12*len(keys) + 4
+		var values []byte
+		out = put16(out, uint16(len(keys)))
+		for _, tag := range keys {
+			var typ uint16 = 3
+			var data []byte
+			for _, v := range tags[tag] {
+				if tiffLongTags[tag] {
+					data = put32(data, v)
+				} else {
+					data = put16(data, uint16(v))
+				}
+			}
+			if tiffLongTags[tag] {
+				typ = 4
+			}
+			out = put16(out, tag)
+			out = put16(out, typ)
+			out = put32(out, uint32(len(tags[tag])))
+			if len(data) <= 4 {
+				out = append(out, data...)
+				out = append(out, make([]byte, 4-len(data))...)
+			} else {
+				out = put32(out, uint32(valuesStart+len(values)))
+				values = append(values, data...)
+			}
+		}
+		next = len(out)
+		out = put32(out, 0)
+		out = append(out, values...)
+	}
+	return out
+}
+
+// chunks returns the compressed strips or tiles of p.
+func (p testTIFF) chunks() [][]byte {
+	chunkWidth, chunkHeight := p.width, p.rowsPerStrip
+	if p.tileWidth > 0 {
+		chunkWidth, chunkHeight = p.tileWidth, p.tileLength
+	}
+	if chunkHeight <= 0 {
+		chunkHeight = p.height
+	}
+
+	var chunks [][]byte
+	for y0 := 0; y0 < p.height; y0 += chunkHeight {
+		for x0 := 0; x0 < p.width; x0 += chunkWidth {
+			// tiles are padded to their full size, the last strip isn't
+			rows := chunkHeight
+			if p.tileWidth == 0 {
+				rows = min(chunkHeight, p.height-y0)
+			}
+			var raw []byte
+			for y := y0; y < y0+rows; y++ {
+				row := make([]byte, chunkWidth*p.samples)
+				for x := x0; x < min(x0+chunkWidth, p.width) && y < p.height; x++ {
+					for s := 0; s < p.samples; s++ {
+						row[(x-x0)*p.samples+s] = testSample(x, y, s)
+					}
+				}
+				if p.predictor == 2 {
+					for i := len(row) - 1; i >= p.samples; i-- {
+						row[i] -= row[i-p.samples]
+					}
+				}
+				raw = append(raw, row...)
+			}
+			if p.compression == tiffCompressionDeflate {
+				var buf bytes.Buffer
+				zw := zlib.NewWriter(&buf)
+				zw.Write(raw)
+				zw.Close()
+				raw = buf.Bytes()
+			}
+			chunks = append(chunks, raw)
+		}
+	}
+	return chunks
+}
+
+// tagValues returns the tags of p with its chunks at offsets, counts bytes
+// long.
+func (p testTIFF) tagValues(offsets, counts []uint32) map[uint16][]uint32 {
+	photometric := uint32(2)
+	if p.samples == 1 {
+		photometric = 1
+	}
+	tags := map[uint16][]uint32{
+		tagImageWidth:      {uint32(p.width)},
+		tagImageLength:     {uint32(p.height)},
+		tagBitsPerSample:   slices.Repeat([]uint32{8}, p.samples),
+		tagCompression:     {max(p.compression, tiffCompressionNone)},
+		tagPhotometric:     {photometric},
+		tagSamplesPerPixel: {uint32(p.samples)},
+		tagPlanarConfig:    {1},
+	}
+	if p.predictor != 0 {
+		tags[tagPredictor] = []uint32{p.predictor}
+	}
+	if p.samples == 4 {
+		tags[tagExtraSamples] = []uint32{p.extra}
+	}
+	if p.tileWidth > 0 {
+		tags[tagTileWidth] = []uint32{uint32(p.tileWidth)}
+		tags[tagTileLength] = []uint32{uint32(p.tileLength)}
+		tags[tagTileOffsets] = offsets
+		tags[tagTileByteCounts] = counts
+	} else {
+		if p.rowsPerStrip > 0 {
+			tags[tagRowsPerStrip] = []uint32{uint32(p.rowsPerStrip)}
+		}
+		tags[tagStripOffsets] = offsets
+		tags[tagStripByteCounts] = counts
+	}
+	for tag, v := range p.tags {
+		if v == nil {
+			delete(tags, tag)
+		} else {
+			tags[tag] = v
+		}
+	}
+	return tags
+}
+
+func TestIsTIFF(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want bool
+	}{
+		{"little endian", []byte("II*\x00\x08\x00\x00\x00"), true},
+		{"big endian", []byte("MM\x00*\x00\x00\x00\x08"), true},
+		{"mixed byte order", []byte("II\x00*\x08\x00\x00\x00"), false},
+		{"PNG", pngSignature, false},
+		{"short", []byte("II*"), false},
+		{"empty", nil, false},
+	}
+	for _, tt := range tests {
+		if got := isTIFF(tt.data); got != tt.want {
+			t.Errorf("%s: isTIFF = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSelectTIFFPage(t *testing.T) {
+	pages := []testTIFF{
+		{width: 4, height: 4, samples: 1},
+		{width: 6, height: 3, samples: 3},
+		{width: 2, height: 5, samples: 4, extra: 2},
+	}
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		data := buildTIFF(order, pages...)
+		tests := []struct {
+			page    int
+			wantErr bool
+		}{
+			{1, false},
+			{2, false},
+			{3, false},
+			{4, true},
+			{10, true},
+		}
+		for _, tt := range tests {
+			got, err := selectTIFFPage(data, tt.page)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("%v page %d: selectTIFFPage succeeded", order, tt.page)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("%v page %d: selectTIFFPage: %v", order, tt.page, err)
+				continue
+			}
+			img, err := tiff.Decode(bytes.NewReader(got))
+			if err != nil {
+				t.Errorf("%v page %d: decoding: %v", order, tt.page, err)
+				continue
+			}
+			p := pages[tt.page-1]
+			if b := img.Bounds(); b.Dx() != p.width || b.Dy() != p.height {
+				t.Errorf("%v page %d: decoded %dx%d, want %dx%d", order, tt.page, b.Dx(), b.Dy(), p.width, p.height)
+			}
+		}
+		if !bytes.Equal(data, buildTIFF(order, pages...)) {
+			t.Errorf("%v: selectTIFFPage modified its input", order)
+		}
+	}
+
+	if _, err := selectTIFFPage([]byte("not a TIFF"), 2); err == nil {
+		t.Errorf("selectTIFFPage of invalid data succeeded")
+	}
+}
+
+func TestPageReader(t *testing.T) {
+	data := buildTIFF(binary.LittleEndian, testTIFF{width: 3, height: 3, samples: 1}, testTIFF{width: 5, height: 2, samples: 1})
+	tests := []struct {
+		name    string
+		data    []byte
+		page    int
+		width   int
+		wantErr bool
+	}{
+		{"first page", data, 1, 3, false},
+		{"no page", data, 0, 3, false},
+		{"second page", data, 2, 5, false},
+		{"missing page", data, 3, 0, true},
+		{"not a TIFF", pngSignature, 2, 0, false},
+	}
+	for _, tt := range tests {
+		th := Thumbnailer{Page: tt.page}
+		r, err := th.pageReader(bytes.NewReader(tt.data))
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: pageReader succeeded", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: pageReader: %v", tt.name, err)
+			continue
+		}
+		if !isTIFF(tt.data) {
+			if got, _ := io.ReadAll(r); !bytes.Equal(got, tt.data) {
+				t.Errorf("%s: pageReader changed the data", tt.name)
+			}
+			continue
+		}
+		config, err := tiff.DecodeConfig(r)
+		if err != nil {
+			t.Errorf("%s: decoding: %v", tt.name, err)
+		} else if config.Width != tt.width {
+			t.Errorf("%s: width %d, want %d", tt.name, config.Width, tt.width)
+		}
+	}
+}
+
+// image returns the pixels of p, as the image decodeTIFFParallel decodes
+// it into.
+func (p testTIFF) image() image.Image {
+	r := image.Rect(0, 0, p.width, p.height)
+	var img image.Image
+	var pix []byte
+	bpp := 4
+	switch {
+	case p.samples == 1:
+		gray := image.NewGray(r)
+		img, pix, bpp = gray, gray.Pix, 1
+	case p.samples == 4 && p.extra == 2:
+		nrgba := image.NewNRGBA(r)
+		img, pix = nrgba, nrgba.Pix
+	default:
+		rgba := image.NewRGBA(r)
+		img, pix = rgba, rgba.Pix
+	}
+	for y := 0; y < p.height; y++ {
+		for x := 0; x < p.width; x++ {
+			px := pix[(y*p.width+x)*bpp:]
+			for s := 0; s < bpp; s++ {
+				px[s] = 0xff
+				if s < p.samples {
+					px[s] = testSample(x, y, s)
+				}
+			}
+		}
+	}
+	return img
+}
+
+// pixOf returns the pixels of the gray, RGBA and NRGBA images TIFFs decode
+// to.
+func pixOf(img image.Image) []byte {
+	switch img := img.(type) {
+	case *image.Gray:
+		return img.Pix
+	case *image.RGBA:
+		return img.Pix
+	case *image.NRGBA:
+		return img.Pix
+	}
+	return nil
+}
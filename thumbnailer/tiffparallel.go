@@ -0,0 +1,327 @@
+package thumbnailer
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"golang.org/x/image/tiff/lzw"
+	"image"
+	"io"
+	"runtime"
+	"sync"
+)
+
+// parallelTIFFPixels is the size from which TIFFs are decoded with
+// decodeTIFFParallel. Smaller images decode quickly enough on one core.
+const parallelTIFFPixels = 16_000_000
+
+// TIFF tags and values read by decodeTIFFParallel.
+const (
+	tagImageWidth      = 256
+	tagImageLength     = 257
+	tagBitsPerSample   = 258
+	tagCompression     = 259
+	tagPhotometric     = 262
+	tagStripOffsets    = 273
+	tagSamplesPerPixel = 277
+	tagRowsPerStrip    = 278
+	tagStripByteCounts = 279
+	tagPlanarConfig    = 284
+	tagPredictor       = 317
+	tagTileWidth       = 322
+	tagTileLength      = 323
+	tagTileOffsets     = 324
+	tagTileByteCounts  = 325
+	tagExtraSamples    = 338
+
+	tiffCompressionNone       = 1
+	tiffCompressionLZW        = 5
+	tiffCompressionDeflate    = 8
+	tiffCompressionOldDeflate = 32946
+)
+
+// tiffLayoutTags are the tags readTIFFLayout reads, all of them SHORT or LONG.
+var tiffLayoutTags = map[uint16]bool{
+	tagImageWidth: true, tagImageLength: true, tagBitsPerSample: true, tagCompression: true, tagPhotometric: true,
+	tagStripOffsets: true, tagSamplesPerPixel: true, tagRowsPerStrip: true, tagStripByteCounts: true,
+	tagPlanarConfig: true, tagPredictor: true, tagTileWidth: true, tagTileLength: true, tagTileOffsets: true,
+	tagTileByteCounts: true, tagExtraSamples: true,
+}
+
+// tiffLayout describes how the pixels of a TIFF are split into independently
+// compressed chunks, either strips of full rows or tiles.
+type tiffLayout struct {
+	width, height int
+	samples       int
+	compression   uint32
+	predictor     uint32
+	// chunkWidth and chunkHeight are the size of every chunk, the last row
+	// and column of tiles are padded to it.
+	chunkWidth, chunkHeight int
+	offsets, counts         []uint32
+	// img is the image to decode into, with samples bytes per pixel.
+	img image.Image
+	pix []byte
+	// stride is the length of a row of img in bytes.
+	stride int
+}
+
+// decodeTIFFParallel decodes a large TIFF of 8-bit gray, RGB or RGBA pixels
+// split into strips or tiles, the usual layout of scans and stitched images,
+// with a goroutine per CPU each decompressing its own chunks. ok is false
+// for small images and layouts it doesn't handle, which are left to the
+// regular, single-threaded decoder.
+func decodeTIFFParallel(data []byte) (img image.Image, ok bool, err error) {
+	workers := runtime.GOMAXPROCS(0)
+	if workers < 2 {
+		return nil, false, nil
+	}
+	l, ok := readTIFFLayout(data)
+	if !ok || l.width*l.height < parallelTIFFPixels || len(l.offsets) < 2 {
+		return nil, false, nil
+	}
+
+	chunks := make(chan int)
+	errs := make(chan error, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < min(workers, len(l.offsets)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var buf bytes.Buffer
+			for chunk := range chunks {
+				if err := l.decodeChunk(data, chunk, &buf); err != nil {
+					errs <- err
+					// drain the rest, so the sender isn't blocked
+					for range chunks {
+					}
+					return
+				}
+			}
+		}()
+	}
+	for chunk := range l.offsets {
+		chunks <- chunk
+	}
+	close(chunks)
+	wg.Wait()
+
+	select {
+	case err := <-errs:
+		return nil, true, err
+	default:
+	}
+	return l.img, true, nil
+}
+
+// readTIFFLayout reads the layout of the first image of a TIFF, ok is false
+// when decodeTIFFParallel can't decode it.
+func readTIFFLayout(data []byte) (tiffLayout, bool) {
+	order, ifd0, ok := tiffOrder(data)
+	if !ok {
+		return tiffLayout{}, false
+	}
+
+	l := tiffLayout{compression: tiffCompressionNone, predictor: 1}
+	photometric, planar, extra := uint32(0), uint32(1), uint32(0)
+	var rowsPerStrip, tileWidth, tileLength int
+	var bits, stripOffsets, stripCounts, tileOffsets, tileCounts []uint32
+	for _, e := range ifdEntries(data, order, ifd0) {
+		if !tiffLayoutTags[e.tag] {
+			continue
+		}
+		values, ok := ifdValues(data, order, e)
+		if !ok {
+			return tiffLayout{}, false
+		}
+		switch e.tag {
+		case tagImageWidth:
+			l.width = int(values[0])
+		case tagImageLength:
+			l.height = int(values[0])
+		case tagBitsPerSample:
+			bits = values
+		case tagCompression:
+			l.compression = values[0]
+		case tagPhotometric:
+			photometric = values[0]
+		case tagSamplesPerPixel:
+			l.samples = int(values[0])
+		case tagRowsPerStrip:
+			rowsPerStrip = int(values[0])
+		case tagPlanarConfig:
+			planar = values[0]
+		case tagPredictor:
+			l.predictor = values[0]
+		case tagExtraSamples:
+			extra = values[0]
+		case tagStripOffsets:
+			stripOffsets = values
+		case tagStripByteCounts:
+			stripCounts = values
+		case tagTileWidth:
+			tileWidth = int(values[0])
+		case tagTileLength:
+			tileLength = int(values[0])
+		case tagTileOffsets:
+			tileOffsets = values
+		case tagTileByteCounts:
+			tileCounts = values
+		}
+	}
+
+	if l.width <= 0 || l.height <= 0 || planar != 1 || len(bits) != l.samples {
+		return tiffLayout{}, false
+	}
+	for _, b := range bits {
+		if b != 8 {
+			return tiffLayout{}, false
+		}
+	}
+	switch l.compression {
+	case tiffCompressionNone, tiffCompressionLZW, tiffCompressionDeflate, tiffCompressionOldDeflate:
+	default:
+		return tiffLayout{}, false
+	}
+	if l.predictor != 1 && l.predictor != 2 {
+		return tiffLayout{}, false
+	}
+
+	r := image.Rect(0, 0, l.width, l.height)
+	switch {
+	case l.samples == 1 && photometric == 1:
+		gray := image.NewGray(r)
+		l.img, l.pix, l.stride = gray, gray.Pix, gray.Stride
+	case l.samples == 3 && photometric == 2:
+		// an opaque RGBA, like the regular decoder returns; decodeChunk
+		// fills in the alpha
+		rgba := image.NewRGBA(r)
+		l.img, l.pix, l.stride = rgba, rgba.Pix, rgba.Stride
+	case l.samples == 4 && photometric == 2 && extra == 1:
+		rgba := image.NewRGBA(r)
+		l.img, l.pix, l.stride = rgba, rgba.Pix, rgba.Stride
+	case l.samples == 4 && photometric == 2 && extra == 2:
+		nrgba := image.NewNRGBA(r)
+		l.img, l.pix, l.stride = nrgba, nrgba.Pix, nrgba.Stride
+	default:
+		return tiffLayout{}, false
+	}
+
+	switch {
+	case tileWidth > 0 && tileLength > 0:
+		across := (l.width + tileWidth - 1) / tileWidth
+		down := (l.height + tileLength - 1) / tileLength
+		if len(tileOffsets) != across*down || len(tileCounts) != len(tileOffsets) {
+			return tiffLayout{}, false
+		}
+		l.chunkWidth, l.chunkHeight = tileWidth, tileLength
+		l.offsets, l.counts = tileOffsets, tileCounts
+	case len(stripOffsets) > 0:
+		if rowsPerStrip <= 0 || rowsPerStrip > l.height {
+			rowsPerStrip = l.height
+		}
+		if len(stripOffsets) != (l.height+rowsPerStrip-1)/rowsPerStrip || len(stripCounts) != len(stripOffsets) {
+			return tiffLayout{}, false
+		}
+		l.chunkWidth, l.chunkHeight = l.width, rowsPerStrip
+		l.offsets, l.counts = stripOffsets, stripCounts
+	default:
+		return tiffLayout{}, false
+	}
+	for i, offset := range l.offsets {
+		if uint64(offset)+uint64(l.counts[i]) > uint64(len(data)) {
+			return tiffLayout{}, false
+		}
+	}
+	return l, true
+}
+
+// ifdValues returns the values of the SHORT or LONG IFD entry e, ok is false
+// for other types and values past the end of data.
+func ifdValues(data []byte, order binary.ByteOrder, e ifdEntry) ([]uint32, bool) {
+	if e.typ != 3 && e.typ != 4 || e.count == 0 {
+		return nil, false
+	}
+	size := tiffTypeSizes[e.typ]
+	start := e.offset + 8
+	if total := uint64(size) * uint64(e.count); total > 4 {
+		start = int(order.Uint32(data[e.offset+8:]))
+		if start < 0 || uint64(start)+total > uint64(len(data)) {
+			return nil, false
+		}
+	}
+	values := make([]uint32, e.count)
+	for i := range values {
+		if e.typ == 3 {
+			values[i] = uint32(order.Uint16(data[start+2*i:]))
+		} else {
+			values[i] = order.Uint32(data[start+4*i:])
+		}
+	}
+	return values, true
+}
+
+// decodeChunk decompresses chunk into buf and copies its pixels into l.img.
+func (l *tiffLayout) decodeChunk(data []byte, chunk int, buf *bytes.Buffer) error {
+	compressed := data[l.offsets[chunk] : l.offsets[chunk]+l.counts[chunk]]
+	var r io.Reader = bytes.NewReader(compressed)
+	switch l.compression {
+	case tiffCompressionLZW:
+		lr := lzw.NewReader(r, lzw.MSB, 8)
+		defer lr.Close()
+		r = lr
+	case tiffCompressionDeflate, tiffCompressionOldDeflate:
+		zr, err := zlib.NewReader(r)
+		if err != nil {
+			return fmt.Errorf("error decompressing TIFF chunk %d: %v", chunk, err)
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	across := (l.width + l.chunkWidth - 1) / l.chunkWidth
+	x0, y0 := chunk%across*l.chunkWidth, chunk/across*l.chunkHeight
+	w, h := min(l.chunkWidth, l.width-x0), min(l.chunkHeight, l.height-y0)
+
+	// tiles are padded to their full size, the last strip only has the rows
+	// left
+	rows := l.chunkHeight
+	if l.chunkWidth == l.width {
+		rows = h
+	}
+	// the whole chunk is read, so the checksum at the end of deflate data
+	// is checked
+	rowBytes := l.chunkWidth * l.samples
+	buf.Reset()
+	if _, err := buf.ReadFrom(r); err != nil {
+		return fmt.Errorf("error decompressing TIFF chunk %d: %v", chunk, err)
+	}
+	if buf.Len() < rows*rowBytes {
+		return fmt.Errorf("error decompressing TIFF chunk %d: %v", chunk, io.ErrUnexpectedEOF)
+	}
+	pix := buf.Bytes()
+
+	if l.predictor == 2 {
+		for row := 0; row < rows; row++ {
+			p := pix[row*rowBytes : (row+1)*rowBytes]
+			for i := l.samples; i < len(p); i++ {
+				p[i] += p[i-l.samples]
+			}
+		}
+	}
+
+	for row := 0; row < h; row++ {
+		src := pix[row*rowBytes : row*rowBytes+w*l.samples]
+		dst := l.pix[(y0+row)*l.stride:]
+		if l.samples == 3 {
+			dst = dst[x0*4 : (x0+w)*4]
+			for x := 0; x < w; x++ {
+				dst[4*x], dst[4*x+1], dst[4*x+2], dst[4*x+3] = src[3*x], src[3*x+1], src[3*x+2], 0xff
+			}
+		} else {
+			copy(dst[x0*l.samples:], src)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package thumbnailer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"runtime"
+	"testing"
+)
+
+// decodeTIFFChunks decodes data like decodeTIFFParallel, chunk by chunk on
+// one goroutine and whatever its size.
+func decodeTIFFChunks(data []byte) (image.Image, bool, error) {
+	l, ok := readTIFFLayout(data)
+	if !ok {
+		return nil, false, nil
+	}
+	var buf bytes.Buffer
+	for chunk := range l.offsets {
+		if err := l.decodeChunk(data, chunk, &buf); err != nil {
+			return nil, true, err
+		}
+	}
+	return l.img, true, nil
+}
+
+func TestDecodeTIFFChunks(t *testing.T) {
+	tests := []struct {
+		name   string
+		order  binary.ByteOrder
+		page   testTIFF
+		chunks int
+	}{
+		{"gray strips", binary.LittleEndian, testTIFF{width: 9, height: 10, samples: 1, rowsPerStrip: 3}, 4},
+		{"RGB strips big endian", binary.BigEndian, testTIFF{width: 9, height: 10, samples: 3, rowsPerStrip: 4}, 3},
+		{"one strip without RowsPerStrip", binary.LittleEndian, testTIFF{width: 5, height: 4, samples: 3}, 1},
+		{"RowsPerStrip past the height", binary.LittleEndian, testTIFF{width: 5, height: 4, samples: 1, rowsPerStrip: 100}, 1},
+		{"associated alpha", binary.LittleEndian, testTIFF{width: 7, height: 6, samples: 4, extra: 1, rowsPerStrip: 2}, 3},
+		{"unassociated alpha", binary.LittleEndian, testTIFF{width: 7, height: 6, samples: 4, extra: 2, rowsPerStrip: 2}, 3},
+		{"deflate", binary.LittleEndian, testTIFF{width: 20, height: 15, samples: 3, compression: tiffCompressionDeflate, rowsPerStrip: 4}, 4},
+		{"deflate with predictor", binary.BigEndian, testTIFF{width: 20, height: 15, samples: 4, extra: 2, compression: tiffCompressionDeflate, predictor: 2, rowsPerStrip: 4}, 4},
+		{"padded tiles", binary.LittleEndian, testTIFF{width: 40, height: 36, samples: 3, tileWidth: 16, tileLength: 16}, 9},
+		{"deflate tiles with predictor", binary.LittleEndian, testTIFF{width: 33, height: 17, samples: 1, compression: tiffCompressionDeflate, predictor: 2, tileWidth: 16, tileLength: 16}, 6},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := buildTIFF(tt.order, tt.page)
+			l, ok := readTIFFLayout(data)
+			if !ok {
+				t.Fatalf("readTIFFLayout rejected the TIFF")
+			}
+			if len(l.offsets) != tt.chunks {
+				t.Errorf("%d chunks, want %d", len(l.offsets), tt.chunks)
+			}
+
+			img, _, err := decodeTIFFChunks(data)
+			if err != nil {
+				t.Fatalf("decoding: %v", err)
+			}
+			want := tt.page.image()
+			if fmt.Sprintf("%T", img) != fmt.Sprintf("%T", want) {
+				t.Errorf("decoded a %T, want %T", img, want)
+			}
+			if img.Bounds() != want.Bounds() || !bytes.Equal(pixOf(img), pixOf(want)) {
+				t.Errorf("pixels don't match the TIFF")
+			}
+		})
+	}
+}
+
+func TestReadTIFFLayoutRejects(t *testing.T) {
+	gray := testTIFF{width: 8, height: 8, samples: 1, rowsPerStrip: 2}
+	with := func(p testTIFF, tag uint16, values ...uint32) testTIFF {
+		p.tags = map[uint16][]uint32{tag: values}
+		return p
+	}
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"not a TIFF", []byte("not a TIFF at all")},
+		{"16 bits per sample", buildTIFF(binary.LittleEndian, with(gray, tagBitsPerSample, 16))},
+		{"samples without bits", buildTIFF(binary.LittleEndian, with(gray, tagSamplesPerPixel, 3))},
+		{"JPEG compression", buildTIFF(binary.LittleEndian, with(gray, tagCompression, 7))},
+		{"floating point predictor", buildTIFF(binary.LittleEndian, with(gray, tagPredictor, 3))},
+		{"separate planes", buildTIFF(binary.LittleEndian, with(gray, tagPlanarConfig, 2))},
+		{"palette", buildTIFF(binary.LittleEndian, with(gray, tagPhotometric, 3))},
+		{"CMYK", buildTIFF(binary.LittleEndian, with(testTIFF{width: 8, height: 8, samples: 4, rowsPerStrip: 2}, tagPhotometric, 5))},
+		{"RGBA without ExtraSamples", buildTIFF(binary.LittleEndian, with(testTIFF{width: 8, height: 8, samples: 4, rowsPerStrip: 2}, tagExtraSamples, 0))},
+		{"strips missing", buildTIFF(binary.LittleEndian, with(gray, tagRowsPerStrip, 1))},
+		{"no strips", buildTIFF(binary.LittleEndian, with(gray, tagStripOffsets))},
+		{"tiles missing", buildTIFF(binary.LittleEndian, with(testTIFF{width: 40, height: 36, samples: 1, tileWidth: 16, tileLength: 16}, tagTileWidth, 32))},
+		{"strip past the end", buildTIFF(binary.LittleEndian, with(testTIFF{width: 8, height: 8, samples: 1}, tagStripByteCounts, 1<<30))},
+		{"no width", buildTIFF(binary.LittleEndian, with(gray, tagImageWidth))},
+	}
+	for _, tt := range tests {
+		if _, ok := readTIFFLayout(tt.data); ok {
+			t.Errorf("%s: readTIFFLayout accepted the TIFF", tt.name)
+		}
+	}
+}
+
+func TestDecodeTIFFChunkErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		page testTIFF
+	}{
+		{"short strip", testTIFF{width: 4, height: 4, samples: 1, tags: map[uint16][]uint32{tagStripByteCounts: {8}}}},
+		{"truncated deflate", testTIFF{width: 4, height: 4, samples: 1, compression: tiffCompressionDeflate, tags: map[uint16][]uint32{tagStripByteCounts: {6}}}},
+		{"invalid deflate", testTIFF{width: 4, height: 4, samples: 1, compression: tiffCompressionDeflate, tags: map[uint16][]uint32{tagStripOffsets: {0}}}},
+	}
+	for _, tt := range tests {
+		_, ok, err := decodeTIFFChunks(buildTIFF(binary.LittleEndian, tt.page))
+		if !ok {
+			t.Errorf("%s: readTIFFLayout rejected the TIFF", tt.name)
+		} else if err == nil {
+			t.Errorf("%s: decoding succeeded", tt.name)
+		}
+	}
+}
+
+func TestDecodeTIFFParallel(t *testing.T) {
+	// a gray image of just parallelTIFFPixels pixels, in strips of 64 rows
+	large := testTIFF{width: 4000, height: 4000, samples: 1, compression: tiffCompressionDeflate, rowsPerStrip: 64}
+	data := buildTIFF(binary.LittleEndian, large)
+
+	// one CPU leaves it to the regular decoder
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(1))
+	if _, ok, _ := decodeTIFFParallel(data); ok {
+		t.Errorf("decodeTIFFParallel decoded with one CPU")
+	}
+	runtime.GOMAXPROCS(4)
+
+	small := buildTIFF(binary.LittleEndian, testTIFF{width: 64, height: 64, samples: 1, rowsPerStrip: 8})
+	if _, ok, _ := decodeTIFFParallel(small); ok {
+		t.Errorf("decodeTIFFParallel decoded a small TIFF")
+	}
+
+	img, ok, err := decodeTIFFParallel(data)
+	if !ok || err != nil {
+		t.Fatalf("decodeTIFFParallel = %v, %v", ok, err)
+	}
+	if want := large.image(); img.Bounds() != want.Bounds() || !bytes.Equal(pixOf(img), pixOf(want)) {
+		t.Errorf("pixels don't match the TIFF")
+	}
+
+	// a broken strip fails the whole image
+	l, _ := readTIFFLayout(data)
+	clear(data[l.offsets[10] : l.offsets[10]+l.counts[10]])
+	if _, ok, err := decodeTIFFParallel(data); !ok || err == nil {
+		t.Errorf("decodeTIFFParallel of a broken strip = %v, %v", ok, err)
+	}
+}
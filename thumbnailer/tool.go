@@ -0,0 +1,94 @@
+package thumbnailer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Retries of the external tools that convert RAW, HEIC and PDF files. They fail
+// transiently on a busy system, so a run that couldn't start or was killed is
+// retried after toolBackoff, doubling the wait for every further retry, see
+// retryTool.
+const (
+	toolRetries = 3
+	toolBackoff = 200 * time.Millisecond
+)
+
+// ErrToolFailed is wrapped by the errors of external tools that exited with an
+// error or still failed after their retries, so callers don't retry them
+// again.
+var ErrToolFailed = errors.New("giving up")
+
+// Logf logs the retries of external tools. It can be replaced to send them
+// elsewhere, or set to a no-op to discard them.
+var Logf = log.Printf
+
+// toolTimeKey is the context key of the duration WithToolTime adds to.
+type toolTimeKey struct{}
+
+// WithToolTime returns a context that makes the decoders add the time spent
+// running external tools, such as exiftool for RAW files, to d. The context
+// must not be shared between goroutines.
+func WithToolTime(ctx context.Context, d *time.Duration) context.Context {
+	return context.WithValue(ctx, toolTimeKey{}, d)
+}
+
+// runTool runs an external tool and returns its standard output, retrying a
+// run that failed transiently with exponential backoff. It gives up early when
+// ctx is done.
+func runTool(ctx context.Context, name string, args ...string) ([]byte, error) {
+	if d, ok := ctx.Value(toolTimeKey{}).(*time.Duration); ok {
+		start := time.Now()
+		defer func() { *d += time.Since(start) }()
+	}
+
+	backoff := toolBackoff
+	for attempt := 1; ; attempt++ {
+		cmd := exec.CommandContext(ctx, name, args...)
+		var stdout, stderr bytes.Buffer
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		err := cmd.Run()
+		if err == nil {
+			return stdout.Bytes(), nil
+		}
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("%s was stopped: %v", name, ctx.Err())
+		}
+
+		msg := strings.TrimSpace(stderr.String())
+		if !retryTool(err) {
+			return nil, fmt.Errorf("%s failed, %w: %w, %s", name, ErrToolFailed, err, msg)
+		}
+		if attempt > toolRetries {
+			return nil, fmt.Errorf("%s failed after %d attempts, %w: %w, %s", name, attempt, ErrToolFailed, err, msg)
+		}
+		Logf("Warning: %s failed (attempt %d of %d), retrying in %v: %v, %s", name, attempt, toolRetries+1, backoff, err, msg)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%s was stopped: %v", name, ctx.Err())
+		}
+		backoff *= 2
+	}
+}
+
+// retryTool reports whether a failed run of a tool may succeed when run again:
+// it couldn't be started, e.g. for a lack of processes or memory, or it was
+// killed by a signal, e.g. by the OOM killer. A tool that exited with an error
+// fails the same way again, as does one that isn't installed.
+func retryTool(err error) bool {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		// -1 for runs terminated by a signal
+		return exitErr.ExitCode() == -1
+	}
+	return !errors.Is(err, exec.ErrNotFound)
+}
@@ -0,0 +1,58 @@
+package thumbnailer
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunTool(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no sh to run as a tool")
+	}
+	defer func(saved func(string, ...interface{})) { Logf = saved }(Logf)
+	Logf = func(string, ...interface{}) {}
+
+	tests := []struct {
+		name     string
+		script   string
+		attempts int
+		wantErr  bool
+	}{
+		{"succeeds", "printf ok", 1, false},
+		{"exits with an error", "echo broken >&2; exit 3", 1, true},
+		{"killed", "kill -KILL $$", toolRetries + 1, true},
+		// killed the first time only, like a tool that ran out of memory once
+		{"killed once", `[ "$(wc -c < "$1")" -gt 1 ] || kill -KILL $$; printf ok`, 2, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// every attempt appends to the file, whose size counts them
+			attempts := filepath.Join(t.TempDir(), "attempts")
+			script := `printf . >> "$1"; ` + tt.script
+			out, err := runTool(context.Background(), "sh", "-c", script, "sh", attempts)
+			if tt.wantErr {
+				if !errors.Is(err, ErrToolFailed) {
+					t.Errorf("error %v, want %v", err, ErrToolFailed)
+				}
+			} else if err != nil || string(out) != "ok" {
+				t.Errorf("runTool = %q, %v", out, err)
+			}
+			if data, _ := os.ReadFile(attempts); len(data) != tt.attempts {
+				t.Errorf("%d attempts, want %d", len(data), tt.attempts)
+			}
+		})
+	}
+
+	_, err := runTool(context.Background(), "thumbnailer-missing-tool")
+	if !errors.Is(err, exec.ErrNotFound) || !errors.Is(err, ErrToolFailed) {
+		t.Errorf("running a missing tool: %v", err)
+	}
+	if err != nil && strings.Contains(err.Error(), "attempts") {
+		t.Errorf("a missing tool was retried: %v", err)
+	}
+}
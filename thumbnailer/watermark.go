@@ -0,0 +1,67 @@
+package thumbnailer
+
+import (
+	"fmt"
+	"github.com/disintegration/imaging"
+	"image"
+	"math"
+	"os"
+)
+
+// watermarkScale is the share of the thumbnail's width and height the
+// watermark is scaled to fit, so it covers the same part of every size.
+const watermarkScale = 0.25
+
+// Watermark is an image overlaid on every thumbnail. The image is only read,
+// so one Watermark can be shared by thumbnailers running concurrently.
+type Watermark struct {
+	Image image.Image
+	// Position is the corner, edge or center the watermark is placed at, see
+	// Positions.
+	Position string
+	// Opacity is the opacity of the watermark, from 0 (invisible) to 1.
+	Opacity float64
+}
+
+// LoadWatermark reads the watermark image from file, usually a PNG with
+// transparency, to be placed at position with opacity.
+func LoadWatermark(file, position string, opacity float64) (*Watermark, error) {
+	if err := checkPosition(position); err != nil {
+		return nil, err
+	}
+	if opacity < 0 || opacity > 1 {
+		return nil, fmt.Errorf("watermark opacity must be between 0 and 1, got %v", opacity)
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("error opening watermark %s: %v", file, err)
+	}
+	defer f.Close()
+
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding watermark %s: %v", file, err)
+	}
+	return &Watermark{Image: img, Position: position, Opacity: opacity}, nil
+}
+
+// watermark overlays the Watermark on img, scaled to fit a watermarkScale
+// share of it and placed at its Position.
+func (t *Thumbnailer) watermark(img image.Image) image.Image {
+	wm := t.Watermark
+	if wm == nil || wm.Opacity == 0 {
+		return img
+	}
+	b, mb := img.Bounds(), wm.Image.Bounds()
+	if b.Empty() || mb.Empty() {
+		return img
+	}
+
+	factor := math.Min(float64(b.Dx())*watermarkScale/float64(mb.Dx()), float64(b.Dy())*watermarkScale/float64(mb.Dy()))
+	w := int(math.Max(1, math.Round(float64(mb.Dx())*factor)))
+	h := int(math.Max(1, math.Round(float64(mb.Dy())*factor)))
+	mark := imaging.Resize(wm.Image, w, h, imaging.Lanczos)
+
+	return imaging.Overlay(img, mark, positionPoint(b, w, h, wm.Position), wm.Opacity)
+}
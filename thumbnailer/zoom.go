@@ -0,0 +1,33 @@
+package thumbnailer
+
+import (
+	"github.com/disintegration/imaging"
+	"image"
+	"math"
+)
+
+// zoomCrop returns the size of the centered region of a w x h source that
+// Zoom keeps.
+func (t *Thumbnailer) zoomCrop(w, h float64) (float64, float64) {
+	if t.Zoom <= 0 || t.Zoom >= 1 {
+		return w, h
+	}
+	return w * t.Zoom, h * t.Zoom
+}
+
+// zoomSize is zoomCrop in whole pixels.
+func (t *Thumbnailer) zoomSize(w, h int) (int, int) {
+	zw, zh := t.zoomCrop(float64(w), float64(h))
+	return int(math.Max(1, math.Round(zw))), int(math.Max(1, math.Round(zh)))
+}
+
+// cropZoom center-crops img to the Zoom share of its width and height.
+func (t *Thumbnailer) cropZoom(img image.Image) image.Image {
+	b := img.Bounds()
+	w, h := t.zoomSize(b.Dx(), b.Dy())
+	if w == b.Dx() && h == b.Dy() {
+		return img
+	}
+	x, y := b.Min.X+(b.Dx()-w)/2, b.Min.Y+(b.Dy()-h)/2
+	return imaging.Crop(img, image.Rect(x, y, x+w, y+h))
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// walkInput walks root like filepath.Walk, but resolves symlinks: fn gets the
+// info of their targets, broken ones are logged and skipped, and symlinked
+// directories are descended into when root is one or with --follow-symlinks.
+// Paths below a symlinked directory keep the symlink's name in them.
+func walkInput(root string, fn filepath.WalkFunc) error {
+	w := &linkWalk{fn: fn}
+	return w.walk(root, root)
+}
+
+// linkWalk is the state of a walkInput shared by the walks of the symlinked
+// directories in it.
+type linkWalk struct {
+	fn filepath.WalkFunc
+	// visited holds the real directories walked so far, so a directory
+	// reached through several symlinks is walked once, and a symlink leading
+	// back into one of them doesn't loop.
+	visited []string
+	// skipAll is set once fn returned filepath.SkipAll, which the nested
+	// filepath.Walk of a symlinked directory would only apply to itself.
+	skipAll bool
+}
+
+// walk walks the directory dir, reporting its paths below path.
+func (w *linkWalk) walk(path, dir string) error {
+	if real, err := realPath(dir); err == nil {
+		w.visited = append(w.visited, real)
+	}
+	return filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if p != dir {
+			rel, _ := filepath.Rel(dir, p)
+			p = filepath.Join(path, rel)
+		} else {
+			p = path
+		}
+		if err == nil && info.IsDir() && p != path && len(w.visited) > 1 {
+			// below a symlink, a directory walked elsewhere is skipped too
+			if real, err := realPath(p); err == nil && w.walked(real) {
+				log.Printf("Warning: skipping %s, %s was already walked", p, real)
+				return filepath.SkipDir
+			}
+		}
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			return w.call(p, info, err)
+		}
+
+		target, err := os.Stat(p)
+		if err != nil {
+			log.Printf("Warning: skipping broken symlink %s: %v", p, err)
+			return nil
+		}
+		if !target.IsDir() {
+			return w.call(p, target, nil)
+		}
+		if !followLinks && p != path {
+			logVerbose("Skipping symlinked directory %s, use --follow-symlinks to descend into it", p)
+			return nil
+		}
+
+		real, err := realPath(p)
+		if err != nil {
+			log.Printf("Warning: skipping symlink %s: %v", p, err)
+			return nil
+		}
+		if p != path {
+			// the root itself may be a symlink, given explicitly
+			parent, _ := realPath(filepath.Dir(p))
+			for _, walked := range append(w.visited, parent) {
+				if within(real, walked) {
+					log.Printf("Warning: skipping symlink %s to %s, which would walk %s again", p, real, walked)
+					return nil
+				}
+			}
+		}
+		if err := w.walk(p, real); err != nil {
+			return err
+		}
+		if w.skipAll {
+			return filepath.SkipAll
+		}
+		return nil
+	})
+}
+
+// walked reports whether the walk of the directory real has been started.
+func (w *linkWalk) walked(real string) bool {
+	for _, v := range w.visited {
+		if v == real {
+			return true
+		}
+	}
+	return false
+}
+
+// call calls fn, recording a filepath.SkipAll it returns.
+func (w *linkWalk) call(path string, info os.FileInfo, err error) error {
+	err = w.fn(path, info, err)
+	if err == filepath.SkipAll {
+		w.skipAll = true
+	}
+	return err
+}
+
+// realPath returns the absolute path of p with all symlinks resolved, so paths
+// reached through relative symlinks compare equal.
+func realPath(p string) (string, error) {
+	real, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Abs(real)
+}
+
+// within reports whether path is dir or below it.
+func within(path, dir string) bool {
+	return path == dir || strings.HasPrefix(path, dir+string(filepath.Separator))
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestWalkInput(t *testing.T) {
+	dir := t.TempDir()
+	root, other := filepath.Join(dir, "in"), filepath.Join(dir, "other")
+	for _, d := range []string{filepath.Join(root, "sub"), other} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range []string{filepath.Join(root, "a.jpg"), filepath.Join(root, "sub", "b.jpg"), filepath.Join(other, "c.jpg")} {
+		if err := os.WriteFile(f, []byte("image"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"link.jpg":   "a.jpg",
+		"broken.jpg": "missing.jpg",
+		"other":      other,
+		// these would walk the input again
+		"sub/loop": "..",
+		"again":    "sub",
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Skipf("creating symlinks: %v", err)
+		}
+	}
+	if err := os.Symlink(root, filepath.Join(dir, "root")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		root   string
+		follow bool
+		want   []string
+	}{
+		{"without --follow-symlinks", root, false, []string{"a.jpg", "link.jpg", "sub/b.jpg"}},
+		{"with --follow-symlinks", root, true, []string{"a.jpg", "link.jpg", "other/c.jpg", "sub/b.jpg"}},
+		{"symlinked root", filepath.Join(dir, "root"), false, []string{"a.jpg", "link.jpg", "sub/b.jpg"}},
+	}
+	defer func(saved bool) { followLinks = saved }(followLinks)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			followLinks = tt.follow
+			var got []string
+			err := walkInput(tt.root, func(path string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				if info.Mode()&os.ModeSymlink != 0 {
+					t.Errorf("%s: got the info of the symlink", path)
+				}
+				if !info.IsDir() {
+					rel, _ := filepath.Rel(tt.root, path)
+					got = append(got, filepath.ToSlash(rel))
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("walkInput: %v", err)
+			}
+			slices.Sort(got)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("walked %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// SkipAll stops the walks of symlinked directories too
+	followLinks = true
+	var n int
+	err := walkInput(filepath.Join(root, "other"), func(path string, info os.FileInfo, err error) error {
+		if !info.IsDir() {
+			n++
+			return filepath.SkipAll
+		}
+		return nil
+	})
+	if err != nil || n != 1 {
+		t.Errorf("walkInput returning SkipAll walked %d files, %v", n, err)
+	}
+}
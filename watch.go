@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"github.com/fsnotify/fsnotify"
+	"github.com/peferb/thumbnailer/thumbnailer"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// settleInterval is how long a file's size must stay the same before it's
+// considered completely written.
+const settleInterval = 500 * time.Millisecond
+
+// watchInput processes images with process as they are created or modified
+// under inputPath until SIGINT or SIGTERM, then waits for in-flight images to
+// finish.
+func watchInput(thumb *thumbnailer.Thumbnailer, accept func(path string) bool, process func(*thumbnailer.Thumbnailer, string) imageResult) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	if err := watchTree(watcher, inputPath); err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// a filesystem running low stops watching like a signal, but with an error
+	var lowSpace error
+	if minFreeBytes > 0 {
+		go monitorFreeSpace(ctx, freeSpaceDir(), func(err error) {
+			lowSpace = err
+			stop()
+		})
+	}
+
+	absOutput, _ := filepath.Abs(outputPath)
+	sem := make(chan struct{}, parallelism)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	pending := make(map[string]bool)
+
+	queue := func(file string) {
+		// thumbnails written inside the watched tree must not be picked up again
+		if abs, err := filepath.Abs(file); err == nil && strings.HasPrefix(abs, absOutput+string(filepath.Separator)) {
+			return
+		}
+		if !accept(file) {
+			return
+		}
+
+		mu.Lock()
+		if pending[file] {
+			mu.Unlock()
+			return
+		}
+		pending[file] = true
+		mu.Unlock()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() {
+				mu.Lock()
+				delete(pending, file)
+				mu.Unlock()
+			}()
+
+			if !waitUntilWritten(ctx, file) {
+				return
+			}
+			if info, err := os.Stat(file); err != nil || tooLarge(file, info.Size()) {
+				return
+			}
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			defer func() { <-sem }()
+
+			if result := process(thumb, file); result.Err == nil && !result.Skipped {
+				log.Printf("Processed image %s in %v", file, result.Duration)
+			}
+		}()
+	}
+
+	log.Printf("Watching %s for new images, press Ctrl-C to stop", inputPath)
+	for {
+		select {
+		case <-ctx.Done():
+			log.Print("Stopping, waiting for images in progress to finish")
+			wg.Wait()
+			return lowSpace
+		case event, ok := <-watcher.Events:
+			if !ok {
+				wg.Wait()
+				return nil
+			}
+			if !event.Has(fsnotify.Create) && !event.Has(fsnotify.Write) {
+				continue
+			}
+
+			info, err := os.Stat(event.Name)
+			if err != nil {
+				continue
+			}
+			if info.IsDir() {
+				if !recursive {
+					continue
+				}
+				if link, err := os.Lstat(event.Name); err == nil && link.Mode()&os.ModeSymlink != 0 && !followLinks {
+					continue
+				}
+				// watch the new directory and pick up anything moved in with it
+				if err := watchTree(watcher, event.Name); err != nil {
+					log.Printf("Error watching directory %s: %v", event.Name, err)
+				}
+				walkInput(event.Name, func(path string, info os.FileInfo, err error) error {
+					if err == nil && !info.IsDir() {
+						queue(path)
+					}
+					return nil
+				})
+				continue
+			}
+			queue(event.Name)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				wg.Wait()
+				return nil
+			}
+			log.Printf("Error watching input path: %v", err)
+		}
+	}
+}
+
+// watchTree adds root and, unless --recursive=false, all directories below it
+// to watcher.
+func watchTree(watcher *fsnotify.Watcher, root string) error {
+	return walkInput(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && !recursive && path != root {
+			return filepath.SkipDir
+		}
+		if info.IsDir() {
+			return watcher.Add(path)
+		}
+		return nil
+	})
+}
+
+// waitUntilWritten waits until the size of file stops changing, so uploads in
+// progress aren't decoded half-written. It returns false when the file
+// disappears or ctx is done.
+func waitUntilWritten(ctx context.Context, file string) bool {
+	var lastSize int64 = -1
+	for {
+		info, err := os.Stat(file)
+		if err != nil {
+			return false
+		}
+		if info.Size() == lastSize && info.Size() > 0 {
+			return true
+		}
+		lastSize = info.Size()
+
+		select {
+		case <-time.After(settleInterval):
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// archive collects all output files when outputPath ends in .zip, nil when
+// writing to a directory.
+var archive *zipArchive
+
+// isZipOutput reports whether the output should be written to a ZIP archive.
+func isZipOutput(path string) bool {
+	return strings.EqualFold(filepath.Ext(path), ".zip")
+}
+
+// zipEntry is one file to add to the archive. The outcome is sent on done.
+type zipEntry struct {
+	name string
+	data []byte
+	done chan error
+}
+
+// zipArchive writes entries to a ZIP file from a single goroutine, as
+// zip.Writer isn't safe for concurrent use. Like saveFile, it writes to a
+// temporary file that is only renamed to path once the archive is complete.
+type zipArchive struct {
+	path    string
+	entries chan zipEntry
+	closed  chan error
+}
+
+func createZipArchive(path string) (*zipArchive, error) {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+
+	a := &zipArchive{
+		path:    path,
+		entries: make(chan zipEntry),
+		closed:  make(chan error, 1),
+	}
+	go a.write(f)
+	return a, nil
+}
+
+func (a *zipArchive) write(f *os.File) {
+	zw := zip.NewWriter(f)
+	var failed error
+	for entry := range a.entries {
+		if failed != nil {
+			// a failed write leaves the archive unusable
+			entry.done <- failed
+			continue
+		}
+		w, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     entry.name,
+			Method:   zip.Deflate,
+			Modified: time.Now(),
+		})
+		if err == nil {
+			_, err = w.Write(entry.data)
+		}
+		failed = err
+		entry.done <- err
+	}
+
+	if failed == nil {
+		failed = zw.Close()
+	}
+	if failed == nil {
+		failed = f.Sync()
+	}
+	if err := f.Close(); failed == nil {
+		failed = err
+	}
+	if failed == nil {
+		failed = os.Chmod(f.Name(), 0644)
+	}
+	if failed == nil {
+		failed = os.Rename(f.Name(), a.path)
+	}
+	if failed != nil {
+		os.Remove(f.Name())
+	}
+	a.closed <- failed
+}
+
+// add writes the output of encode to the archive as file, which is a path
+// below outputPath.
+func (a *zipArchive) add(file string, encode func(w io.Writer) error) error {
+	name, err := filepath.Rel(a.path, file)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	if err := encode(&buf); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	a.entries <- zipEntry{name: filepath.ToSlash(name), data: buf.Bytes(), done: done}
+	return <-done
+}
+
+// close finishes the archive and moves it into place.
+func (a *zipArchive) close() error {
+	close(a.entries)
+	return <-a.closed
+}
+
+// makeOutputDir creates dir for output files, unless they go into an archive
+// or are kept as data URIs.
+func makeOutputDir(dir string) error {
+	if archive != nil || dataURI {
+		return nil
+	}
+	return os.MkdirAll(dir, os.ModePerm)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestIsZipOutput(t *testing.T) {
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"out.zip", true},
+		{"thumbs/OUT.ZIP", true},
+		{"out", false},
+		{"out.zip/thumbs", false},
+		{"out.tar", false},
+	}
+	for _, tt := range tests {
+		if got := isZipOutput(tt.path); got != tt.want {
+			t.Errorf("isZipOutput(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestZipArchive(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "out.zip")
+	a, err := createZipArchive(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// entries are added from several goroutines, like the workers do
+	want := make(map[string]string)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		name := fmt.Sprintf("sub/%d.jpg", i)
+		want[name] = fmt.Sprintf("thumbnail %d", i)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := a.add(filepath.Join(path, name), func(w io.Writer) error {
+				_, err := io.WriteString(w, want[name])
+				return err
+			})
+			if err != nil {
+				t.Errorf("adding %s: %v", name, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// a failed encode adds nothing
+	errEncode := errors.New("encode failed")
+	if err := a.add(filepath.Join(path, "failed.jpg"), func(w io.Writer) error { return errEncode }); err != errEncode {
+		t.Errorf("adding a failed encode: %v, want %v", err, errEncode)
+	}
+
+	if _, err := os.Stat(path); err == nil {
+		t.Errorf("the archive is in place before it's closed")
+	}
+	if err := a.close(); err != nil {
+		t.Fatalf("closing the archive: %v", err)
+	}
+
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+	if len(zr.File) != len(want) {
+		t.Errorf("%d entries, want %d", len(zr.File), len(want))
+	}
+	for _, f := range zr.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Errorf("opening %s: %v", f.Name, err)
+			continue
+		}
+		data, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Errorf("reading %s: %v", f.Name, err)
+		} else if string(data) != want[f.Name] {
+			t.Errorf("%s holds %q, want %q", f.Name, data, want[f.Name])
+		}
+	}
+
+	// only the archive is left, no temporary file
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("%d files next to the archive", len(entries))
+	}
+}